@@ -2,37 +2,439 @@ package log_v1
 
 import (
 	"fmt"
+	"time"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
-type ErrOffsetOutOfRange struct {
+/*
+Every error the log service returns on purpose has a type here. Each type maps to the gRPC code that tells
+clients how to react: retry, back off, read from somewhere else, or give up. Each status also carries two details:
+an ErrorInfo whose reason identifies the error and whose metadata holds the error's fields, so FromError can
+rebuild the typed error on the client, and a LocalizedMessage that explains the error to people.
+*/
+
+// ErrorDomain is the domain of the ErrorInfo details of the log service's errors.
+const ErrorDomain = "proglog.ttaaoo.github.com"
+
+// The reasons of the ErrorInfo details, one per error type.
+const (
+	ReasonOffsetBelowLowest  = "OFFSET_BELOW_LOWEST"
+	ReasonOffsetAboveHighest = "OFFSET_ABOVE_HIGHEST"
+	ReasonSegmentCorrupt     = "SEGMENT_CORRUPT"
+	ReasonLogClosed          = "LOG_CLOSED"
+	ReasonDiskFull           = "DISK_FULL"
+	ReasonNotLeader          = "NOT_LEADER"
+	ReasonPermissionDenied   = "PERMISSION_DENIED"
+	ReasonUnauthenticated    = "UNAUTHENTICATED"
+	ReasonOutOfOrderSequence = "OUT_OF_ORDER_SEQUENCE"
+	ReasonUnknownTransaction = "UNKNOWN_TRANSACTION"
+	ReasonOffsetConflict     = "OFFSET_CONFLICT"
+	ReasonSlowConsumer       = "SLOW_CONSUMER"
+	ReasonQuotaExceeded      = "QUOTA_EXCEEDED"
+	ReasonControlRecord      = "CONTROL_RECORD"
+	ReasonBatchTooLarge      = "BATCH_TOO_LARGE"
+)
+
+// newStatus builds the status of an error with its ErrorInfo and LocalizedMessage details, and any other details the error has.
+func newStatus(
+	c codes.Code,
+	msg, reason string,
+	metadata map[string]string,
+	explanation string,
+	details ...protoadapt.MessageV1,
+) *status.Status {
+	st := status.New(c, msg)
+	std, err := st.WithDetails(append([]protoadapt.MessageV1{
+		&errdetails.ErrorInfo{
+			Reason:   reason,
+			Domain:   ErrorDomain,
+			Metadata: metadata,
+		},
+		&errdetails.LocalizedMessage{
+			Locale:  "en-US",
+			Message: explanation,
+		},
+	}, details...)...)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func offsetRangeMetadata(offset, lowest, highWatermark uint64) map[string]string {
+	return map[string]string{
+		"offset":         fmt.Sprint(offset),
+		"lowest_offset":  fmt.Sprint(lowest),
+		"high_watermark": fmt.Sprint(highWatermark),
+	}
+}
+
+// ErrOffsetBelowLowest is returned when reading an offset lower than the log's lowest offset,
+// usually because the log truncated it. Consumers should carry on from the lowest offset.
+type ErrOffsetBelowLowest struct {
 	Offset uint64
+	// the log's lowest offset and its next offset when the read failed
+	Lowest        uint64
+	HighWatermark uint64
 }
 
-func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
-	st := status.New(
-		404,
-		fmt.Sprintf("offset out of range: %d", e.Offset),
+func (e ErrOffsetBelowLowest) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.OutOfRange,
+		fmt.Sprintf("offset below lowest: %d", e.Offset),
+		ReasonOffsetBelowLowest,
+		offsetRangeMetadata(e.Offset, e.Lowest, e.HighWatermark),
+		fmt.Sprintf(
+			"The requested offset %d is below the log's lowest offset %d; the records were truncated",
+			e.Offset,
+			e.Lowest,
+		),
 	)
-	msg := fmt.Sprintf(
-		"The request offset is outside the log's range: %d",
-		e.Offset,
+}
+
+func (e ErrOffsetBelowLowest) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOffsetAboveHighest is returned when reading an offset at or past the log's high watermark,
+// the offset the next appended record gets. Consumers can wait for the record to be appended.
+type ErrOffsetAboveHighest struct {
+	Offset uint64
+	// the log's lowest offset and its next offset when the read failed
+	Lowest        uint64
+	HighWatermark uint64
+}
+
+func (e ErrOffsetAboveHighest) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.OutOfRange,
+		fmt.Sprintf("offset above highest: %d", e.Offset),
+		ReasonOffsetAboveHighest,
+		offsetRangeMetadata(e.Offset, e.Lowest, e.HighWatermark),
+		fmt.Sprintf(
+			"The requested offset %d is past the end of the log, whose next offset is %d",
+			e.Offset,
+			e.HighWatermark,
+		),
 	)
+}
 
-	d := &errdetails.LocalizedMessage{
-		Locale:  "en-US",
-		Message: msg,
-	}
+func (e ErrOffsetAboveHighest) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
 
-	std, err := st.WithDetails(d)
-	if err != nil {
-		return st
+// ErrSegmentCorrupt is returned when a record the log should have can't be read back from its segment:
+// the index points past the end of the store, or the store holds bytes that don't decode into a record.
+type ErrSegmentCorrupt struct {
+	BaseOffset uint64
+	Offset     uint64
+	// what went wrong reading the record
+	Cause error
+}
+
+func (e ErrSegmentCorrupt) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.DataLoss,
+		fmt.Sprintf("segment %d corrupt at offset %d: %v", e.BaseOffset, e.Offset, e.Cause),
+		ReasonSegmentCorrupt,
+		map[string]string{
+			"base_offset": fmt.Sprint(e.BaseOffset),
+			"offset":      fmt.Sprint(e.Offset),
+			"cause":       fmt.Sprint(e.Cause),
+		},
+		fmt.Sprintf("The record at offset %d can't be read from its segment, which is corrupt", e.Offset),
+	)
+}
+
+func (e ErrSegmentCorrupt) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrSegmentCorrupt) Unwrap() error {
+	return e.Cause
+}
+
+// ErrLogClosed is returned when reading from or appending to a log that was closed, like one whose server is shutting down.
+type ErrLogClosed struct{}
+
+func (e ErrLogClosed) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.Unavailable,
+		"log closed",
+		ReasonLogClosed,
+		nil,
+		"The log is closed, most likely because the server is shutting down",
+	)
+}
+
+func (e ErrLogClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrDiskFull is returned when the log can't append because its disk has no space left.
+type ErrDiskFull struct{}
+
+func (e ErrDiskFull) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.ResourceExhausted,
+		"disk full",
+		ReasonDiskFull,
+		nil,
+		"The log's disk has no space left for the records",
+	)
+}
+
+func (e ErrDiskFull) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned when producing to a server whose log doesn't take appends because it only follows another writer.
+type ErrNotLeader struct {
+	// the address of the server to produce to instead, if the server knows it
+	Leader string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	var metadata map[string]string
+	explanation := "The server doesn't take appends; produce to the leader instead"
+	if e.Leader != "" {
+		metadata = map[string]string{"leader": e.Leader}
+		explanation = fmt.Sprintf("The server doesn't take appends; produce to the leader at %s instead", e.Leader)
 	}
-	return std
+	return newStatus(
+		codes.FailedPrecondition,
+		"not leader",
+		ReasonNotLeader,
+		metadata,
+		explanation,
+	)
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPermissionDenied is returned when the ACL doesn't permit the client to perform the action on the object.
+type ErrPermissionDenied struct {
+	Subject string
+	Object  string
+	Action  string
+}
+
+func (e ErrPermissionDenied) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.PermissionDenied,
+		fmt.Sprintf("%s not permitted to %s to %s", e.Subject, e.Action, e.Object),
+		ReasonPermissionDenied,
+		map[string]string{
+			"subject": e.Subject,
+			"object":  e.Object,
+			"action":  e.Action,
+		},
+		fmt.Sprintf("The client %q isn't permitted to %s", e.Subject, e.Action),
+	)
+}
+
+func (e ErrPermissionDenied) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnauthenticated is returned when the client's credentials, like its bearer token, are invalid.
+type ErrUnauthenticated struct {
+	// why the server rejected the credentials
+	Cause string
+}
+
+func (e ErrUnauthenticated) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.Unauthenticated,
+		fmt.Sprintf("unauthenticated: %s", e.Cause),
+		ReasonUnauthenticated,
+		map[string]string{"cause": e.Cause},
+		"The server couldn't verify the client's credentials",
+	)
+}
+
+func (e ErrUnauthenticated) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOutOfOrderSequence is returned when an idempotent producer's record skips ahead of,
+// or falls too far behind, the sequence numbers the log has seen from the producer.
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+	// the sequence number the log expected next
+	Expected uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.FailedPrecondition,
+		fmt.Sprintf("out of order sequence for producer %d: %d", e.ProducerID, e.Sequence),
+		ReasonOutOfOrderSequence,
+		map[string]string{
+			"producer_id": fmt.Sprint(e.ProducerID),
+			"sequence":    fmt.Sprint(e.Sequence),
+			"expected":    fmt.Sprint(e.Expected),
+		},
+		fmt.Sprintf(
+			"The producer's sequence number %d doesn't follow the last one the log has seen, expected %d",
+			e.Sequence,
+			e.Expected,
+		),
+	)
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownTransaction is returned when producing to, committing, or aborting
+// a transaction that isn't open, because it never began, already ended, or timed out.
+type ErrUnknownTransaction struct {
+	TransactionID uint64
+}
+
+func (e ErrUnknownTransaction) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.FailedPrecondition,
+		fmt.Sprintf("unknown transaction: %d", e.TransactionID),
+		ReasonUnknownTransaction,
+		map[string]string{"transaction_id": fmt.Sprint(e.TransactionID)},
+		fmt.Sprintf(
+			"The transaction %d isn't open: it never began, it already ended, or it timed out",
+			e.TransactionID,
+		),
+	)
+}
+
+func (e ErrUnknownTransaction) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOffsetConflict is returned by conditional appends when the log's next offset
+// isn't the offset the producer expected, because someone else appended in the meantime.
+type ErrOffsetConflict struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrOffsetConflict) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.FailedPrecondition,
+		fmt.Sprintf("offset conflict: expected next offset %d, got %d", e.Expected, e.Actual),
+		ReasonOffsetConflict,
+		map[string]string{
+			"expected": fmt.Sprint(e.Expected),
+			"actual":   fmt.Sprint(e.Actual),
+		},
+		fmt.Sprintf(
+			"The log's next offset is %d, not %d: another record was appended since the producer last read the log",
+			e.Actual,
+			e.Expected,
+		),
+	)
+}
+
+func (e ErrOffsetConflict) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrSlowConsumer is returned when the server disconnects a stream whose consumer didn't take a response
+// within the server's send timeout, so the records waiting for the consumer don't pin the server's memory.
+// Consumers can reconnect from the offset after the last record they got.
+type ErrSlowConsumer struct {
+	SendTimeout time.Duration
+}
+
+func (e ErrSlowConsumer) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.DeadlineExceeded,
+		fmt.Sprintf("slow consumer: send timed out after %s", e.SendTimeout),
+		ReasonSlowConsumer,
+		map[string]string{"send_timeout": e.SendTimeout.String()},
+		fmt.Sprintf("The consumer didn't take the server's response within %s, so the server closed the stream", e.SendTimeout),
+	)
+}
+
+func (e ErrSlowConsumer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrQuotaExceeded is returned when a client has used up one of its quotas, like how many bytes it may produce per second.
+// Its status carries a RetryInfo detail saying how long the client should wait before it's back within its quota.
+type ErrQuotaExceeded struct {
+	Subject string
+	// the quota the client exceeded: produce_bytes, consume_bytes, or requests
+	Quota      string
+	RetryAfter time.Duration
+}
+
+func (e ErrQuotaExceeded) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.ResourceExhausted,
+		fmt.Sprintf("%s exceeded its %s quota, retry after %s", e.Subject, e.Quota, e.RetryAfter),
+		ReasonQuotaExceeded,
+		map[string]string{
+			"subject": e.Subject,
+			"quota":   e.Quota,
+		},
+		fmt.Sprintf("The client %q exceeded its %s quota; retry after %s", e.Subject, e.Quota, e.RetryAfter),
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(e.RetryAfter)},
+	)
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrControlRecord is returned when a producer sets a record's control type. Transaction markers are only
+// appended by committing or aborting the transaction, so producers can't end each other's transactions.
+type ErrControlRecord struct {
+	Control ControlType
+}
+
+func (e ErrControlRecord) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.InvalidArgument,
+		fmt.Sprintf("records can't set control type %s", e.Control),
+		ReasonControlRecord,
+		map[string]string{"control": e.Control.String()},
+		"Transaction markers are appended by committing or aborting the transaction, not by producing them",
+	)
+}
+
+func (e ErrControlRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrBatchTooLarge is returned when a batch has more records than a segment's index holds,
+// so the log can't append it even to a new segment.
+type ErrBatchTooLarge struct {
+	Records uint64
+	// the most records a segment holds
+	MaxRecords uint64
+}
+
+func (e ErrBatchTooLarge) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.InvalidArgument,
+		fmt.Sprintf("batch of %d records is too large", e.Records),
+		ReasonBatchTooLarge,
+		map[string]string{
+			"records":     fmt.Sprint(e.Records),
+			"max_records": fmt.Sprint(e.MaxRecords),
+		},
+		fmt.Sprintf("A batch can have at most %d records, split the batch into smaller ones", e.MaxRecords),
+	)
 }
 
-func (e ErrOffsetOutOfRange) Error() string {
+func (e ErrBatchTooLarge) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
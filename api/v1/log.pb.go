@@ -24,10 +24,235 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type ControlType int32
+
+const (
+	ControlType_CONTROL_NONE   ControlType = 0
+	ControlType_CONTROL_COMMIT ControlType = 1
+	ControlType_CONTROL_ABORT  ControlType = 2
+)
+
+// Enum value maps for ControlType.
+var (
+	ControlType_name = map[int32]string{
+		0: "CONTROL_NONE",
+		1: "CONTROL_COMMIT",
+		2: "CONTROL_ABORT",
+	}
+	ControlType_value = map[string]int32{
+		"CONTROL_NONE":   0,
+		"CONTROL_COMMIT": 1,
+		"CONTROL_ABORT":  2,
+	}
+)
+
+func (x ControlType) Enum() *ControlType {
+	p := new(ControlType)
+	*p = x
+	return p
+}
+
+func (x ControlType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ControlType) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[0].Descriptor()
+}
+
+func (ControlType) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[0]
+}
+
+func (x ControlType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ControlType.Descriptor instead.
+func (ControlType) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{0}
+}
+
+// IsolationLevel sets which records of transactions consumers see.
+type IsolationLevel int32
+
+const (
+	// every record, including the records of open and aborted transactions and their markers
+	IsolationLevel_READ_UNCOMMITTED IsolationLevel = 0
+	// only the records of committed transactions and records produced outside transactions
+	IsolationLevel_READ_COMMITTED IsolationLevel = 1
+)
+
+// Enum value maps for IsolationLevel.
+var (
+	IsolationLevel_name = map[int32]string{
+		0: "READ_UNCOMMITTED",
+		1: "READ_COMMITTED",
+	}
+	IsolationLevel_value = map[string]int32{
+		"READ_UNCOMMITTED": 0,
+		"READ_COMMITTED":   1,
+	}
+)
+
+func (x IsolationLevel) Enum() *IsolationLevel {
+	p := new(IsolationLevel)
+	*p = x
+	return p
+}
+
+func (x IsolationLevel) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (IsolationLevel) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[1].Descriptor()
+}
+
+func (IsolationLevel) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[1]
+}
+
+func (x IsolationLevel) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use IsolationLevel.Descriptor instead.
+func (IsolationLevel) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{1}
+}
+
+// StartPosition sets where consumers start reading.
+type StartPosition int32
+
+const (
+	// the request's offset
+	StartPosition_START_OFFSET StartPosition = 0
+	// the log's lowest offset
+	StartPosition_START_EARLIEST StartPosition = 1
+	// the log's next offset, so the consumer only sees the records appended from now on
+	StartPosition_START_LATEST StartPosition = 2
+	// the first record produced at or after the request's timestamp
+	StartPosition_START_TIMESTAMP StartPosition = 3
+)
+
+// Enum value maps for StartPosition.
+var (
+	StartPosition_name = map[int32]string{
+		0: "START_OFFSET",
+		1: "START_EARLIEST",
+		2: "START_LATEST",
+		3: "START_TIMESTAMP",
+	}
+	StartPosition_value = map[string]int32{
+		"START_OFFSET":    0,
+		"START_EARLIEST":  1,
+		"START_LATEST":    2,
+		"START_TIMESTAMP": 3,
+	}
+)
+
+func (x StartPosition) Enum() *StartPosition {
+	p := new(StartPosition)
+	*p = x
+	return p
+}
+
+func (x StartPosition) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (StartPosition) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[2].Descriptor()
+}
+
+func (StartPosition) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[2]
+}
+
+func (x StartPosition) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use StartPosition.Descriptor instead.
+func (StartPosition) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{2}
+}
+
+// OutOfRangePolicy sets what happens when a consumer's offset is out of the log's range,
+// because retention truncated it or it's past the end of the log.
+type OutOfRangePolicy int32
+
+const (
+	// fail the request with an out of range error
+	OutOfRangePolicy_OUT_OF_RANGE_FAIL OutOfRangePolicy = 0
+	// carry on from the log's lowest offset
+	OutOfRangePolicy_OUT_OF_RANGE_EARLIEST OutOfRangePolicy = 1
+	// carry on from the log's next offset
+	OutOfRangePolicy_OUT_OF_RANGE_LATEST OutOfRangePolicy = 2
+)
+
+// Enum value maps for OutOfRangePolicy.
+var (
+	OutOfRangePolicy_name = map[int32]string{
+		0: "OUT_OF_RANGE_FAIL",
+		1: "OUT_OF_RANGE_EARLIEST",
+		2: "OUT_OF_RANGE_LATEST",
+	}
+	OutOfRangePolicy_value = map[string]int32{
+		"OUT_OF_RANGE_FAIL":     0,
+		"OUT_OF_RANGE_EARLIEST": 1,
+		"OUT_OF_RANGE_LATEST":   2,
+	}
+)
+
+func (x OutOfRangePolicy) Enum() *OutOfRangePolicy {
+	p := new(OutOfRangePolicy)
+	*p = x
+	return p
+}
+
+func (x OutOfRangePolicy) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (OutOfRangePolicy) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[3].Descriptor()
+}
+
+func (OutOfRangePolicy) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[3]
+}
+
+func (x OutOfRangePolicy) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use OutOfRangePolicy.Descriptor instead.
+func (OutOfRangePolicy) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{3}
+}
+
 type Record struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Value         []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
-	Offset        uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Value  []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Offset uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	// set by idempotent producers: the ID the producer got from InitProducer
+	// and the producer's sequence number for the record, which goes up by one with each record
+	ProducerId uint64 `protobuf:"varint,3,opt,name=producer_id,json=producerId,proto3" json:"producer_id,omitempty"`
+	Sequence   uint64 `protobuf:"varint,4,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// the transaction the record was produced in, if any
+	TransactionId uint64 `protobuf:"varint,5,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	// set on the marker records the log appends when a transaction commits or aborts
+	Control ControlType `protobuf:"varint,6,opt,name=control,proto3,enum=log.v1.ControlType" json:"control,omitempty"`
+	// metadata the producer attaches to the record, like the trace context the server
+	// propagates to the record's consumers
+	Headers map[string]string `protobuf:"bytes,7,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// when the record was produced, in milliseconds since the Unix epoch;
+	// the log sets it to the append time if the producer doesn't
+	Timestamp int64 `protobuf:"varint,8,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// what the record is about, like a user ID, which consumers can filter on
+	Key           []byte `protobuf:"bytes,9,opt,name=key,proto3" json:"key,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -76,9 +301,62 @@ func (x *Record) GetOffset() uint64 {
 	return 0
 }
 
+func (x *Record) GetProducerId() uint64 {
+	if x != nil {
+		return x.ProducerId
+	}
+	return 0
+}
+
+func (x *Record) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *Record) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+func (x *Record) GetControl() ControlType {
+	if x != nil {
+		return x.Control
+	}
+	return ControlType_CONTROL_NONE
+}
+
+func (x *Record) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *Record) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Record) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
 type ProduceRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Record        *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Record *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	// when set, the record is only appended if the log's next offset is still this offset
+	ExpectedOffset *uint64 `protobuf:"varint,2,opt,name=expected_offset,json=expectedOffset,proto3,oneof" json:"expected_offset,omitempty"`
+	// a batch of records to append together instead of record, compressed with the log's codec if it has one
+	Records       []*Record `protobuf:"bytes,3,rep,name=records,proto3" json:"records,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -120,9 +398,24 @@ func (x *ProduceRequest) GetRecord() *Record {
 	return nil
 }
 
+func (x *ProduceRequest) GetExpectedOffset() uint64 {
+	if x != nil && x.ExpectedOffset != nil {
+		return *x.ExpectedOffset
+	}
+	return 0
+}
+
+func (x *ProduceRequest) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
 type ProduceResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the offset of the record, or of the batch's first record
+	Offset        uint64 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -165,8 +458,21 @@ func (x *ProduceResponse) GetOffset() uint64 {
 }
 
 type ConsumeRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Offset    uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Isolation IsolationLevel         `protobuf:"varint,2,opt,name=isolation,proto3,enum=log.v1.IsolationLevel" json:"isolation,omitempty"`
+	Start     StartPosition          `protobuf:"varint,3,opt,name=start,proto3,enum=log.v1.StartPosition" json:"start,omitempty"`
+	// for START_TIMESTAMP, in milliseconds since the Unix epoch
+	Timestamp  int64            `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	OutOfRange OutOfRangePolicy `protobuf:"varint,5,opt,name=out_of_range,json=outOfRange,proto3,enum=log.v1.OutOfRangePolicy" json:"out_of_range,omitempty"`
+	// for streams, the most bytes of records the server batches into one response; the server
+	// sends every record in its own response if it's zero. A record larger than the limit gets a batch of its own.
+	MaxBatchBytes uint32 `protobuf:"varint,6,opt,name=max_batch_bytes,json=maxBatchBytes,proto3" json:"max_batch_bytes,omitempty"`
+	// for batching streams, how long the server waits for more records to fill a batch
+	// once it has one, in milliseconds. The server sends what it has right away if it's zero.
+	MaxWaitMs uint32 `protobuf:"varint,7,opt,name=max_wait_ms,json=maxWaitMs,proto3" json:"max_wait_ms,omitempty"`
+	// for streams, the records the consumer wants; the server skips the others
+	Filter        *Filter `protobuf:"bytes,8,opt,name=filter,proto3" json:"filter,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -208,16 +514,136 @@ func (x *ConsumeRequest) GetOffset() uint64 {
 	return 0
 }
 
+func (x *ConsumeRequest) GetIsolation() IsolationLevel {
+	if x != nil {
+		return x.Isolation
+	}
+	return IsolationLevel_READ_UNCOMMITTED
+}
+
+func (x *ConsumeRequest) GetStart() StartPosition {
+	if x != nil {
+		return x.Start
+	}
+	return StartPosition_START_OFFSET
+}
+
+func (x *ConsumeRequest) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *ConsumeRequest) GetOutOfRange() OutOfRangePolicy {
+	if x != nil {
+		return x.OutOfRange
+	}
+	return OutOfRangePolicy_OUT_OF_RANGE_FAIL
+}
+
+func (x *ConsumeRequest) GetMaxBatchBytes() uint32 {
+	if x != nil {
+		return x.MaxBatchBytes
+	}
+	return 0
+}
+
+func (x *ConsumeRequest) GetMaxWaitMs() uint32 {
+	if x != nil {
+		return x.MaxWaitMs
+	}
+	return 0
+}
+
+func (x *ConsumeRequest) GetFilter() *Filter {
+	if x != nil {
+		return x.Filter
+	}
+	return nil
+}
+
+// Filter selects records by their key and headers. A record matches when it matches every condition that's set.
+type Filter struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// headers the record must carry, with these values
+	Headers map[string]string `protobuf:"bytes,1,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// what the record's key must start with
+	KeyPrefix []byte `protobuf:"bytes,2,opt,name=key_prefix,json=keyPrefix,proto3" json:"key_prefix,omitempty"`
+	// a CEL expression over the record's key (bytes), headers (map(string, string)) and timestamp (timestamp)
+	// that must be true, like: headers["type"] == "order" && timestamp > timestamp("2024-01-01T00:00:00Z").
+	// The record doesn't match if evaluating the expression fails, like when it reads a header the record doesn't carry.
+	Expression    string `protobuf:"bytes,3,opt,name=expression,proto3" json:"expression,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Filter) Reset() {
+	*x = Filter{}
+	mi := &file_api_v1_log_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Filter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Filter) ProtoMessage() {}
+
+func (x *Filter) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Filter.ProtoReflect.Descriptor instead.
+func (*Filter) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Filter) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *Filter) GetKeyPrefix() []byte {
+	if x != nil {
+		return x.KeyPrefix
+	}
+	return nil
+}
+
+func (x *Filter) GetExpression() string {
+	if x != nil {
+		return x.Expression
+	}
+	return ""
+}
+
 type ConsumeResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Record        *Record                `protobuf:"bytes,2,opt,name=record,proto3" json:"record,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the record, unless the request asked for batches
+	Record *Record `protobuf:"bytes,2,opt,name=record,proto3" json:"record,omitempty"`
+	// the batch of records, for requests with max_batch_bytes set
+	Records []*Record `protobuf:"bytes,4,rep,name=records,proto3" json:"records,omitempty"`
+	// the log's next offset when the record was read, so consumers know how far behind they are
+	HighWatermark uint64 `protobuf:"varint,3,opt,name=high_watermark,json=highWatermark,proto3" json:"high_watermark,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *ConsumeResponse) Reset() {
 	*x = ConsumeResponse{}
-	mi := &file_api_v1_log_proto_msgTypes[4]
+	mi := &file_api_v1_log_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -229,7 +655,7 @@ func (x *ConsumeResponse) String() string {
 func (*ConsumeResponse) ProtoMessage() {}
 
 func (x *ConsumeResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_api_v1_log_proto_msgTypes[4]
+	mi := &file_api_v1_log_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -242,7 +668,7 @@ func (x *ConsumeResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ConsumeResponse.ProtoReflect.Descriptor instead.
 func (*ConsumeResponse) Descriptor() ([]byte, []int) {
-	return file_api_v1_log_proto_rawDescGZIP(), []int{4}
+	return file_api_v1_log_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *ConsumeResponse) GetRecord() *Record {
@@ -252,83 +678,739 @@ func (x *ConsumeResponse) GetRecord() *Record {
 	return nil
 }
 
-var File_api_v1_log_proto protoreflect.FileDescriptor
-
-const file_api_v1_log_proto_rawDesc = "" +
-	"\n" +
-	"\x10api/v1/log.proto\x12\x06log.v1\"6\n" +
-	"\x06Record\x12\x14\n" +
-	"\x05value\x18\x01 \x01(\fR\x05value\x12\x16\n" +
-	"\x06offset\x18\x02 \x01(\x04R\x06offset\"8\n" +
-	"\x0eProduceRequest\x12&\n" +
-	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\")\n" +
-	"\x0fProduceResponse\x12\x16\n" +
-	"\x06offset\x18\x01 \x01(\x04R\x06offset\"(\n" +
-	"\x0eConsumeRequest\x12\x16\n" +
-	"\x06offset\x18\x01 \x01(\x04R\x06offset\"9\n" +
-	"\x0fConsumeResponse\x12&\n" +
-	"\x06record\x18\x02 \x01(\v2\x0e.log.v1.RecordR\x06record2\x8f\x02\n" +
-	"\x03Log\x12<\n" +
-	"\aProduce\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00\x12<\n" +
-	"\aConsume\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00\x12F\n" +
-	"\rProduceStream\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00(\x010\x01\x12D\n" +
-	"\rConsumeStream\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x000\x01B'Z%github.com/ttaatoo/proglog/api/log_v1b\x06proto3"
+func (x *ConsumeResponse) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
 
-var (
-	file_api_v1_log_proto_rawDescOnce sync.Once
-	file_api_v1_log_proto_rawDescData []byte
-)
+func (x *ConsumeResponse) GetHighWatermark() uint64 {
+	if x != nil {
+		return x.HighWatermark
+	}
+	return 0
+}
 
-func file_api_v1_log_proto_rawDescGZIP() []byte {
-	file_api_v1_log_proto_rawDescOnce.Do(func() {
-		file_api_v1_log_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_v1_log_proto_rawDesc), len(file_api_v1_log_proto_rawDesc)))
-	})
-	return file_api_v1_log_proto_rawDescData
+type SubscribeRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Request:
+	//
+	//	*SubscribeRequest_Consume
+	//	*SubscribeRequest_Credit
+	Request       isSubscribeRequest_Request `protobuf_oneof:"request"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
-var file_api_v1_log_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
-var file_api_v1_log_proto_goTypes = []any{
-	(*Record)(nil),          // 0: log.v1.Record
-	(*ProduceRequest)(nil),  // 1: log.v1.ProduceRequest
-	(*ProduceResponse)(nil), // 2: log.v1.ProduceResponse
-	(*ConsumeRequest)(nil),  // 3: log.v1.ConsumeRequest
-	(*ConsumeResponse)(nil), // 4: log.v1.ConsumeResponse
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
-var file_api_v1_log_proto_depIdxs = []int32{
-	0, // 0: log.v1.ProduceRequest.record:type_name -> log.v1.Record
-	0, // 1: log.v1.ConsumeResponse.record:type_name -> log.v1.Record
-	1, // 2: log.v1.Log.Produce:input_type -> log.v1.ProduceRequest
-	3, // 3: log.v1.Log.Consume:input_type -> log.v1.ConsumeRequest
-	1, // 4: log.v1.Log.ProduceStream:input_type -> log.v1.ProduceRequest
-	3, // 5: log.v1.Log.ConsumeStream:input_type -> log.v1.ConsumeRequest
-	2, // 6: log.v1.Log.Produce:output_type -> log.v1.ProduceResponse
-	4, // 7: log.v1.Log.Consume:output_type -> log.v1.ConsumeResponse
-	2, // 8: log.v1.Log.ProduceStream:output_type -> log.v1.ProduceResponse
-	4, // 9: log.v1.Log.ConsumeStream:output_type -> log.v1.ConsumeResponse
-	6, // [6:10] is the sub-list for method output_type
-	2, // [2:6] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-func init() { file_api_v1_log_proto_init() }
-func file_api_v1_log_proto_init() {
-	if File_api_v1_log_proto != nil {
-		return
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SubscribeRequest) GetRequest() isSubscribeRequest_Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetConsume() *ConsumeRequest {
+	if x != nil {
+		if x, ok := x.Request.(*SubscribeRequest_Consume); ok {
+			return x.Consume
+		}
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetCredit() uint32 {
+	if x != nil {
+		if x, ok := x.Request.(*SubscribeRequest_Credit); ok {
+			return x.Credit
+		}
+	}
+	return 0
+}
+
+type isSubscribeRequest_Request interface {
+	isSubscribeRequest_Request()
+}
+
+type SubscribeRequest_Consume struct {
+	// what to consume, in the stream's first message
+	Consume *ConsumeRequest `protobuf:"bytes,1,opt,name=consume,proto3,oneof"`
+}
+
+type SubscribeRequest_Credit struct {
+	// how many more records the server may send
+	Credit uint32 `protobuf:"varint,2,opt,name=credit,proto3,oneof"`
+}
+
+func (*SubscribeRequest_Consume) isSubscribeRequest_Request() {}
+
+func (*SubscribeRequest_Credit) isSubscribeRequest_Request() {}
+
+type InitProducerRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InitProducerRequest) Reset() {
+	*x = InitProducerRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InitProducerRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InitProducerRequest) ProtoMessage() {}
+
+func (x *InitProducerRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InitProducerRequest.ProtoReflect.Descriptor instead.
+func (*InitProducerRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{7}
+}
+
+type InitProducerResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ProducerId    uint64                 `protobuf:"varint,1,opt,name=producer_id,json=producerId,proto3" json:"producer_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InitProducerResponse) Reset() {
+	*x = InitProducerResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InitProducerResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InitProducerResponse) ProtoMessage() {}
+
+func (x *InitProducerResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InitProducerResponse.ProtoReflect.Descriptor instead.
+func (*InitProducerResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *InitProducerResponse) GetProducerId() uint64 {
+	if x != nil {
+		return x.ProducerId
+	}
+	return 0
+}
+
+type BeginTransactionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BeginTransactionRequest) Reset() {
+	*x = BeginTransactionRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BeginTransactionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BeginTransactionRequest) ProtoMessage() {}
+
+func (x *BeginTransactionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BeginTransactionRequest.ProtoReflect.Descriptor instead.
+func (*BeginTransactionRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{9}
+}
+
+type BeginTransactionResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TransactionId uint64                 `protobuf:"varint,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BeginTransactionResponse) Reset() {
+	*x = BeginTransactionResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BeginTransactionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BeginTransactionResponse) ProtoMessage() {}
+
+func (x *BeginTransactionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BeginTransactionResponse.ProtoReflect.Descriptor instead.
+func (*BeginTransactionResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *BeginTransactionResponse) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+type EndTransactionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TransactionId uint64                 `protobuf:"varint,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EndTransactionRequest) Reset() {
+	*x = EndTransactionRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EndTransactionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndTransactionRequest) ProtoMessage() {}
+
+func (x *EndTransactionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndTransactionRequest.ProtoReflect.Descriptor instead.
+func (*EndTransactionRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *EndTransactionRequest) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+type EndTransactionResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the offset of the transaction's commit or abort marker
+	Offset        uint64 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EndTransactionResponse) Reset() {
+	*x = EndTransactionResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EndTransactionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndTransactionResponse) ProtoMessage() {}
+
+func (x *EndTransactionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndTransactionResponse.ProtoReflect.Descriptor instead.
+func (*EndTransactionResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *EndTransactionResponse) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+type TruncateRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the lowest offset to keep; the segment holding it and the ones after it stay
+	Lowest        uint64 `protobuf:"varint,1,opt,name=lowest,proto3" json:"lowest,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TruncateRequest) Reset() {
+	*x = TruncateRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TruncateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TruncateRequest) ProtoMessage() {}
+
+func (x *TruncateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TruncateRequest.ProtoReflect.Descriptor instead.
+func (*TruncateRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *TruncateRequest) GetLowest() uint64 {
+	if x != nil {
+		return x.Lowest
+	}
+	return 0
+}
+
+type TruncateResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the log's lowest offset after the truncation
+	LowestOffset  uint64 `protobuf:"varint,1,opt,name=lowest_offset,json=lowestOffset,proto3" json:"lowest_offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TruncateResponse) Reset() {
+	*x = TruncateResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TruncateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TruncateResponse) ProtoMessage() {}
+
+func (x *TruncateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TruncateResponse.ProtoReflect.Descriptor instead.
+func (*TruncateResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *TruncateResponse) GetLowestOffset() uint64 {
+	if x != nil {
+		return x.LowestOffset
+	}
+	return 0
+}
+
+type SnapshotRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// decrypt the records of encrypted segments
+	Plaintext     bool `protobuf:"varint,1,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *SnapshotRequest) GetPlaintext() bool {
+	if x != nil {
+		return x.Plaintext
+	}
+	return false
+}
+
+type SnapshotChunk struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the next bytes of the snapshot: record frames, each a big-endian uint64 length followed by the record
+	Data          []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotChunk) Reset() {
+	*x = SnapshotChunk{}
+	mi := &file_api_v1_log_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotChunk) ProtoMessage() {}
+
+func (x *SnapshotChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotChunk.ProtoReflect.Descriptor instead.
+func (*SnapshotChunk) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *SnapshotChunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+var File_api_v1_log_proto protoreflect.FileDescriptor
+
+const file_api_v1_log_proto_rawDesc = "" +
+	"\n" +
+	"\x10api/v1/log.proto\x12\x06log.v1\"\xec\x02\n" +
+	"\x06Record\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\fR\x05value\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\x12\x1f\n" +
+	"\vproducer_id\x18\x03 \x01(\x04R\n" +
+	"producerId\x12\x1a\n" +
+	"\bsequence\x18\x04 \x01(\x04R\bsequence\x12%\n" +
+	"\x0etransaction_id\x18\x05 \x01(\x04R\rtransactionId\x12-\n" +
+	"\acontrol\x18\x06 \x01(\x0e2\x13.log.v1.ControlTypeR\acontrol\x125\n" +
+	"\aheaders\x18\a \x03(\v2\x1b.log.v1.Record.HeadersEntryR\aheaders\x12\x1c\n" +
+	"\ttimestamp\x18\b \x01(\x03R\ttimestamp\x12\x10\n" +
+	"\x03key\x18\t \x01(\fR\x03key\x1a:\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xa4\x01\n" +
+	"\x0eProduceRequest\x12&\n" +
+	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\x12,\n" +
+	"\x0fexpected_offset\x18\x02 \x01(\x04H\x00R\x0eexpectedOffset\x88\x01\x01\x12(\n" +
+	"\arecords\x18\x03 \x03(\v2\x0e.log.v1.RecordR\arecordsB\x12\n" +
+	"\x10_expected_offset\")\n" +
+	"\x0fProduceResponse\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\"\xd5\x02\n" +
+	"\x0eConsumeRequest\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x124\n" +
+	"\tisolation\x18\x02 \x01(\x0e2\x16.log.v1.IsolationLevelR\tisolation\x12+\n" +
+	"\x05start\x18\x03 \x01(\x0e2\x15.log.v1.StartPositionR\x05start\x12\x1c\n" +
+	"\ttimestamp\x18\x04 \x01(\x03R\ttimestamp\x12:\n" +
+	"\fout_of_range\x18\x05 \x01(\x0e2\x18.log.v1.OutOfRangePolicyR\n" +
+	"outOfRange\x12&\n" +
+	"\x0fmax_batch_bytes\x18\x06 \x01(\rR\rmaxBatchBytes\x12\x1e\n" +
+	"\vmax_wait_ms\x18\a \x01(\rR\tmaxWaitMs\x12&\n" +
+	"\x06filter\x18\b \x01(\v2\x0e.log.v1.FilterR\x06filter\"\xba\x01\n" +
+	"\x06Filter\x125\n" +
+	"\aheaders\x18\x01 \x03(\v2\x1b.log.v1.Filter.HeadersEntryR\aheaders\x12\x1d\n" +
+	"\n" +
+	"key_prefix\x18\x02 \x01(\fR\tkeyPrefix\x12\x1e\n" +
+	"\n" +
+	"expression\x18\x03 \x01(\tR\n" +
+	"expression\x1a:\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x8a\x01\n" +
+	"\x0fConsumeResponse\x12&\n" +
+	"\x06record\x18\x02 \x01(\v2\x0e.log.v1.RecordR\x06record\x12(\n" +
+	"\arecords\x18\x04 \x03(\v2\x0e.log.v1.RecordR\arecords\x12%\n" +
+	"\x0ehigh_watermark\x18\x03 \x01(\x04R\rhighWatermark\"k\n" +
+	"\x10SubscribeRequest\x122\n" +
+	"\aconsume\x18\x01 \x01(\v2\x16.log.v1.ConsumeRequestH\x00R\aconsume\x12\x18\n" +
+	"\x06credit\x18\x02 \x01(\rH\x00R\x06creditB\t\n" +
+	"\arequest\"\x15\n" +
+	"\x13InitProducerRequest\"7\n" +
+	"\x14InitProducerResponse\x12\x1f\n" +
+	"\vproducer_id\x18\x01 \x01(\x04R\n" +
+	"producerId\"\x19\n" +
+	"\x17BeginTransactionRequest\"A\n" +
+	"\x18BeginTransactionResponse\x12%\n" +
+	"\x0etransaction_id\x18\x01 \x01(\x04R\rtransactionId\">\n" +
+	"\x15EndTransactionRequest\x12%\n" +
+	"\x0etransaction_id\x18\x01 \x01(\x04R\rtransactionId\"0\n" +
+	"\x16EndTransactionResponse\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\")\n" +
+	"\x0fTruncateRequest\x12\x16\n" +
+	"\x06lowest\x18\x01 \x01(\x04R\x06lowest\"7\n" +
+	"\x10TruncateResponse\x12#\n" +
+	"\rlowest_offset\x18\x01 \x01(\x04R\flowestOffset\"/\n" +
+	"\x0fSnapshotRequest\x12\x1c\n" +
+	"\tplaintext\x18\x01 \x01(\bR\tplaintext\"#\n" +
+	"\rSnapshotChunk\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data*F\n" +
+	"\vControlType\x12\x10\n" +
+	"\fCONTROL_NONE\x10\x00\x12\x12\n" +
+	"\x0eCONTROL_COMMIT\x10\x01\x12\x11\n" +
+	"\rCONTROL_ABORT\x10\x02*:\n" +
+	"\x0eIsolationLevel\x12\x14\n" +
+	"\x10READ_UNCOMMITTED\x10\x00\x12\x12\n" +
+	"\x0eREAD_COMMITTED\x10\x01*\\\n" +
+	"\rStartPosition\x12\x10\n" +
+	"\fSTART_OFFSET\x10\x00\x12\x12\n" +
+	"\x0eSTART_EARLIEST\x10\x01\x12\x10\n" +
+	"\fSTART_LATEST\x10\x02\x12\x13\n" +
+	"\x0fSTART_TIMESTAMP\x10\x03*]\n" +
+	"\x10OutOfRangePolicy\x12\x15\n" +
+	"\x11OUT_OF_RANGE_FAIL\x10\x00\x12\x19\n" +
+	"\x15OUT_OF_RANGE_EARLIEST\x10\x01\x12\x17\n" +
+	"\x13OUT_OF_RANGE_LATEST\x10\x022\xa7\x06\n" +
+	"\x03Log\x12<\n" +
+	"\aProduce\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00\x12<\n" +
+	"\aConsume\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00\x12F\n" +
+	"\rProduceStream\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00(\x010\x01\x12D\n" +
+	"\rConsumeStream\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x000\x01\x12D\n" +
+	"\tSubscribe\x12\x18.log.v1.SubscribeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00(\x010\x01\x12K\n" +
+	"\fInitProducer\x12\x1b.log.v1.InitProducerRequest\x1a\x1c.log.v1.InitProducerResponse\"\x00\x12W\n" +
+	"\x10BeginTransaction\x12\x1f.log.v1.BeginTransactionRequest\x1a .log.v1.BeginTransactionResponse\"\x00\x12T\n" +
+	"\x11CommitTransaction\x12\x1d.log.v1.EndTransactionRequest\x1a\x1e.log.v1.EndTransactionResponse\"\x00\x12S\n" +
+	"\x10AbortTransaction\x12\x1d.log.v1.EndTransactionRequest\x1a\x1e.log.v1.EndTransactionResponse\"\x00\x12?\n" +
+	"\bTruncate\x12\x17.log.v1.TruncateRequest\x1a\x18.log.v1.TruncateResponse\"\x00\x12>\n" +
+	"\bSnapshot\x12\x17.log.v1.SnapshotRequest\x1a\x15.log.v1.SnapshotChunk\"\x000\x01B'Z%github.com/ttaatoo/proglog/api/log_v1b\x06proto3"
+
+var (
+	file_api_v1_log_proto_rawDescOnce sync.Once
+	file_api_v1_log_proto_rawDescData []byte
+)
+
+func file_api_v1_log_proto_rawDescGZIP() []byte {
+	file_api_v1_log_proto_rawDescOnce.Do(func() {
+		file_api_v1_log_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_v1_log_proto_rawDesc), len(file_api_v1_log_proto_rawDesc)))
+	})
+	return file_api_v1_log_proto_rawDescData
+}
+
+var file_api_v1_log_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_api_v1_log_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
+var file_api_v1_log_proto_goTypes = []any{
+	(ControlType)(0),                 // 0: log.v1.ControlType
+	(IsolationLevel)(0),              // 1: log.v1.IsolationLevel
+	(StartPosition)(0),               // 2: log.v1.StartPosition
+	(OutOfRangePolicy)(0),            // 3: log.v1.OutOfRangePolicy
+	(*Record)(nil),                   // 4: log.v1.Record
+	(*ProduceRequest)(nil),           // 5: log.v1.ProduceRequest
+	(*ProduceResponse)(nil),          // 6: log.v1.ProduceResponse
+	(*ConsumeRequest)(nil),           // 7: log.v1.ConsumeRequest
+	(*Filter)(nil),                   // 8: log.v1.Filter
+	(*ConsumeResponse)(nil),          // 9: log.v1.ConsumeResponse
+	(*SubscribeRequest)(nil),         // 10: log.v1.SubscribeRequest
+	(*InitProducerRequest)(nil),      // 11: log.v1.InitProducerRequest
+	(*InitProducerResponse)(nil),     // 12: log.v1.InitProducerResponse
+	(*BeginTransactionRequest)(nil),  // 13: log.v1.BeginTransactionRequest
+	(*BeginTransactionResponse)(nil), // 14: log.v1.BeginTransactionResponse
+	(*EndTransactionRequest)(nil),    // 15: log.v1.EndTransactionRequest
+	(*EndTransactionResponse)(nil),   // 16: log.v1.EndTransactionResponse
+	(*TruncateRequest)(nil),          // 17: log.v1.TruncateRequest
+	(*TruncateResponse)(nil),         // 18: log.v1.TruncateResponse
+	(*SnapshotRequest)(nil),          // 19: log.v1.SnapshotRequest
+	(*SnapshotChunk)(nil),            // 20: log.v1.SnapshotChunk
+	nil,                              // 21: log.v1.Record.HeadersEntry
+	nil,                              // 22: log.v1.Filter.HeadersEntry
+}
+var file_api_v1_log_proto_depIdxs = []int32{
+	0,  // 0: log.v1.Record.control:type_name -> log.v1.ControlType
+	21, // 1: log.v1.Record.headers:type_name -> log.v1.Record.HeadersEntry
+	4,  // 2: log.v1.ProduceRequest.record:type_name -> log.v1.Record
+	4,  // 3: log.v1.ProduceRequest.records:type_name -> log.v1.Record
+	1,  // 4: log.v1.ConsumeRequest.isolation:type_name -> log.v1.IsolationLevel
+	2,  // 5: log.v1.ConsumeRequest.start:type_name -> log.v1.StartPosition
+	3,  // 6: log.v1.ConsumeRequest.out_of_range:type_name -> log.v1.OutOfRangePolicy
+	8,  // 7: log.v1.ConsumeRequest.filter:type_name -> log.v1.Filter
+	22, // 8: log.v1.Filter.headers:type_name -> log.v1.Filter.HeadersEntry
+	4,  // 9: log.v1.ConsumeResponse.record:type_name -> log.v1.Record
+	4,  // 10: log.v1.ConsumeResponse.records:type_name -> log.v1.Record
+	7,  // 11: log.v1.SubscribeRequest.consume:type_name -> log.v1.ConsumeRequest
+	5,  // 12: log.v1.Log.Produce:input_type -> log.v1.ProduceRequest
+	7,  // 13: log.v1.Log.Consume:input_type -> log.v1.ConsumeRequest
+	5,  // 14: log.v1.Log.ProduceStream:input_type -> log.v1.ProduceRequest
+	7,  // 15: log.v1.Log.ConsumeStream:input_type -> log.v1.ConsumeRequest
+	10, // 16: log.v1.Log.Subscribe:input_type -> log.v1.SubscribeRequest
+	11, // 17: log.v1.Log.InitProducer:input_type -> log.v1.InitProducerRequest
+	13, // 18: log.v1.Log.BeginTransaction:input_type -> log.v1.BeginTransactionRequest
+	15, // 19: log.v1.Log.CommitTransaction:input_type -> log.v1.EndTransactionRequest
+	15, // 20: log.v1.Log.AbortTransaction:input_type -> log.v1.EndTransactionRequest
+	17, // 21: log.v1.Log.Truncate:input_type -> log.v1.TruncateRequest
+	19, // 22: log.v1.Log.Snapshot:input_type -> log.v1.SnapshotRequest
+	6,  // 23: log.v1.Log.Produce:output_type -> log.v1.ProduceResponse
+	9,  // 24: log.v1.Log.Consume:output_type -> log.v1.ConsumeResponse
+	6,  // 25: log.v1.Log.ProduceStream:output_type -> log.v1.ProduceResponse
+	9,  // 26: log.v1.Log.ConsumeStream:output_type -> log.v1.ConsumeResponse
+	9,  // 27: log.v1.Log.Subscribe:output_type -> log.v1.ConsumeResponse
+	12, // 28: log.v1.Log.InitProducer:output_type -> log.v1.InitProducerResponse
+	14, // 29: log.v1.Log.BeginTransaction:output_type -> log.v1.BeginTransactionResponse
+	16, // 30: log.v1.Log.CommitTransaction:output_type -> log.v1.EndTransactionResponse
+	16, // 31: log.v1.Log.AbortTransaction:output_type -> log.v1.EndTransactionResponse
+	18, // 32: log.v1.Log.Truncate:output_type -> log.v1.TruncateResponse
+	20, // 33: log.v1.Log.Snapshot:output_type -> log.v1.SnapshotChunk
+	23, // [23:34] is the sub-list for method output_type
+	12, // [12:23] is the sub-list for method input_type
+	12, // [12:12] is the sub-list for extension type_name
+	12, // [12:12] is the sub-list for extension extendee
+	0,  // [0:12] is the sub-list for field type_name
+}
+
+func init() { file_api_v1_log_proto_init() }
+func file_api_v1_log_proto_init() {
+	if File_api_v1_log_proto != nil {
+		return
+	}
+	file_api_v1_log_proto_msgTypes[1].OneofWrappers = []any{}
+	file_api_v1_log_proto_msgTypes[6].OneofWrappers = []any{
+		(*SubscribeRequest_Consume)(nil),
+		(*SubscribeRequest_Credit)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_v1_log_proto_rawDesc), len(file_api_v1_log_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   5,
+			NumEnums:      4,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_api_v1_log_proto_goTypes,
 		DependencyIndexes: file_api_v1_log_proto_depIdxs,
+		EnumInfos:         file_api_v1_log_proto_enumTypes,
 		MessageInfos:      file_api_v1_log_proto_msgTypes,
 	}.Build()
 	File_api_v1_log_proto = out.File
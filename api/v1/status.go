@@ -0,0 +1,126 @@
+package log_v1
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Clients get the log service's errors as gRPC status errors. FromError turns them back into the typed errors
+of this package, so clients can handle them with errors.As instead of parsing messages:
+
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+	var below api.ErrOffsetBelowLowest
+	if errors.As(api.FromError(err), &below) {
+		offset = below.Lowest
+	}
+*/
+
+// FromError returns the typed error the status error stands for,
+// or the error itself if it isn't one of the log service's errors.
+func FromError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	info := errorInfo(st)
+	if info == nil {
+		return err
+	}
+
+	m := info.Metadata
+	switch info.Reason {
+	case ReasonOffsetBelowLowest:
+		return ErrOffsetBelowLowest{
+			Offset:        parseUint(m["offset"]),
+			Lowest:        parseUint(m["lowest_offset"]),
+			HighWatermark: parseUint(m["high_watermark"]),
+		}
+	case ReasonOffsetAboveHighest:
+		return ErrOffsetAboveHighest{
+			Offset:        parseUint(m["offset"]),
+			Lowest:        parseUint(m["lowest_offset"]),
+			HighWatermark: parseUint(m["high_watermark"]),
+		}
+	case ReasonSegmentCorrupt:
+		return ErrSegmentCorrupt{
+			BaseOffset: parseUint(m["base_offset"]),
+			Offset:     parseUint(m["offset"]),
+			Cause:      errors.New(m["cause"]),
+		}
+	case ReasonLogClosed:
+		return ErrLogClosed{}
+	case ReasonDiskFull:
+		return ErrDiskFull{}
+	case ReasonNotLeader:
+		return ErrNotLeader{Leader: m["leader"]}
+	case ReasonPermissionDenied:
+		return ErrPermissionDenied{Subject: m["subject"], Object: m["object"], Action: m["action"]}
+	case ReasonUnauthenticated:
+		return ErrUnauthenticated{Cause: m["cause"]}
+	case ReasonOutOfOrderSequence:
+		return ErrOutOfOrderSequence{
+			ProducerID: parseUint(m["producer_id"]),
+			Sequence:   parseUint(m["sequence"]),
+			Expected:   parseUint(m["expected"]),
+		}
+	case ReasonUnknownTransaction:
+		return ErrUnknownTransaction{TransactionID: parseUint(m["transaction_id"])}
+	case ReasonOffsetConflict:
+		return ErrOffsetConflict{Expected: parseUint(m["expected"]), Actual: parseUint(m["actual"])}
+	case ReasonSlowConsumer:
+		timeout, _ := time.ParseDuration(m["send_timeout"])
+		return ErrSlowConsumer{SendTimeout: timeout}
+	case ReasonQuotaExceeded:
+		return ErrQuotaExceeded{Subject: m["subject"], Quota: m["quota"], RetryAfter: RetryAfter(err)}
+	case ReasonControlRecord:
+		return ErrControlRecord{Control: ControlType(ControlType_value[m["control"]])}
+	case ReasonBatchTooLarge:
+		return ErrBatchTooLarge{Records: parseUint(m["records"]), MaxRecords: parseUint(m["max_records"])}
+	}
+	return err
+}
+
+// IsOffsetOutOfRange reports whether the error, typed or a status error, is ErrOffsetBelowLowest or ErrOffsetAboveHighest.
+func IsOffsetOutOfRange(err error) bool {
+	err = FromError(err)
+	var below ErrOffsetBelowLowest
+	var above ErrOffsetAboveHighest
+	return errors.As(err, &below) || errors.As(err, &above)
+}
+
+// RetryAfter returns how long the status error's RetryInfo detail tells the client to wait before retrying, or zero if it has none.
+func RetryAfter(err error) time.Duration {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	return 0
+}
+
+// errorInfo returns the status's ErrorInfo detail of the log service's domain, if it has one.
+func errorInfo(st *status.Status) *errdetails.ErrorInfo {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return info
+		}
+	}
+	return nil
+}
+
+func parseUint(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
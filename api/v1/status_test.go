@@ -0,0 +1,68 @@
+package log_v1
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFromError(t *testing.T) {
+	for want, code := range map[error]codes.Code{
+		ErrOffsetBelowLowest{Offset: 1, Lowest: 5, HighWatermark: 10}:   codes.OutOfRange,
+		ErrOffsetAboveHighest{Offset: 12, Lowest: 5, HighWatermark: 10}: codes.OutOfRange,
+		ErrLogClosed{}:                         codes.Unavailable,
+		ErrDiskFull{}:                          codes.ResourceExhausted,
+		ErrNotLeader{Leader: "127.0.0.1:8400"}: codes.FailedPrecondition,
+		ErrNotLeader{}:                         codes.FailedPrecondition,
+		ErrPermissionDenied{Subject: "nobody", Object: "*", Action: "produce"}:        codes.PermissionDenied,
+		ErrOutOfOrderSequence{ProducerID: 1, Sequence: 4, Expected: 2}:                codes.FailedPrecondition,
+		ErrUnknownTransaction{TransactionID: 7}:                                       codes.FailedPrecondition,
+		ErrOffsetConflict{Expected: 3, Actual: 4}:                                     codes.FailedPrecondition,
+		ErrUnauthenticated{Cause: "token expired"}:                                    codes.Unauthenticated,
+		ErrSlowConsumer{SendTimeout: 5 * time.Second}:                                 codes.DeadlineExceeded,
+		ErrQuotaExceeded{Subject: "root", Quota: "requests", RetryAfter: time.Second}: codes.ResourceExhausted,
+		ErrControlRecord{Control: ControlType_CONTROL_COMMIT}:                         codes.InvalidArgument,
+		ErrBatchTooLarge{Records: 10, MaxRecords: 8}:                                  codes.InvalidArgument,
+	} {
+		// what the client gets is the status error gRPC rebuilds from the server's status
+		st := status.Convert(want)
+		require.Equal(t, code, st.Code())
+		got := FromError(st.Err())
+		require.Equal(t, want, got)
+	}
+
+	corrupt := ErrSegmentCorrupt{BaseOffset: 16, Offset: 20, Cause: io.ErrUnexpectedEOF}
+	st := status.Convert(corrupt)
+	require.Equal(t, codes.DataLoss, st.Code())
+	var got ErrSegmentCorrupt
+	require.ErrorAs(t, FromError(st.Err()), &got)
+	require.Equal(t, uint64(16), got.BaseOffset)
+	require.Equal(t, uint64(20), got.Offset)
+	require.EqualError(t, got.Cause, io.ErrUnexpectedEOF.Error())
+
+	// errors that aren't the log service's are returned as is
+	other := status.Error(codes.Internal, "boom")
+	require.Equal(t, other, FromError(other))
+	plain := errors.New("boom")
+	require.Equal(t, plain, FromError(plain))
+	require.Nil(t, FromError(nil))
+}
+
+func TestRetryAfter(t *testing.T) {
+	err := status.Convert(ErrQuotaExceeded{Subject: "root", Quota: "produce_bytes", RetryAfter: 250 * time.Millisecond}).Err()
+	require.Equal(t, 250*time.Millisecond, RetryAfter(err))
+	require.Zero(t, RetryAfter(status.Convert(ErrDiskFull{}).Err()))
+	require.Zero(t, RetryAfter(errors.New("boom")))
+}
+
+func TestIsOffsetOutOfRange(t *testing.T) {
+	require.True(t, IsOffsetOutOfRange(ErrOffsetBelowLowest{}))
+	require.True(t, IsOffsetOutOfRange(status.Convert(ErrOffsetAboveHighest{}).Err()))
+	require.False(t, IsOffsetOutOfRange(ErrLogClosed{}))
+	require.False(t, IsOffsetOutOfRange(errors.New("boom")))
+}
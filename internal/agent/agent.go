@@ -1,18 +1,36 @@
 package agent
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	api "github.com/ttaaoo/proglog/api/v1"
 	"github.com/ttaaoo/proglog/internal/auth"
+	"github.com/ttaaoo/proglog/internal/config"
 	"github.com/ttaaoo/proglog/internal/discovery"
 	"github.com/ttaaoo/proglog/internal/log"
 	"github.com/ttaaoo/proglog/internal/server"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type Config struct {
@@ -29,6 +47,47 @@ type Config struct {
 	StartJoinAddrs []string
 	ACLModelFile   string
 	ACLPolicyFile  string
+	// Topic names the agent's log in ACL policies, which grant actions on topics or topic prefixes like orders.*.
+	// Defaults to "log".
+	Topic string
+	// TierDir is the secondary storage directory that closed segments are
+	// offloaded to once they're older than OffloadAfter. Offloading is disabled when it's empty.
+	TierDir      string
+	OffloadAfter time.Duration
+	// EncryptionKeyFile is the file of the keys the log encrypts records with at rest, one "id base64-key"
+	// line per key, where the last key encrypts new segments. The log isn't encrypted when it's empty.
+	EncryptionKeyFile string
+	// Compression names the codec the log compresses produced batches of records with:
+	// gzip, snappy, zstd, or lz4. Batches are appended as individual records when it's empty or "none".
+	Compression string
+	// HTTPPort is the port the agent serves its Prometheus metrics on, at /metrics,
+	// on the same host as BindAddr. The agent doesn't serve metrics when it's zero.
+	HTTPPort int
+	// OTLPEndpoint is the URL of the OTLP gRPC endpoint the agent exports its traces to,
+	// like http://localhost:4317. The agent doesn't export traces when it's empty.
+	OTLPEndpoint string
+	// TracerProvider overrides the provider the agent traces with, for example to record spans in tests.
+	TracerProvider trace.TracerProvider
+	// HealthCheckInterval is how often the agent checks that its log can take appends,
+	// reporting NOT_SERVING while it can't. Defaults to 10 seconds.
+	HealthCheckInterval time.Duration
+	// SendTimeout is how long the server waits for a stream's consumer to take a response
+	// before it disconnects the consumer. Streams wait forever if it's zero.
+	SendTimeout time.Duration
+	// Quotas limit what each client may do per second, by the subject of the client's certificate,
+	// with the quota under "*" applying to clients without their own.
+	Quotas map[string]server.Quota
+	// JWKSFile, if set, makes the agent accept JWT bearer tokens signed with the keys of the JSON Web Key Set,
+	// ahead of client certificates. The tokens' JWTSubjectClaim holds the client's subject, "sub" by default,
+	// and they must have the JWTIssuer and JWTAudience if those are set.
+	JWKSFile        string
+	JWTSubjectClaim string
+	JWTIssuer       string
+	JWTAudience     string
+	// AuditFile, if set, is the file the agent appends the audit events of its authorization decisions to, as lines of JSON.
+	AuditFile string
+	// AuditLog makes the agent append the audit events to a log of their own, in the audit directory of DataDir.
+	AuditLog bool
 }
 
 // An Agent runs on every service instance, setting up and connecting
@@ -39,8 +98,16 @@ type Agent struct {
 
 	log        *log.Log
 	server     *grpc.Server
+	authorizer *auth.Authorizer
+	auditFile  *server.FileAuditSink
+	auditLog   *log.Log
 	membership *discovery.Membership
 	replicator *log.Replicator
+	registry   *prometheus.Registry
+	httpServer *http.Server
+	// the provider the agent created to export to OTLPEndpoint, which the agent shuts down
+	exporter *sdktrace.TracerProvider
+	health   *health.Server
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -56,14 +123,30 @@ func (c Config) RPCAddr() (string, error) {
 	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
 }
 
+func (c Config) HTTPAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%d", host, c.HTTPPort), nil
+}
+
 func New(config Config) (*Agent, error) {
 	a := &Agent{
 		Config:    config,
+		registry:  prometheus.NewRegistry(),
+		health:    health.NewServer(),
 		shutdowns: make(chan struct{}),
 	}
+	// the agent isn't ready until it has set up its log, which may have to recover, and joined the cluster
+	a.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
 
 	setup := []func() error{
 		// a.setupLogger,
+		a.setupTracing,
+		// the probes answer while the rest of the agent sets up
+		a.setupHTTP,
 		a.setupLog,
 		a.setupServer,
 		a.setupMembership,
@@ -71,20 +154,175 @@ func New(config Config) (*Agent, error) {
 
 	for _, fn := range setup {
 		if err := fn(); err != nil {
+			// release what the earlier steps set up, like the log's directory lock, so the agent can be created again
+			_ = a.Shutdown()
 			return nil, err
 		}
 	}
 
+	a.checkHealth()
+	go a.watchHealth()
 	return a, nil
 }
 
+func (a *Agent) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	a.health.SetServingStatus("", status)
+	a.health.SetServingStatus(api.Log_ServiceDesc.ServiceName, status)
+}
+
+// checkHealth reports SERVING if the log can take appends, and NOT_SERVING if its disk is full or read-only.
+func (a *Agent) checkHealth() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := a.log.Check(); err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	a.setServingStatus(status)
+}
+
+// watchHealth checks the agent's health periodically until the agent shuts down.
+func (a *Agent) watchHealth() {
+	interval := a.Config.HealthCheckInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.shutdowns:
+			return
+		case <-ticker.C:
+			a.checkHealth()
+		}
+	}
+}
+
+// setupTracing sets up the provider the server and the replicator trace with:
+// the configured one, one that exports to the OTLP endpoint, or the global one.
+func (a *Agent) setupTracing() error {
+	if a.Config.TracerProvider != nil || a.Config.OTLPEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracegrpc.New(
+		context.Background(),
+		otlptracegrpc.WithEndpointURL(a.Config.OTLPEndpoint),
+	)
+	if err != nil {
+		return err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("proglog"),
+		semconv.ServiceInstanceID(a.Config.NodeName),
+	))
+	if err != nil {
+		return err
+	}
+	a.exporter = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	a.Config.TracerProvider = a.exporter
+	return nil
+}
+
 func (a *Agent) setupLog() error {
+	logConfig := log.Config{}
+	if a.Config.TierDir != "" {
+		store, err := log.NewDirObjectStore(a.Config.TierDir)
+		if err != nil {
+			return err
+		}
+		logConfig.Tier.Store = store
+		logConfig.Tier.OffloadAfter = a.Config.OffloadAfter
+	}
+	if a.Config.EncryptionKeyFile != "" {
+		keys, err := log.NewKeyFileProvider(a.Config.EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		logConfig.Encryption.Keys = keys
+	}
+	if a.Config.Compression != "" {
+		codec, err := log.ParseCodec(a.Config.Compression)
+		if err != nil {
+			return err
+		}
+		logConfig.Compression = codec
+	}
+
 	var err error
 	a.log, err = log.NewLog(
 		a.Config.DataDir,
-		log.Config{},
+		logConfig,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if err := a.registry.Register(a.log); err != nil {
+		return err
+	}
+
+	if logConfig.Tier.Store != nil {
+		go a.offload()
+	}
+	return nil
+}
+
+// offload periodically moves the log's old segments to the secondary storage tier
+// until the agent shuts down. It checks at a quarter of OffloadAfter, so a segment stays local
+// for at most a quarter longer than OffloadAfter, but no more often than once a minute.
+func (a *Agent) offload() {
+	interval := a.Config.OffloadAfter / 4
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.shutdowns:
+			return
+		case <-ticker.C:
+			_ = a.log.Offload()
+		}
+	}
+}
+
+// setupAudit opens the sinks the server sends its audit events to, or returns nil if the agent doesn't audit.
+func (a *Agent) setupAudit() (server.AuditSink, error) {
+	var sinks server.AuditSinks
+	if a.Config.AuditFile != "" {
+		var err error
+		a.auditFile, err = server.NewFileAuditSink(a.Config.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, a.auditFile)
+	}
+	if a.Config.AuditLog {
+		dir := filepath.Join(a.Config.DataDir, "audit")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		var err error
+		a.auditLog, err = log.NewLog(dir, log.Config{})
+		if err != nil {
+			return nil, err
+		}
+		// the server appends the events to the audit log directly, not through its own RPCs,
+		// so auditing doesn't set off authorizations to audit
+		sinks = append(sinks, &server.LogAuditSink{Log: a.auditLog})
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	}
+	return sinks, nil
 }
 
 func (a *Agent) setupServer() error {
@@ -95,10 +333,43 @@ func (a *Agent) setupServer() error {
 	if err != nil {
 		return err
 	}
+	// permissions change when the policy file does, without restarting the agent
+	if err := authorizer.Watch(); err != nil {
+		return err
+	}
+	a.authorizer = authorizer
+
+	var authenticators []server.Authenticator
+	if a.Config.JWKSFile != "" {
+		jwt, err := auth.NewJWTAuthenticator(auth.JWTConfig{
+			JWKSFile:     a.Config.JWKSFile,
+			SubjectClaim: a.Config.JWTSubjectClaim,
+			Issuer:       a.Config.JWTIssuer,
+			Audience:     a.Config.JWTAudience,
+		})
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	authenticators = append(authenticators, server.TLSAuthenticator{})
+
+	auditSink, err := a.setupAudit()
+	if err != nil {
+		return err
+	}
 
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		CommitLog:      server.LogCommitLog{Log: a.log},
+		Authorizer:     authorizer,
+		Topic:          a.Config.Topic,
+		Registerer:     a.registry,
+		TracerProvider: a.Config.TracerProvider,
+		Health:         a.health,
+		SendTimeout:    a.Config.SendTimeout,
+		Quotas:         a.Config.Quotas,
+		Authenticators: authenticators,
+		AuditSink:      auditSink,
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -141,10 +412,16 @@ func (a *Agent) setupMembership() error {
 		return err
 	}
 
-	var opts []grpc.DialOption
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
 	if a.Config.PeerTLSConfig != nil {
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig)))
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig))}
+	}
+	// trace the replicator's calls, so the replicated records' traces continue into the other servers
+	tracingOpts := []otelgrpc.Option{otelgrpc.WithPropagators(server.Propagator)}
+	if a.Config.TracerProvider != nil {
+		tracingOpts = append(tracingOpts, otelgrpc.WithTracerProvider(a.Config.TracerProvider))
 	}
+	opts = append(opts, grpc.WithStatsHandler(otelgrpc.NewClientHandler(tracingOpts...)))
 
 	conn, err := grpc.NewClient(rpcAddr, opts...)
 	if err != nil {
@@ -165,18 +442,129 @@ func (a *Agent) setupMembership() error {
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err := a.registry.Register(a.replicator); err != nil {
+		return err
+	}
+	return a.registry.Register(a.membership)
+}
+
+// setupHTTP serves the metrics of the agent's components, along with the Go runtime's and the process's,
+// for Prometheus to scrape, and the probes for the orchestrator:
+//   - /healthz answers OK until the agent starts shutting down;
+//   - /readyz answers OK while the gRPC health service reports SERVING.
+func (a *Agent) setupHTTP() error {
+	if a.Config.HTTPPort == 0 {
+		return nil
+	}
+
+	err := a.registry.Register(collectors.NewGoCollector())
+	if err != nil {
+		return err
+	}
+	err = a.registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if err != nil {
+		return err
+	}
+
+	if err := a.registerCertificateExpiry(); err != nil {
+		return err
+	}
+
+	httpAddr, err := a.Config.HTTPAddr()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(a.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", a.handleHealthz)
+	mux.HandleFunc("GET /readyz", a.handleReadyz)
+	a.httpServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := a.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+
+	return nil
+}
+
+// registerCertificateExpiry exports when the certificates of the server and peer TLS configs expire,
+// which moves forward as they're rotated, so operators can alert on certificates that stopped rotating.
+func (a *Agent) registerCertificateExpiry() error {
+	for name, tlsConfig := range map[string]*tls.Config{
+		"server": a.Config.ServerTLSConfig,
+		"peer":   a.Config.PeerTLSConfig,
+	} {
+		if tlsConfig == nil {
+			continue
+		}
+		if _, ok := config.CertificateExpiry(tlsConfig); !ok {
+			continue
+		}
+		err := a.registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "proglog_tls_certificate_expiry_timestamp_seconds",
+			Help:        "When the certificate the TLS config presents expires, in seconds since the Unix epoch.",
+			ConstLabels: prometheus.Labels{"config": name},
+		}, func() float64 {
+			expiry, _ := config.CertificateExpiry(tlsConfig)
+			return float64(expiry.Unix())
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Agent) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-a.shutdowns:
+		writeStatus(w, healthpb.HealthCheckResponse_NOT_SERVING)
+	default:
+		writeStatus(w, healthpb.HealthCheckResponse_SERVING)
+	}
+}
+
+func (a *Agent) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	res, err := a.health.Check(r.Context(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeStatus(w, res.Status)
+}
+
+func writeStatus(w http.ResponseWriter, status healthpb.HealthCheckResponse_ServingStatus) {
+	if status != healthpb.HealthCheckResponse_SERVING {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, status)
 }
 
 // This ensures that the agent will shut down once even if
 // people call Shutdown() multiple times.
 // Then we shut down the agent and its components by:
-//  1. Leaving the membership so that other servers will see that this server has left the cluster,
+//  1. Reporting NOT_SERVING, so the orchestrator and clients stop sending requests our way;
+//  2. Leaving the membership so that other servers will see that this server has left the cluster,
 //     so that this server doesn't receive discovery events anymore;
-//  2. Closing the replicator so it doesn't continue to replicate;
-//  3. Gracefully stopping the gRPC server;
-//  4. Closing the log.
+//  3. Closing the replicator so it doesn't continue to replicate;
+//  4. Gracefully stopping the gRPC server;
+//  5. Closing the HTTP server of the metrics and probes;
+//  6. Flushing the spans to the OTLP endpoint;
+//  7. Closing the log.
+//
+// New shuts down an agent it fails to set up, which skips the components it didn't get to.
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -189,13 +577,64 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
-		a.membership.Leave,
-		a.replicator.Close,
 		func() error {
-			a.server.GracefulStop()
+			a.health.Shutdown()
 			return nil
 		},
-		a.log.Close,
+		func() error {
+			if a.membership == nil {
+				return nil
+			}
+			return a.membership.Leave()
+		},
+		func() error {
+			if a.replicator == nil {
+				return nil
+			}
+			return a.replicator.Close()
+		},
+		func() error {
+			if a.server != nil {
+				a.server.GracefulStop()
+			}
+			return nil
+		},
+		func() error {
+			if a.authorizer == nil {
+				return nil
+			}
+			return a.authorizer.Close()
+		},
+		func() error {
+			if a.auditFile == nil {
+				return nil
+			}
+			return a.auditFile.Close()
+		},
+		func() error {
+			if a.auditLog == nil {
+				return nil
+			}
+			return a.auditLog.Close()
+		},
+		func() error {
+			if a.httpServer == nil {
+				return nil
+			}
+			return a.httpServer.Close()
+		},
+		func() error {
+			if a.exporter == nil {
+				return nil
+			}
+			return a.exporter.Shutdown(context.Background())
+		},
+		func() error {
+			if a.log == nil {
+				return nil
+			}
+			return a.log.Close()
+		},
 	}
 
 	for _, fn := range shutdown {
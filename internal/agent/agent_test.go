@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"testing"
 	"time"
@@ -15,6 +17,8 @@ import (
 	"github.com/ttaaoo/proglog/internal/config"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func TestAgent(t *testing.T) {
@@ -39,11 +43,13 @@ func TestAgent(t *testing.T) {
 	// sets up a three-node cluster
 	var agents []*agent.Agent
 	for i := 0; i < 3; i++ {
-		ports := dynaport.Get(2)
+		ports := dynaport.Get(3)
 		// ports[0] is for Serf service discovery connections
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 		// ports[1] is for gRPC log connections
 		rpcPort := ports[1]
+		// ports[2] is for the metrics HTTP server
+		httpPort := ports[2]
 
 		dataDir, err := os.MkdirTemp("", "agent-test-log")
 		require.NoError(t, err)
@@ -59,7 +65,9 @@ func TestAgent(t *testing.T) {
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
 			RPCPort:         rpcPort,
+			HTTPPort:        httpPort,
 			DataDir:         dataDir,
+			Compression:     "zstd",
 			ACLModelFile:    config.ACLModelFile,
 			ACLPolicyFile:   config.ACLPolicyFile,
 			ServerTLSConfig: serverTLSConfig,
@@ -108,16 +116,119 @@ func TestAgent(t *testing.T) {
 		})
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, []byte("hello world"))
+
+	// the agents expose their metrics, including the replication from the other nodes
+	metrics := scrape(t, agents[1])
+	for _, want := range []string{
+		"proglog_log_appends_total",
+		"proglog_log_highest_offset",
+		`proglog_grpc_requests_total{code="OK",method="/log.v1.Log/Consume"} 1`,
+		// the other two nodes replicate from this one
+		"proglog_consume_stream_subscriptions 2",
+		`proglog_replication_lag_records{peer="0"}`,
+		`proglog_membership_members{status="alive"} 3`,
+		`proglog_tls_certificate_expiry_timestamp_seconds{config="server"}`,
+		`proglog_tls_certificate_expiry_timestamp_seconds{config="peer"}`,
+		"go_goroutines",
+	} {
+		require.Contains(t, metrics, want)
+	}
+
+	// the agents report they're ready once they've joined the cluster
+	health := healthpb.NewHealthClient(conn(t, agents[1], peerTLSConfig))
+	res, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "log.v1.Log"})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+	require.Equal(t, http.StatusOK, get(t, agents[1], "/healthz").StatusCode)
+	require.Equal(t, http.StatusOK, get(t, agents[1], "/readyz").StatusCode)
+}
+
+func TestAgentShutdownNotServing(t *testing.T) {
+	ports := dynaport.Get(3)
+	dataDir := t.TempDir()
+	a, err := agent.New(agent.Config{
+		NodeName:      "0",
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:       ports[1],
+		HTTPPort:      ports[2],
+		DataDir:       dataDir,
+		ACLModelFile:  config.ACLModelFile,
+		ACLPolicyFile: config.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+
+	health := healthpb.NewHealthClient(conn(t, a, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	watch, err := health.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- a.Shutdown() }()
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+	// the server stops gracefully once the watch ends
+	cancel()
+	require.NoError(t, <-shutdown)
+}
+
+func TestAgentSetupFailureReleasesLog(t *testing.T) {
+	ports := dynaport.Get(3)
+	c := agent.Config{
+		NodeName:      "0",
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:       ports[1],
+		HTTPPort:      ports[2],
+		DataDir:       t.TempDir(),
+		ACLModelFile:  "missing-model.conf",
+		ACLPolicyFile: config.ACLPolicyFile,
+	}
+	// the server fails to set up after the agent opened its log and its HTTP server
+	_, err := agent.New(c)
+	require.Error(t, err)
+
+	// so the agent can be created again with the same log and ports
+	c.ACLModelFile = config.ACLModelFile
+	a, err := agent.New(c)
+	require.NoError(t, err)
+	require.NoError(t, a.Shutdown())
+}
+
+func scrape(t *testing.T, agent *agent.Agent) string {
+	resp := get(t, agent, "/metrics")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func get(t *testing.T, agent *agent.Agent, path string) *http.Response {
+	httpAddr, err := agent.Config.HTTPAddr()
+	require.NoError(t, err)
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path))
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
-	tlsCreds := credentials.NewTLS(tlsConfig)
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
+	return api.NewLogClient(conn(t, agent, tlsConfig))
+}
+
+func conn(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) *grpc.ClientConn {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
 	rpcAddr, err := agent.Config.RPCAddr()
 	require.NoError(t, err)
 
 	conn, err := grpc.NewClient(rpcAddr, opts...)
 	require.NoError(t, err)
-	client := api.NewLogClient(conn)
-	return client
+	t.Cleanup(func() { conn.Close() })
+	return conn
 }
@@ -1,42 +1,156 @@
 package auth
 
 import (
-	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/casbin/casbin/v2"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	api "github.com/ttaaoo/proglog/api/v1"
 )
 
+/*
+Authorizer checks a client's access with a Casbin enforcer built from the ACL model and policy files.
+The model decides what policies mean: ours grants subjects, or the roles and groups they're assigned with g rules,
+actions on objects, where an object ending in * matches every object with that prefix and * alone matches all of them.
+An admin policy grants every action on its objects. The actions are produce, consume, truncate, decrypt, create_topic and admin,
+where decrypt lets a client snapshot an encrypted log in plaintext.
+The server authorizes each request on the topic of the log it serves; create_topic is reserved for when
+a server serves more than one topic, since there's nothing to create until then.
+
+	p, producers, orders.*, produce
+	p, ops, *, admin
+	g, root, producers
+
+Watch reloads the policy whenever its file changes, so permissions change without a restart.
+Each reload builds a new enforcer and swaps it in atomically, so Authorize never sees a half-loaded policy,
+and a policy file that fails to load leaves the previous policy in place.
+*/
 type Authorizer struct {
-	enforcer *casbin.Enforcer
+	model  string
+	policy string
+
+	enforcer atomic.Pointer[casbin.Enforcer]
+	logger   *zerolog.Logger
+
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	done    chan struct{}
 }
 
 func New(model, policy string) (*Authorizer, error) {
-	enforcer, err := casbin.NewEnforcer(model, policy)
-	if err != nil {
+	logger := zerolog.New(os.Stderr).With().Str("service", "authorizer").Logger()
+	a := &Authorizer{
+		model:  model,
+		policy: policy,
+		logger: &logger,
+	}
+	if err := a.Reload(); err != nil {
 		return nil, err
 	}
-	return &Authorizer{enforcer: enforcer}, nil
+	return a, nil
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	ok, err := a.enforcer.Enforce(subject, object, action)
+	ok, err := a.enforcer.Load().Enforce(subject, object, action)
 	if err != nil {
 		return err
 	}
 	if !ok {
+		return api.ErrPermissionDenied{
+			Subject: subject,
+			Object:  object,
+			Action:  action,
+		}
+	}
 
-		msg := fmt.Sprintf(
-			"%s not permitted to %s to %s",
-			subject,
-			action,
-			object,
-		)
+	return nil
+}
 
-		st := status.New(codes.PermissionDenied, msg)
-		return st.Err()
+// Reload loads the model and policy files into a new enforcer and swaps it in. If loading fails,
+// it returns the error and Authorize keeps using the previous enforcer.
+func (a *Authorizer) Reload() error {
+	enforcer, err := casbin.NewEnforcer(a.model, a.policy)
+	if err != nil {
+		return err
 	}
+	a.enforcer.Store(enforcer)
+	return nil
+}
 
+// Watch reloads the policy whenever its file changes, until Close. We watch the file's directory rather than
+// the file itself because editors and config management replace files by renaming a new one over them,
+// after which a watch on the old file would never fire again.
+func (a *Authorizer) Watch() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.watcher != nil {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(a.policy)); err != nil {
+		watcher.Close()
+		return err
+	}
+	a.watcher = watcher
+	a.done = make(chan struct{})
+	go a.watch(watcher, a.done)
 	return nil
 }
+
+// reloadDelay is how long the watcher waits after the policy file's last change before reloading it,
+// so it doesn't load a file that's still being written.
+const reloadDelay = 100 * time.Millisecond
+
+func (a *Authorizer) watch(watcher *fsnotify.Watcher, done chan struct{}) {
+	defer close(done)
+	policy := filepath.Clean(a.policy)
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != policy {
+				continue
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
+				reload = time.After(reloadDelay)
+			}
+		case <-reload:
+			reload = nil
+			if err := a.Reload(); err != nil {
+				a.logger.Error().Err(err).Str("policy", a.policy).Msg("failed to reload ACL policy")
+				continue
+			}
+			a.logger.Info().Str("policy", a.policy).Msg("reloaded ACL policy")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			a.logger.Error().Err(err).Str("policy", a.policy).Msg("failed to watch ACL policy")
+		}
+	}
+}
+
+// Close stops watching the policy file.
+func (a *Authorizer) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.watcher == nil {
+		return nil
+	}
+	err := a.watcher.Close()
+	<-a.done
+	a.watcher = nil
+	return err
+}
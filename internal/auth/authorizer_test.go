@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+const model = "../../test/model.conf"
+
+func writePolicy(t *testing.T, path, policy string) {
+	t.Helper()
+	// like config management does, we write the new policy next to the old one and rename it over
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte(policy), 0o644))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func TestAuthorize(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	writePolicy(t, policy, `p, producer, orders.*, produce
+p, consumer, *, consume
+p, ops, *, admin
+g, alice, producer
+g, bob, consumer
+g, carol, oncall
+g, oncall, ops
+`)
+	a, err := New(model, policy)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		subject, object, action string
+		allowed                 bool
+	}{
+		{"alice", "orders.eu", "produce", true},
+		{"alice", "orders.", "produce", true},
+		{"alice", "payments", "produce", false},
+		{"alice", "*", "produce", false},
+		{"alice", "orders.eu", "consume", false},
+		{"bob", "payments", "consume", true},
+		{"bob", "*", "consume", true},
+		{"bob", "payments", "produce", false},
+		// carol is on call, whose members are ops, who may do anything
+		{"carol", "*", "truncate", true},
+		{"carol", "orders.eu", "create_topic", true},
+		{"carol", "payments", "produce", true},
+		{"dave", "*", "consume", false},
+	} {
+		err := a.Authorize(tc.subject, tc.object, tc.action)
+		if tc.allowed {
+			require.NoError(t, err, "%s %s %s", tc.subject, tc.action, tc.object)
+		} else {
+			require.Equal(t, api.ErrPermissionDenied{Subject: tc.subject, Object: tc.object, Action: tc.action}, err)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	writePolicy(t, policy, "p, alice, *, produce\n")
+	a, err := New(model, policy)
+	require.NoError(t, err)
+	require.NoError(t, a.Watch())
+	defer func() {
+		require.NoError(t, a.Close())
+	}()
+	require.NoError(t, a.Authorize("alice", "*", "produce"))
+	require.Error(t, a.Authorize("bob", "*", "produce"))
+
+	writePolicy(t, policy, "p, bob, *, produce\n")
+	require.Eventually(t, func() bool {
+		return a.Authorize("bob", "*", "produce") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Error(t, a.Authorize("alice", "*", "produce"))
+
+	// editing the file in place reloads it too
+	require.NoError(t, os.WriteFile(policy, []byte("p, bob, *, produce\np, bob, *, consume\n"), 0o644))
+	require.Eventually(t, func() bool {
+		return a.Authorize("bob", "*", "consume") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a policy that fails to load leaves the previous one in place
+	writePolicy(t, policy, "p, bob, *\n")
+	_, err = New(model, policy)
+	require.Error(t, err)
+	time.Sleep(3 * reloadDelay)
+	require.NoError(t, a.Authorize("bob", "*", "produce"))
+}
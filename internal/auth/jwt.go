@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+JWTAuthenticator identifies clients by the bearer tokens they send in the authorization metadata of their RPCs,
+for clients that can't hold a certificate of their own, like the services of a web app acting for their users.
+It verifies the tokens' signatures against the public keys of a local JWKS file and checks their expiry,
+and their issuer and audience if it's configured to, and takes the client's subject from a claim of the token.
+*/
+type JWTAuthenticator struct {
+	keys   jose.JSONWebKeySet
+	config JWTConfig
+}
+
+type JWTConfig struct {
+	// JWKSFile is the JSON Web Key Set holding the public keys the tokens are signed with.
+	JWKSFile string
+	// SubjectClaim is the claim that holds the client's subject. Defaults to "sub".
+	SubjectClaim string
+	// Issuer and Audience, if set, are the issuer and one of the audiences the tokens must have.
+	Issuer   string
+	Audience string
+}
+
+// jwtAlgorithms are the signature algorithms we accept. They're the asymmetric ones, since we only hold public keys.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// jwtLeeway is how far the clocks of the token's issuer and the server may drift apart.
+const jwtLeeway = time.Minute
+
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = "sub"
+	}
+	b, err := os.ReadFile(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &JWTAuthenticator{config: config}
+	if err := json.Unmarshal(b, &a.keys); err != nil {
+		return nil, fmt.Errorf("parse JWKS %s: %w", config.JWKSFile, err)
+	}
+	return a, nil
+}
+
+// Authenticate implements server.Authenticator. RPCs without a bearer token aren't this authenticator's to identify,
+// so it returns the empty subject for them.
+func (a *JWTAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	for _, v := range md.Get("authorization") {
+		if t, ok := cutPrefixFold(v, "Bearer "); ok {
+			token = strings.TrimSpace(t)
+			break
+		}
+	}
+	if token == "" {
+		return "", nil
+	}
+
+	parsed, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return "", api.ErrUnauthenticated{Cause: fmt.Sprintf("invalid token: %v", err)}
+	}
+	var (
+		registered jwt.Claims
+		claims     map[string]any
+	)
+	if err := parsed.Claims(a.keys, &registered, &claims); err != nil {
+		return "", api.ErrUnauthenticated{Cause: fmt.Sprintf("invalid token: %v", err)}
+	}
+	expected := jwt.Expected{Issuer: a.config.Issuer, Time: time.Now()}
+	if a.config.Audience != "" {
+		expected.AnyAudience = jwt.Audience{a.config.Audience}
+	}
+	if err := registered.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return "", api.ErrUnauthenticated{Cause: fmt.Sprintf("invalid token: %v", err)}
+	}
+	// tokens that never expire would stay valid forever if they leaked
+	if registered.Expiry == nil {
+		return "", api.ErrUnauthenticated{Cause: "invalid token: no expiry"}
+	}
+
+	subject, ok := claims[a.config.SubjectClaim].(string)
+	if !ok || subject == "" {
+		return "", api.ErrUnauthenticated{Cause: fmt.Sprintf("token has no %s claim", a.config.SubjectClaim)}
+	}
+	return subject, nil
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return "", false
+	}
+	return s[len(prefix):], true
+}
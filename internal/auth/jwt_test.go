@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	b, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       key.Public(),
+		KeyID:     "1",
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(jwks, b, 0o644))
+
+	a, err := NewJWTAuthenticator(JWTConfig{JWKSFile: jwks, Audience: "proglog"})
+	require.NoError(t, err)
+	byEmail, err := NewJWTAuthenticator(JWTConfig{JWKSFile: jwks, SubjectClaim: "email"})
+	require.NoError(t, err)
+
+	sign := func(signer *ecdsa.PrivateKey, claims map[string]any) string {
+		s, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: signer},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "1"),
+		)
+		require.NoError(t, err)
+		token, err := jwt.Signed(s).Claims(claims).Serialize()
+		require.NoError(t, err)
+		return token
+	}
+	valid := func() map[string]any {
+		return map[string]any{
+			"sub":   "alice",
+			"email": "alice@example.com",
+			"aud":   "proglog",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(claims map[string]any, k string, v any) map[string]any {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+		return claims
+	}
+	ctxWith := func(authorization string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", authorization))
+	}
+
+	for scenario, tc := range map[string]struct {
+		authenticator *JWTAuthenticator
+		ctx           context.Context
+		subject       string
+		unauthorized  bool
+	}{
+		"valid token":              {a, ctxWith("Bearer " + sign(key, valid())), "alice", false},
+		"subject from other claim": {byEmail, ctxWith("bearer " + sign(key, valid())), "alice@example.com", false},
+		"no token":                 {a, context.Background(), "", false},
+		"other scheme":             {a, ctxWith("Basic YWxpY2U6c2VjcmV0"), "", false},
+		"garbage":                  {a, ctxWith("Bearer garbage"), "", true},
+		"other key":                {a, ctxWith("Bearer " + sign(other, valid())), "", true},
+		"expired": {
+			a, ctxWith("Bearer " + sign(key, with(valid(), "exp", time.Now().Add(-time.Hour).Unix()))), "", true,
+		},
+		"no expiry":      {a, ctxWith("Bearer " + sign(key, with(valid(), "exp", nil))), "", true},
+		"other audience": {a, ctxWith("Bearer " + sign(key, with(valid(), "aud", "other"))), "", true},
+		"no subject":     {a, ctxWith("Bearer " + sign(key, with(valid(), "sub", nil))), "", true},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			subject, err := tc.authenticator.Authenticate(tc.ctx)
+			if tc.unauthorized {
+				var unauthenticated api.ErrUnauthenticated
+				require.ErrorAs(t, err, &unauthenticated)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.subject, subject)
+		})
+	}
+}
@@ -2,8 +2,6 @@ package config
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -41,37 +39,47 @@ func configFile(filename string) string {
 	return filepath.Join(homeDir, ".proglog", filename)
 }
 
+// SetupTLSConfig returns a TLS config for the server or client that reloads its certificate and CA
+// from their files whenever they change, so the certificates can rotate without restarting the agent.
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
-	var err error
+	files, err := newTLSFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	tlsConfig := &tls.Config{}
-	if cfg.CertFile != "" && cfg.KeyFile != "" {
-		tlsConfig.Certificates = make([]tls.Certificate, 1)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
-		if err != nil {
-			return nil, err
+	if files.certFile != "" {
+		if cfg.Server {
+			tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert, _ := files.current()
+				return cert, nil
+			}
+		} else {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert, _ := files.current()
+				return cert, nil
+			}
 		}
 	}
 
 	if cfg.CAFile != "" {
-		b, err := os.ReadFile(cfg.CAFile)
-		if err != nil {
-			return nil, err
-		}
-
-		ca := x509.NewCertPool()
-		if !ca.AppendCertsFromPEM(b) {
-			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
-		}
-
 		if cfg.Server {
 			// Server *tls.Config is setup to verify the client's certificate and allow the client
-			// to verify the server's certificate by setting its ClientCAs
-			tlsConfig.ClientCAs = ca
+			// to verify the server's certificate by setting its ClientCAs. The handshake reads ClientCAs
+			// from the config GetConfigForClient returns, so each handshake gets the current pool
 			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			base := tlsConfig.Clone()
+			tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				c := base.Clone()
+				_, c.ClientCAs = files.current()
+				return c, nil
+			}
 		} else {
-			// Client *tls.Config is setup to verify server's certificate with the client's by
-			// setting the *tls.Config's RootCAs
-			tlsConfig.RootCAs = ca
+			// Client *tls.Config is setup to verify server's certificate against the CA pool.
+			// RootCAs can't be swapped once the config's in use, so rather than let the handshake verify
+			// the certificate against them, we verify it ourselves against the current pool
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = files.verifyConnection
 		}
 		tlsConfig.ServerName = cfg.ServerAddress
 	}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Our certificates rotate every day, so the TLS configs SetupTLSConfig returns don't hold on to the certificate and
+CA pool they started with. They ask tlsFiles for them on every handshake, which checks whether the files
+changed on disk since it last read them and reloads them if they did. A rotation that fails to load,
+like one caught halfway through writing the files, leaves the previous certificate and pool in place
+until the files change again, so a bad rotation doesn't take the agent's connections down with it.
+*/
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+}
+
+// fileStamp tells whether a file changed since it was loaded.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newTLSFiles(cfg TLSConfig) (*tlsFiles, error) {
+	f := &tlsFiles{caFile: cfg.CAFile}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		f.certFile = cfg.CertFile
+		f.keyFile = cfg.KeyFile
+	}
+	stamps, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(stamps); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *tlsFiles) files() []string {
+	var files []string
+	for _, file := range []string{f.certFile, f.keyFile, f.caFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (f *tlsFiles) stat() (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	for _, file := range f.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps[file] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// load reads the files, and swaps in their certificate and pool if they're valid.
+// The caller holds mu or owns f.
+func (f *tlsFiles) load(stamps map[string]fileStamp) error {
+	var cert *tls.Certificate
+	if f.certFile != "" {
+		c, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if f.caFile != "" {
+		b, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("failed to parse root certificate: %q", f.caFile)
+		}
+	}
+
+	f.stamps, f.cert, f.pool = stamps, cert, pool
+	return nil
+}
+
+// current returns the certificate and CA pool, reloading them first if their files changed.
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stamps, err := f.stat()
+	if err != nil {
+		log.Printf("failed to check TLS files for changes: %v", err)
+		return f.cert, f.pool
+	}
+	if !f.changed(stamps) {
+		return f.cert, f.pool
+	}
+	if err := f.load(stamps); err != nil {
+		// we retry once the files change again, rather than on every handshake until they do
+		f.stamps = stamps
+		log.Printf("failed to reload TLS files: %v", err)
+	}
+	return f.cert, f.pool
+}
+
+func (f *tlsFiles) changed(stamps map[string]fileStamp) bool {
+	for file, stamp := range stamps {
+		loaded := f.stamps[file]
+		if !stamp.modTime.Equal(loaded.modTime) || stamp.size != loaded.size {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyConnection verifies the server's certificate chain against the current CA pool, which the client can't
+// otherwise do since tls.Config reads RootCAs once per connection but has no callback to get them with.
+func (f *tlsFiles) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server didn't present a certificate")
+	}
+	_, pool := f.current()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// CertificateExpiry returns when the certificate the TLS config currently presents expires,
+// or false if it doesn't present one.
+func CertificateExpiry(tlsConfig *tls.Config) (time.Time, bool) {
+	var (
+		cert *tls.Certificate
+		err  error
+	)
+	switch {
+	case tlsConfig.GetCertificate != nil:
+		cert, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	case tlsConfig.GetClientCertificate != nil:
+		cert, err = tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	case len(tlsConfig.Certificates) > 0:
+		cert = &tlsConfig.Certificates[0]
+	}
+	if err != nil || cert == nil || len(cert.Certificate) == 0 {
+		return time.Time{}, false
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return leaf.NotAfter, true
+}
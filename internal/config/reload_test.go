@@ -0,0 +1,134 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfigReloads(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	copyFile(t, ServerCertFile, certFile)
+	copyFile(t, ServerKeyFile, keyFile)
+	copyFile(t, CAFile, caFile)
+
+	serverConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	clientConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:      RootClientCertFile,
+		KeyFile:       RootClientKeyFile,
+		CAFile:        CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, handshake(t, serverConfig, clientConfig))
+	_, ok := CertificateExpiry(serverConfig)
+	require.True(t, ok)
+
+	// rotating the server's certificate to the root client's, which isn't valid for the server's address,
+	// shows the server presents the new certificate without setting up its config again
+	rotate(t, RootClientCertFile, certFile)
+	rotate(t, RootClientKeyFile, keyFile)
+	require.Error(t, handshake(t, serverConfig, clientConfig))
+	rotated, ok := CertificateExpiry(serverConfig)
+	require.True(t, ok)
+	leaf := certificate(t, RootClientCertFile, RootClientKeyFile)
+	require.Equal(t, leaf.NotAfter, rotated)
+
+	// a rotation that fails to load leaves the previous certificate in place
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	require.NoError(t, os.Chtimes(keyFile, time.Now(), time.Now().Add(2*time.Hour)))
+	rotated, ok = CertificateExpiry(serverConfig)
+	require.True(t, ok)
+	require.Equal(t, leaf.NotAfter, rotated)
+
+	rotate(t, ServerCertFile, certFile)
+	rotate(t, ServerKeyFile, keyFile)
+	require.NoError(t, handshake(t, serverConfig, clientConfig))
+
+	// the server's own certificate didn't sign the client's, so the server rejects the client once it trusts only that
+	require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0o600))
+	require.NoError(t, os.Chtimes(caFile, time.Now(), time.Now().Add(3*time.Hour)))
+	require.NoError(t, handshake(t, serverConfig, clientConfig))
+	rotate(t, ServerCertFile, caFile)
+	require.Error(t, handshake(t, serverConfig, clientConfig))
+}
+
+// handshake connects a client to a server over loopback and returns the error of whichever side failed the handshake.
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) error {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		server := tls.Server(conn, serverConfig)
+		if err := server.Handshake(); err != nil {
+			errs <- err
+			return
+		}
+		_, err = server.Write([]byte{1})
+		errs <- err
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// with TLS 1.3 the client finishes its handshake before the server has verified its certificate,
+	// so the client only learns the server rejected it when it reads
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, readErr := conn.Read(make([]byte, 1))
+	if err := <-errs; err != nil {
+		return err
+	}
+	return readErr
+}
+
+// rotate copies src over dst and moves dst's modification time forward, so the change shows
+// even on file systems whose timestamps are too coarse to tell writes in quick succession apart.
+func rotate(t *testing.T, src, dst string) {
+	t.Helper()
+	info, err := os.Stat(dst)
+	require.NoError(t, err)
+	copyFile(t, src, dst)
+	modTime := info.ModTime().Add(time.Hour)
+	require.NoError(t, os.Chtimes(dst, modTime, modTime))
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	b, err := os.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, b, 0o600))
+}
+
+func certificate(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	return cert.Leaf
+}
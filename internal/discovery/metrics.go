@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ prometheus.Collector = (*Membership)(nil)
+
+var membersDesc = prometheus.NewDesc(
+	"proglog_membership_members",
+	"The number of cluster members this node knows about, by Serf status.",
+	[]string{"status"}, nil,
+)
+
+// memberStatuses are the statuses we report counts for, so a status without members reports zero
+// instead of disappearing.
+var memberStatuses = []serf.MemberStatus{
+	serf.StatusAlive,
+	serf.StatusLeaving,
+	serf.StatusLeft,
+	serf.StatusFailed,
+}
+
+// Describe implements prometheus.Collector.
+func (m *Membership) Describe(ch chan<- *prometheus.Desc) {
+	ch <- membersDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *Membership) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[serf.MemberStatus]int)
+	for _, member := range m.Members() {
+		counts[member.Status]++
+	}
+	for _, status := range memberStatuses {
+		ch <- prometheus.MustNewConstMetric(
+			membersDesc,
+			prometheus.GaugeValue,
+			float64(counts[status]),
+			status.String(),
+		)
+	}
+}
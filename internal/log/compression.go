@@ -0,0 +1,238 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec identifies the algorithm a record batch is compressed with.
+type Codec uint8
+
+const (
+	NoCompression Codec = iota
+	Gzip
+	Snappy
+	Zstd
+	LZ4
+)
+
+func (c Codec) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	case LZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// ParseCodec returns the codec with the given name, as Codec.String names it.
+func ParseCodec(name string) (Codec, error) {
+	for c := NoCompression; c <= LZ4; c++ {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression codec %q", name)
+}
+
+/*
+A compressed batch is stored as a single store frame:
+
+	[batchMagic][codec][first offset][compressed records]
+	 1byte       1byte  8bytes
+
+and once decompressed, the records are laid out like the store lays out its frames:
+
+	[length][record][length][record]...
+	 8bytes          8bytes
+
+Every offset in the batch has its own index entry, and they all point at the batch's frame.
+A record's place in the batch is its offset minus the batch's first offset.
+
+A marshalled record never starts with a zero byte because protobuf doesn't allow field number 0,
+so the magic byte tells batch frames apart from the plain record frames that Append writes.
+*/
+
+const (
+	batchMagic     byte = 0
+	batchHeaderLen      = 1 + 1 + 8
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func compress(codec Codec, p []byte) ([]byte, error) {
+	switch codec {
+	case NoCompression:
+		return p, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return snappy.Encode(nil, p), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	case LZ4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+}
+
+func decompress(codec Codec, p []byte) ([]byte, error) {
+	switch codec {
+	case NoCompression:
+		return p, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case Snappy:
+		return snappy.Decode(nil, p)
+	case Zstd:
+		return zstdDecoder.DecodeAll(p, nil)
+	case LZ4:
+		return io.ReadAll(lz4.NewReader(bytes.NewReader(p)))
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+}
+
+// encodeBatch frames the marshalled records as a compressed batch starting at the given offset.
+func encodeBatch(codec Codec, first uint64, records [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, p := range records {
+		if err := binary.Write(&buf, enc, uint64(len(p))); err != nil {
+			return nil, err
+		}
+		buf.Write(p)
+	}
+
+	compressed, err := compress(codec, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, batchHeaderLen, batchHeaderLen+len(compressed))
+	frame[0] = batchMagic
+	frame[1] = byte(codec)
+	enc.PutUint64(frame[2:batchHeaderLen], first)
+	return append(frame, compressed...), nil
+}
+
+func isBatch(p []byte) bool {
+	return len(p) >= batchHeaderLen && p[0] == batchMagic
+}
+
+// batchCodec returns the codec the batch frame is compressed with.
+func batchCodec(p []byte) Codec {
+	return Codec(p[1])
+}
+
+// decodeBatch decompresses a batch frame and splits it into its marshalled records.
+// The records of an uncompressed batch are slices of the frame.
+func decodeBatch(p []byte) (first uint64, records [][]byte, err error) {
+	first = enc.Uint64(p[2:batchHeaderLen])
+	b, err := decompress(batchCodec(p), p[batchHeaderLen:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for len(b) > 0 {
+		if len(b) < lenWidth {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		size := enc.Uint64(b[:lenWidth])
+		if uint64(len(b)-lenWidth) < size {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		records = append(records, b[lenWidth:lenWidth+size])
+		b = b[lenWidth+size:]
+	}
+	return first, records, nil
+}
+
+// batchCacheSize is the number of decompressed batches each segment keeps, so that
+// sequential reads through a batch only decompress it once.
+const batchCacheSize = 4
+
+// batchCache holds a segment's most recently decompressed batches, keyed by their position in the store.
+type batchCache struct {
+	mu      sync.Mutex
+	batches map[uint64]*batch
+	order   []uint64
+}
+
+type batch struct {
+	first   uint64
+	records [][]byte
+}
+
+// record returns the marshalled record at the given offset.
+func (b *batch) record(off uint64) ([]byte, error) {
+	if off < b.first || off-b.first >= uint64(len(b.records)) {
+		return nil, io.EOF
+	}
+	return b.records[off-b.first], nil
+}
+
+func newBatchCache() *batchCache {
+	return &batchCache{batches: make(map[uint64]*batch)}
+}
+
+func (c *batchCache) get(pos uint64) (*batch, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.batches[pos]
+	return b, ok
+}
+
+func (c *batchCache) put(pos uint64, b *batch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.batches[pos]; ok {
+		return
+	}
+	if len(c.order) >= batchCacheSize {
+		delete(c.batches, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.batches[pos] = b
+	c.order = append(c.order, pos)
+}
@@ -0,0 +1,171 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestCompressedBatch(t *testing.T) {
+	for _, codec := range []Codec{Gzip, Snappy, Zstd, LZ4} {
+		t.Run(codec.String(), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compression-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Compression = codec
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			var records []*api.Record
+			var size uint64
+			for i := 0; i < 10; i++ {
+				value := []byte(fmt.Sprintf(`{"id":%d,"kind":"event","payload":"hello world"}`, i))
+				records = append(records, &api.Record{Value: value})
+				size += uint64(len(value))
+			}
+			first, err := log.AppendBatch(records)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), first)
+			// the batch is one store frame and it's smaller than the records it holds
+			require.Less(t, log.activeSegment.store.size, size)
+			require.Equal(t, uint64(len(records)), log.activeSegment.index.entries())
+
+			testReadBatch(t, log, records)
+			// sequential reads decompressed the batch once
+			require.Len(t, log.activeSegment.batches.batches, 1)
+
+			// the next batch's offsets follow the first's
+			first, err = log.AppendBatch(records[:2])
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(records)), first)
+
+			require.NoError(t, log.Close())
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			testReadBatch(t, log, records)
+			off, err := log.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(records)+1), off)
+		})
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for _, codec := range []Codec{NoCompression, Gzip, Snappy, Zstd, LZ4} {
+		parsed, err := ParseCodec(codec.String())
+		require.NoError(t, err)
+		require.Equal(t, codec, parsed)
+	}
+	_, err := ParseCodec("brotli")
+	require.Error(t, err)
+}
+
+func testReadBatch(t *testing.T, log *Log, records []*api.Record) {
+	t.Helper()
+	for i, want := range records {
+		got, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, uint64(i), got.Offset)
+	}
+}
+
+func TestCompressedBatchRollsSegment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Compression = Snappy
+	c.Segment.MaxIndexBytes = indexHeaderLen + entWidth*3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{Value: []byte("hello world")}
+	_, err = log.Append(append)
+	require.NoError(t, err)
+
+	// the batch doesn't fit in the active segment's index, so it goes in a new segment
+	first, err := log.AppendBatch([]*api.Record{{Value: write}, {Value: write}, {Value: write}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Len(t, log.segments, 3)
+	require.Equal(t, uint64(1), log.segments[1].baseOffset)
+	got, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, write, got.Value)
+}
+
+func TestBatchIsAtomic(t *testing.T) {
+	log, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	// without compression, the batch is still one frame
+	records := []*api.Record{{Value: write}, {Value: write}, {Value: write}}
+	first, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Equal(t, uint64(len(records)), log.activeSegment.index.entries())
+	testReadBatch(t, log, records)
+
+	// a record the log refuses fails the whole batch
+	_, err = log.AppendBatch([]*api.Record{{Value: write}, {Value: write, Control: api.ControlType_CONTROL_COMMIT}})
+	require.Equal(t, api.ErrControlRecord{Control: api.ControlType_CONTROL_COMMIT}, err)
+	require.Equal(t, uint64(len(records)), log.NextOffset())
+}
+
+func TestBatchSequences(t *testing.T) {
+	log, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	id, err := log.InitProducer()
+	require.NoError(t, err)
+	batch := func(sequences ...uint64) []*api.Record {
+		var records []*api.Record
+		for _, seq := range sequences {
+			records = append(records, &api.Record{Value: write, ProducerId: id, Sequence: seq})
+		}
+		return records
+	}
+
+	first, err := log.AppendBatch(batch(0, 1, 2))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	// a retry of the batch isn't appended again
+	first, err = log.AppendBatch(batch(0, 1, 2))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+
+	// every record of the batch must follow the one before it
+	_, err = log.AppendBatch(batch(3, 5))
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: id, Sequence: 5, Expected: 4}, err)
+	_, err = log.AppendBatch(batch(3, 3))
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: id, Sequence: 3, Expected: 4}, err)
+	// and only the first may be a retry
+	_, err = log.AppendBatch(append([]*api.Record{{Value: write}}, batch(2)...))
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: id, Sequence: 2, Expected: 3}, err)
+	require.Equal(t, uint64(3), log.NextOffset())
+
+	first, err = log.AppendBatch(batch(3, 4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = indexHeaderLen + entWidth*3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	_, err = log.AppendBatch([]*api.Record{{Value: write}, {Value: write}, {Value: write}, {Value: write}})
+	require.Equal(t, api.ErrBatchTooLarge{Records: 4, MaxRecords: 3}, err)
+}
@@ -1,5 +1,11 @@
 package log
 
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
 type Config struct {
 	Segment struct {
 		// The maximum number of bytes to store in the segment's store file.
@@ -9,5 +15,71 @@ type Config struct {
 		// The offset to start at when creating a new segment file.
 		// This is used to ensure that each segment file has a unique name.
 		InitialOffset uint64
+		// The number of bytes, 4 or 8, new indexes store relative offsets in. Defaults to 4,
+		// which caps a segment at 2^32 records; MaxIndexBytes must respect that cap.
+		IndexOffsetWidth uint64
+	}
+	Tier struct {
+		// The secondary storage that closed segments are offloaded to.
+		// Offloading is disabled when it's nil.
+		Store ObjectStore
+		// How long a closed segment stays on the local disk before Offload moves it to the Store.
+		OffloadAfter time.Duration
+		// The directory remote segments are fetched into when they're read.
+		// Defaults to a "cache" directory inside the log's directory.
+		CacheDir string
+		// The maximum number of fetched segments kept in the CacheDir.
+		MaxCachedSegments int
+	}
+	Encryption struct {
+		// The provider of the keys segment stores are encrypted at rest with.
+		// Stores are written in plaintext when it's nil.
+		Keys KeyProvider
+	}
+	RecordCache struct {
+		// The maximum number of the most recently appended records the log keeps in memory, unmarshalled,
+		// to serve reads near the head of the log without touching the store.
+		MaxRecords int
+		// The maximum number of bytes the cached records may take up, marshalled.
+		// The cache is disabled when both limits are 0.
+		MaxBytes uint64
+	}
+	Producers struct {
+		// The number of idempotent producers whose last sequence numbers the log remembers.
+		// When a producer that was forgotten retries a record, the record is appended again. Defaults to 1024.
+		MaxProducers int
+	}
+	Transactions struct {
+		// How long an open transaction may go without appending a record before the log aborts it,
+		// so an abandoned transaction doesn't hold read-committed consumers back. Defaults to a minute.
+		Timeout time.Duration
+	}
+	// Opens the log for inspection tools: NewLog takes a shared lock on the directory
+	// instead of an exclusive one, and the log refuses writes with ErrReadOnly.
+	// OpenReadOnly sets it to read a log while another process writes it.
+	ReadOnly bool
+	// The codec AppendBatch compresses record batches with.
+	// Batches are written uncompressed by default.
+	Compression Codec
+}
+
+// validate checks that the segments the config describes can be written without overflowing their indexes.
+func (c Config) validate() error {
+	width := c.Segment.IndexOffsetWidth
+	if width != 4 && width != 8 {
+		return fmt.Errorf("invalid log config: IndexOffsetWidth must be 4 or 8, got %d", width)
+	}
+	if c.Segment.MaxIndexBytes < indexHeaderLen+width+posWidth {
+		return fmt.Errorf("invalid log config: MaxIndexBytes %d can't hold a single index entry", c.Segment.MaxIndexBytes)
+	}
+	if width == 4 && (c.Segment.MaxIndexBytes-indexHeaderLen)/(width+posWidth) > math.MaxUint32+1 {
+		return fmt.Errorf(
+			"invalid log config: MaxIndexBytes %d allows more than 2^32 records per segment, which needs an IndexOffsetWidth of 8",
+			c.Segment.MaxIndexBytes,
+		)
+	}
+	if c.Compression > LZ4 {
+		return fmt.Errorf("invalid log config: unknown compression codec: %s", c.Compression)
 	}
+	return nil
 }
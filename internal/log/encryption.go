@@ -0,0 +1,249 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+// KeyProvider hands out the keys that segment stores are encrypted with.
+// Each segment records the ID of the key it was created with, so rotating the current key
+// only affects new segments, and old segments stay readable as long as the provider still knows their key.
+// The first implementation is KeyFileProvider; a KMS-backed provider only needs to implement these two methods.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the bytes of the key that new segments are encrypted with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the bytes of the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// KeyFileProvider reads AES keys from a local file with one key per line:
+//
+//	<id> <base64-encoded 16, 24, or 32 byte key>
+//
+// The key on the last line is the current key, so rotating a key means appending a line.
+type KeyFileProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+var _ KeyProvider = (*KeyFileProvider)(nil)
+
+func NewKeyFileProvider(name string) (*KeyFileProvider, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &KeyFileProvider{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("malformed key line in %q: %q", name, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("malformed key %q in %q: %w", id, name, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %q in %q: %w", id, name, err)
+		}
+		p.keys[id] = key
+		p.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.current == "" {
+		return nil, fmt.Errorf("no keys in %q", name)
+	}
+	return p, nil
+}
+
+func (p *KeyFileProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *KeyFileProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %q", id)
+	}
+	return key, nil
+}
+
+// keyExt is the extension of the file holding the ID of the key a segment's store is encrypted with.
+const keyExt = ".key"
+
+// segmentCipher returns the AEAD the segment's store is encrypted with, or nil if it's stored in plaintext.
+// A new segment records the provider's current key ID in its key file.
+// An existing segment without a key file was written before encryption was turned on, so it stays in plaintext.
+// Read-only logs never write key files.
+func segmentCipher(keyFile string, storeSize uint64, keys KeyProvider, readOnly bool) (cipher.AEAD, error) {
+	if keys == nil {
+		return nil, nil
+	}
+
+	var key []byte
+	b, err := os.ReadFile(keyFile)
+	switch {
+	case err == nil:
+		if key, err = keys.Key(string(b)); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist) && storeSize == 0 && !readOnly:
+		var id string
+		if id, key, err = keys.CurrentKey(); err != nil {
+			return nil, err
+		}
+		if err := writeKeyFile(keyFile, id); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeKeyFile writes the key ID to a temp file, syncs it, renames it into place, and syncs the directory,
+// so a crash can't leave a segment whose records are encrypted but whose key file is empty or missing,
+// which would make the segment look like it was written in plaintext.
+func writeKeyFile(name, id string) error {
+	f, err := os.OpenFile(name+tmpExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(id); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name+tmpExt, name); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// PlaintextReader returns an io.Reader to read the whole log like Reader does,
+// except that the records of encrypted segments come out decrypted.
+// Reader's output is safe to ship anywhere since it stays encrypted, but this one isn't:
+// the server only streams it to clients the ACL grants the decrypt action, in plaintext Snapshot calls.
+func (l *Log) PlaintextReader() io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	readers := make([]io.Reader, len(l.segments))
+	for i, segment := range l.segments {
+		r := &plaintextReader{log: l, segment: segment}
+		if !segment.remote {
+			// appends hold the log's write lock, so the store's size is stable while we hold the read lock
+			r.end = segment.store.size
+		}
+		readers[i] = r
+	}
+	return io.MultiReader(readers...)
+}
+
+// plaintextReader decrypts a segment's store one record frame at a time and re-frames the plaintext
+// the way the store frames records: [length][record].
+type plaintextReader struct {
+	log     *Log
+	segment *segment
+	// the position of the next frame to read and the store's size when the reader was created
+	pos, end uint64
+	buf      []byte
+}
+
+func (r *plaintextReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the record frame at the reader's position into its buffer.
+// Offloading swaps the segment's store for a remote one, so we look at the segment under the log's read lock.
+func (r *plaintextReader) next() error {
+	r.log.mu.RLock()
+	if r.segment.remote {
+		// fetching the segment may download it, which appends mustn't wait for
+		r.log.mu.RUnlock()
+		err := r.nextRemote()
+		if err != nil && err != io.EOF {
+			err = r.log.remoteError(r.segment, r.segment.baseOffset, err)
+		}
+		return err
+	}
+	defer r.log.mu.RUnlock()
+	if r.log.closed {
+		return api.ErrLogClosed{}
+	}
+	if !r.log.contains(r.segment) {
+		return r.log.outOfRange(r.segment.baseOffset)
+	}
+	return r.read(r.segment.store)
+}
+
+// nextRemote reads the next record frame from the cached copy of the remote segment.
+func (r *plaintextReader) nextRemote() error {
+	cached, err := r.log.pin(r.segment)
+	if err != nil {
+		return err
+	}
+	defer r.log.unpin(cached)
+	// a remote segment never changes, so its whole store is ours to read
+	r.end = cached.store.size
+	return r.read(cached.store)
+}
+
+func (r *plaintextReader) read(s *store) error {
+	if r.pos >= r.end {
+		return io.EOF
+	}
+
+	b, err := s.Read(r.pos)
+	if err != nil {
+		return err
+	}
+	r.pos += s.frameSize(b)
+	r.buf = make([]byte, lenWidth+len(b))
+	enc.PutUint64(r.buf, uint64(len(b)))
+	copy(r.buf[lenWidth:], b)
+	return nil
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestKeyFileProvider(t *testing.T) {
+	old, current := newKey(t), newKey(t)
+	name := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(name, []byte(fmt.Sprintf(
+		"# rotated monthly\nold %s\ncurrent %s\n",
+		base64.StdEncoding.EncodeToString(old),
+		base64.StdEncoding.EncodeToString(current),
+	)), 0600))
+
+	p, err := NewKeyFileProvider(name)
+	require.NoError(t, err)
+	id, key, err := p.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, "current", id)
+	require.Equal(t, current, key)
+	key, err = p.Key("old")
+	require.NoError(t, err)
+	require.Equal(t, old, key)
+	_, err = p.Key("unknown")
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(name, []byte("short "+base64.StdEncoding.EncodeToString([]byte("abc"))), 0600))
+	_, err = NewKeyFileProvider(name)
+	require.Error(t, err)
+}
+
+func TestLogEncryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kms := &stubKMS{keys: map[string][]byte{"v1": newKey(t)}, current: "v1"}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Encryption.Keys = kms
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	secret := []byte("ssn: 123-45-6789")
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: secret})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// the records are encrypted at rest and the segment records which key it uses
+	b, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(b, secret))
+	id, err := os.ReadFile(filepath.Join(dir, "0"+keyExt))
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(id))
+
+	// rotating the key only affects new segments
+	kms.keys["v2"] = newKey(t)
+	kms.current = "v2"
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.newSegment(2))
+	_, err = log.Append(&api.Record{Value: secret})
+	require.NoError(t, err)
+	id, err = os.ReadFile(filepath.Join(dir, "2"+keyExt))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(id))
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, secret, read.Value)
+	}
+
+	// the raw reader stays encrypted while the plaintext reader decrypts
+	b, err = io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(b, secret))
+	b, err = io.ReadAll(log.PlaintextReader())
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		size := enc.Uint64(b[:lenWidth])
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], read))
+		require.Equal(t, secret, read.Value)
+		require.Equal(t, off, read.Offset)
+		b = b[lenWidth+size:]
+	}
+	require.Empty(t, b)
+
+	// segments can't be read once their key is gone
+	require.NoError(t, log.Close())
+	delete(kms.keys, "v1")
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+// stubKMS stands in for a KMS-backed KeyProvider.
+type stubKMS struct {
+	keys    map[string][]byte
+	current string
+}
+
+func (s *stubKMS) CurrentKey() (string, []byte, error) {
+	return s.current, s.keys[s.current], nil
+}
+
+func (s *stubKMS) Key(id string) ([]byte, error) {
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %q", id)
+	}
+	return key, nil
+}
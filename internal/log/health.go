@@ -0,0 +1,65 @@
+package log
+
+import (
+	"errors"
+	"syscall"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Check tells whether the log can take appends, for health checks. A log can't when it was opened read-only,
+when its directory is on a read-only filesystem, or when its disk is full, which Check reports with api.ErrDiskFull.
+We look at the filesystem itself rather than wait for an append to fail, so a server reports it can't take writes
+before a client tries, but an append that failed for lack of space or a read-only disk is also remembered until one succeeds.
+*/
+func (l *Log) Check() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.mu.RLock()
+	err := l.writeErr
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Access(l.Dir, unix.W_OK); err != nil {
+		return diskError(err)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(l.Dir, &st); err != nil {
+		return err
+	}
+	if st.Bavail == 0 {
+		return api.ErrDiskFull{}
+	}
+	return nil
+}
+
+// noteWriteErr remembers whether the last write failed because of the disk, and returns the write's error translated by diskError.
+// The caller must hold the write lock.
+func (l *Log) noteWriteErr(err error) error {
+	if err == nil {
+		l.writeErr = nil
+		return nil
+	}
+	err = diskError(err)
+	if err == (api.ErrDiskFull{}) || err == ErrReadOnly {
+		l.writeErr = err
+	}
+	return err
+}
+
+// diskError translates the errors of writing to a full or read-only disk to api.ErrDiskFull and ErrReadOnly.
+func diskError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return api.ErrDiskFull{}
+	case errors.Is(err, syscall.EROFS):
+		return ErrReadOnly
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package log
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, log.Check())
+
+	// an append that failed for lack of space is remembered until one succeeds
+	log.mu.Lock()
+	log.noteWriteErr(fmt.Errorf("write: %w", syscall.ENOSPC))
+	log.mu.Unlock()
+	require.Equal(t, api.ErrDiskFull{}, log.Check())
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Check())
+
+	// other errors don't say anything about the disk
+	log.mu.Lock()
+	log.noteWriteErr(fmt.Errorf("some error"))
+	log.mu.Unlock()
+	require.NoError(t, log.Check())
+	require.NoError(t, log.Close())
+
+	ro, err := OpenReadOnly(dir, Config{})
+	require.NoError(t, err)
+	defer ro.Close()
+	require.Equal(t, ErrReadOnly, ro.Check())
+}
@@ -1,7 +1,11 @@
 package log
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 
 	"github.com/tysonmote/gommap"
@@ -11,10 +15,11 @@ import (
 *Width define the number of bytes that make up the value in the index
 
 Our index entries contain two fields: the record's offset and its position in the store file.
-We store offsets as uint32 and positions as uint64, so they take up 4 and 8 bytes respectively.
+We store positions as uint64s, so they take up 8 bytes. Offsets are relative to the segment's base offset
+and take up 4 bytes by default, which caps a segment at 2^32 records; indexes can use 8 byte offsets instead.
 
-We use the entWidth to jump straight to the position of an entry given its offset since the position in the file is
-offset * entWidth.
+We use the entry width to jump straight to the position of an entry given its offset since the position in the file is
+header + offset * entWidth.
 */
 
 var (
@@ -23,19 +28,49 @@ var (
 	entWidth        = offWidth + posWidth
 )
 
+/*
+Since version 1, an index starts with a header that records its format:
+
+	[magic][version][offset width][reserved]
+	 4bytes 1byte    1byte         2bytes
+
+Version 0 indexes have no header and use 4 byte offsets. Their first entry is always
+offset 0 (four zero bytes), so it can't be mistaken for the magic.
+*/
+
+const (
+	indexMagic          = "PLIX"
+	indexVersion   byte = 1
+	indexHeaderLen      = 8
+)
+
+var errIndexOffsetOverflow = errors.New("relative offset overflows the index's offset width")
+
 // index defines our index file, which comprises a persisted file and a memory-mapped file.
 type index struct {
 	file *os.File
 	// The memory-mapped file that we'll use to access the index
 	mmap gommap.MMap
-	// The size of the index and where to write the next enrtry appended to the index
+	// The size of the index, header included, and where to write the next entry appended to the index
 	size uint64
+	// The length of the header; 0 for version 0 indexes
+	headerLen uint64
+	// The width of the relative offsets and of whole entries
+	offWidth uint64
+	entWidth uint64
+	// Set for indexes of read-only logs, which are mapped PROT_READ and never resized
+	readOnly bool
 }
 
 // newIndex creates an index for the given file.
 // We save the current size of the file so we can track the amount of data in the index file as we add index entries.
 // we grow the file to the max index size before memory-mapping the file and then return the created index to the caller.
+// A new index is written with the current version's header and the configured offset width; an existing index keeps its own format.
 func newIndex(f *os.File, c Config) (*index, error) {
+	if c.ReadOnly {
+		return newReadOnlyIndex(f)
+	}
+
 	idx := &index{
 		file: f,
 	}
@@ -45,6 +80,24 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
+
+	header := make([]byte, indexHeaderLen)
+	switch {
+	case idx.size == 0:
+		header = newIndexHeader(c.Segment.IndexOffsetWidth)
+		if _, err := f.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+		idx.size = indexHeaderLen
+	case idx.size >= indexHeaderLen:
+		if _, err := f.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := idx.readHeader(header); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+
 	// The reason we resize them now is that, once they're memory-mapped, we can't resize them.
 	// We grow the files by appending empty space at the end of them, so the last entry is no longer
 	// ad the end of the file - instead, there's some unknown amount of space between this entry and the file's end.
@@ -67,10 +120,122 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
+// newReadOnlyIndex maps the index file as it is, without writing a header or growing it.
+// Since the file may belong to a segment another process is appending to, the index starts out empty
+// and the segment scans it for the entries that are backed by records in the store.
+func newReadOnlyIndex(f *os.File) (*index, error) {
+	idx := &index{
+		file:     f,
+		readOnly: true,
+	}
+	if err := idx.remap(); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, indexHeaderLen)
+	if len(idx.mmap) >= indexHeaderLen {
+		copy(header, idx.mmap)
+	}
+	if err := idx.readHeader(header); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	idx.size = idx.headerLen
+	return idx, nil
+}
+
+// remap maps the read-only index's file again if its size changed, which happens when
+// the writer opens the segment and grows its index to MaxIndexBytes.
+func (i *index) remap() error {
+	fi, err := i.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == int64(len(i.mmap)) {
+		return nil
+	}
+
+	if i.mmap != nil {
+		if err := i.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		i.mmap = nil
+	}
+	// an empty file can't be mapped, and has no entries to read anyway
+	if fi.Size() == 0 {
+		return nil
+	}
+	i.mmap, err = gommap.Map(i.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	return err
+}
+
+// scan picks up the entries appended to a read-only index since it was last scanned.
+// A writer pads its index with zeros, so an entry only counts if its relative offset matches
+// its place in the index and it points inside the store, i.e. its record has been flushed.
+func (i *index) scan(storeSize uint64) error {
+	if err := i.remap(); err != nil {
+		return err
+	}
+	if i.headerLen == 0 && len(i.mmap) >= indexHeaderLen && bytes.Equal(i.mmap[:len(indexMagic)], []byte(indexMagic)) {
+		// the index was empty when we opened it, and the writer has written its header since
+		if err := i.readHeader(i.mmap[:indexHeaderLen]); err != nil {
+			return err
+		}
+		i.size = i.headerLen
+	}
+
+	for i.hasRoom(1) {
+		off, pos := i.entry(i.size)
+		if off != i.entries() || pos >= storeSize {
+			break
+		}
+		i.size += i.entWidth
+	}
+	return nil
+}
+
+func newIndexHeader(width uint64) []byte {
+	if width == 0 {
+		width = offWidth
+	}
+	header := make([]byte, indexHeaderLen)
+	copy(header, indexMagic)
+	header[4] = indexVersion
+	header[5] = byte(width)
+	return header
+}
+
+// readHeader sets the index's format from its header, falling back to version 0 if there's no header.
+func (i *index) readHeader(header []byte) error {
+	if !bytes.Equal(header[:len(indexMagic)], []byte(indexMagic)) {
+		i.headerLen, i.offWidth = 0, offWidth
+		i.entWidth = i.offWidth + posWidth
+		return nil
+	}
+
+	if version := header[4]; version != indexVersion {
+		return fmt.Errorf("unsupported index version: %d", version)
+	}
+	i.headerLen, i.offWidth = indexHeaderLen, uint64(header[5])
+	if i.offWidth != 4 && i.offWidth != 8 {
+		return fmt.Errorf("unsupported index offset width: %d", i.offWidth)
+	}
+	i.entWidth = i.offWidth + posWidth
+	return nil
+}
+
 // Close makes sure the memory-mapped file has synced its data to the persisted file and that the persisted file
 // has flushed its contents to stable storage.
 // Then it truncates the persisted file to the amount of data that's actually in it.
 func (i *index) Close() error {
+	if i.readOnly {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
@@ -86,44 +251,77 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+// entries returns the number of entries in the index.
+func (i *index) entries() uint64 {
+	return (i.size - i.headerLen) / i.entWidth
+}
+
+// capacity returns how many entries the index holds once it's full.
+func (i *index) capacity() uint64 {
+	return (uint64(len(i.mmap)) - i.headerLen) / i.entWidth
+}
+
+// hasRoom reports whether the index can take n more entries.
+func (i *index) hasRoom(n uint64) bool {
+	return uint64(len(i.mmap)) >= i.size+n*i.entWidth
+}
+
 // Read takes in an offset and returns the associated record's position in the store.
 // The given offset is relative to the segment's base offset; 0 is always the offset of the index's first entry.
 // 1 is the second entry, and so on.
-// We use relative offsets to reduce the size of the indexes by storing offsets as uint32s.
+// We use relative offsets to reduce the size of the indexes by storing offsets as uint32s by default.
 // If we used absolute offsets, we'd have to store the offsets as uint64s and require four more bytes for each entry.
-func (i *index) Read(offset int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+func (i *index) Read(offset int64) (out uint64, pos uint64, err error) {
+	if i.entries() == 0 {
 		return 0, 0, io.EOF
 	}
 
 	if offset == -1 {
 		// calculate the relative offset of the last entry
-		out = uint32((i.size / entWidth) - 1)
+		out = i.entries() - 1
 	} else {
-		out = uint32(offset)
+		out = uint64(offset)
 	}
 
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	if out >= i.entries() {
 		return 0, 0, io.EOF
 	}
-
-	// size of the offset part of the index entry
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
-	// size of the position part of the index entry
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	out, pos = i.entry(i.headerLen + out*i.entWidth)
 	return out, pos, nil
 }
 
+// entry decodes the entry that starts at the given position in the file.
+func (i *index) entry(at uint64) (off, pos uint64) {
+	// the offset part of the index entry
+	if i.offWidth == 4 {
+		off = uint64(enc.Uint32(i.mmap[at : at+i.offWidth]))
+	} else {
+		off = enc.Uint64(i.mmap[at : at+i.offWidth])
+	}
+	// the position part of the index entry
+	pos = enc.Uint64(i.mmap[at+i.offWidth : at+i.entWidth])
+	return off, pos
+}
+
 // Write appends the given offset and position to the index.
-func (i *index) Write(offset uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth {
+func (i *index) Write(offset uint64, pos uint64) error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
+	if !i.hasRoom(1) {
 		return io.EOF
 	}
 
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], offset)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
-	i.size += entWidth
+	if i.offWidth == 4 {
+		if offset > math.MaxUint32 {
+			return errIndexOffsetOverflow
+		}
+		enc.PutUint32(i.mmap[i.size:i.size+i.offWidth], uint32(offset))
+	} else {
+		enc.PutUint64(i.mmap[i.size:i.size+i.offWidth], offset)
+	}
+	enc.PutUint64(i.mmap[i.size+i.offWidth:i.size+i.entWidth], pos)
+	i.size += i.entWidth
 	return nil
 }
 
@@ -2,6 +2,7 @@ package log
 
 import (
 	"io"
+	"math"
 	"os"
 	"testing"
 
@@ -19,7 +20,7 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, f.Name(), idx.Name())
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -45,6 +46,70 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
-	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexOffsetWidth(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "index_width_test")
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexOffsetWidth = 8
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), idx.entWidth)
+
+	// 8 byte offsets go past what 4 bytes can hold
+	want := uint64(math.MaxUint32) + 1
+	require.NoError(t, idx.Write(want, 10))
+	off, pos, err := idx.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, want, off)
+	require.Equal(t, uint64(10), pos)
+	require.NoError(t, idx.Close())
+
+	// the width comes from the header, not the config, when the index exists
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	c.Segment.IndexOffsetWidth = 4
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	off, _, err = idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, want, off)
+	require.NoError(t, idx.Close())
+
+	// 4 byte offsets refuse to wrap
+	f, err = os.CreateTemp(t.TempDir(), "index_overflow_test")
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, errIndexOffsetOverflow, idx.Write(want, 10))
+}
+
+func TestIndexVersion0(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "index_v0_test")
+	require.NoError(t, err)
+
+	// version 0 indexes have no header and 4 byte offsets
+	entry := make([]byte, entWidth)
+	for i := uint64(0); i < 2; i++ {
+		enc.PutUint32(entry[:offWidth], uint32(i))
+		enc.PutUint64(entry[offWidth:], i*width)
+		_, err = f.Write(entry)
+		require.NoError(t, err)
+	}
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexOffsetWidth = 8
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx.headerLen)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, width, pos)
+}
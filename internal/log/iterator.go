@@ -0,0 +1,322 @@
+package log
+
+import (
+	"errors"
+	"io"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// iteratorReadAhead is the number of bytes an iterator reads from a store at a time,
+// so sequential reads are served from memory instead of costing two ReadAts per record.
+const iteratorReadAhead = 64 * 1024
+
+/*
+Iterator walks the log's records in order, forwards with Next or backwards with Prev.
+Its cursor sits between two records: Next returns the record at the cursor and moves the cursor past it,
+and Prev returns the record before the cursor and moves the cursor before it, so calling Next after Prev
+returns the same record again.
+
+Moving forwards, the iterator keeps its place in the current segment's store and reads the records one frame
+after the other, without looking them up in the index. Appends and truncations can run while the iterator is in use:
+each call holds the log's read lock, and the iterator looks its segment up again when the log's segments change under it.
+
+	it := log.Iterator()
+	it.Seek(offset)
+	for it.Next() {
+		record := it.Record()
+	}
+	if err := it.Err(); err != nil {
+	}
+
+When Next returns false with a nil Err, the iterator has caught up with the log,
+and Next returns the records appended since when it's called again.
+*/
+type Iterator struct {
+	log *Log
+	// the offset of the record Next returns
+	cursor uint64
+	// the segment holding the record at the cursor and, if known, the position of the record's frame in its store
+	segment *segment
+	pos     uint64
+	posOK   bool
+	// the bytes read ahead from the segment's store, starting at bufStart
+	buf      []byte
+	bufStart uint64
+
+	record    *api.Record
+	err       error
+	isolation api.IsolationLevel
+	// set for the log's own scans, which go straight to the store so they don't skew the record cache's counters,
+	// and don't refresh a follower since the follower scans when it refreshes
+	scan bool
+}
+
+// Iterator returns an iterator positioned at the log's lowest offset.
+func (l *Log) Iterator() *Iterator {
+	it := &Iterator{log: l}
+	lowest, _ := l.LowestOffset()
+	it.Seek(lowest)
+	return it
+}
+
+// Seek moves the cursor so that Next returns the record at the given offset and Prev returns the one before it.
+func (it *Iterator) Seek(offset uint64) {
+	it.cursor = offset
+	it.posOK = false
+	it.record, it.err = nil, nil
+}
+
+// SetIsolation sets which records of transactions the iterator returns. A read-committed iterator
+// skips transaction markers and the records of aborted transactions, and Next stops at the last stable offset.
+func (it *Iterator) SetIsolation(level api.IsolationLevel) {
+	it.isolation = level
+}
+
+// Next reads the record at the cursor and moves the cursor past it.
+// It returns false when there's no record at the cursor, either because the iterator reached the end of the log
+// or because of an error, which Err returns.
+func (it *Iterator) Next() bool {
+	for {
+		record, err := it.next()
+		if err == io.EOF && it.log.follow && !it.scan {
+			// the writer may have appended the record since we last looked
+			if err = it.log.Refresh(); err == nil {
+				record, err = it.next()
+			}
+		}
+		if !it.done(record, err, it.cursor+1) {
+			return false
+		}
+		if it.visible(record) {
+			return true
+		}
+	}
+}
+
+// next reads the record at the cursor, or returns io.EOF if a read-committed iterator reached the last stable offset.
+func (it *Iterator) next() (*api.Record, error) {
+	if it.isolation == api.IsolationLevel_READ_COMMITTED && it.cursor >= it.log.stableOffset() {
+		return nil, io.EOF
+	}
+	return it.read(it.cursor, true)
+}
+
+// Prev reads the record before the cursor and moves the cursor before it.
+// It returns false at the start of the log or on an error, which Err returns.
+func (it *Iterator) Prev() bool {
+	for {
+		if it.cursor == 0 {
+			it.record, it.err = nil, nil
+			return false
+		}
+		record, err := it.read(it.cursor-1, false)
+		if !it.done(record, err, it.cursor-1) {
+			return false
+		}
+		if it.visible(record) {
+			return true
+		}
+	}
+}
+
+// visible reports whether the iterator's isolation level lets it return the record.
+func (it *Iterator) visible(record *api.Record) bool {
+	return it.isolation != api.IsolationLevel_READ_COMMITTED || it.log.committed(record)
+}
+
+// done records the outcome of a read and moves the cursor if it succeeded.
+func (it *Iterator) done(record *api.Record, err error, cursor uint64) bool {
+	it.record, it.err = record, err
+	if err == io.EOF {
+		it.err = nil
+	}
+	if err != nil {
+		it.record = nil
+		return false
+	}
+	if !it.scan {
+		it.log.metrics.reads.Inc()
+	}
+	it.cursor = cursor
+	return true
+}
+
+// Record returns the record read by the last call to Next or Prev.
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// Err returns the error that stopped the last call to Next or Prev, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// read returns the record at the given offset, or io.EOF if it's past either end of the log.
+// Offsets below the lowest offset are out of range going forwards, since they were truncated from under the iterator.
+func (it *Iterator) read(off uint64, forward bool) (*api.Record, error) {
+	l := it.log
+	if !it.scan {
+		if record, ok := l.recordCache.get(off); ok {
+			// we skipped the store, so we no longer know where the record at the cursor starts
+			it.posOK = false
+			return record, nil
+		}
+	}
+
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return nil, api.ErrLogClosed{}
+	}
+
+	s := l.segmentFor(off)
+	if s == nil {
+		defer l.mu.RUnlock()
+		if forward && len(l.segments) > 0 && off < l.segments[0].baseOffset {
+			return nil, l.outOfRange(off)
+		}
+		return nil, io.EOF
+	}
+	if s != it.segment {
+		it.segment, it.posOK = s, false
+		it.buf, it.bufStart = it.buf[:0], 0
+	}
+	if s.remote {
+		it.posOK = false
+		// fetching the segment may download it, which appends mustn't wait for
+		l.mu.RUnlock()
+		return l.readRemote(s, off)
+	}
+	defer l.mu.RUnlock()
+	record, err := it.readLocal(s, off, forward)
+	if errors.Is(err, io.EOF) && l.follow {
+		// the writer indexed the record but hasn't flushed it to the store yet
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, readError(s, off, err)
+	}
+	return record, nil
+}
+
+// readLocal reads the record at the given offset from the local segment,
+// and keeps track of where the record at the cursor starts in the store.
+func (it *Iterator) readLocal(s *segment, off uint64, forward bool) (*api.Record, error) {
+	pos := it.pos
+	if !forward || !it.posOK {
+		var err error
+		if _, pos, err = s.index.Read(int64(off - s.baseOffset)); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		p    []byte
+		size uint64
+		err  error
+	)
+	b, ok := s.batches.get(pos)
+	if !ok {
+		if p, size, err = it.frame(s, pos); err != nil {
+			return nil, err
+		}
+		if isBatch(p) {
+			first, records, err := decodeBatch(p)
+			if err != nil {
+				return nil, err
+			}
+			b = &batch{first: first, records: records}
+			s.batches.put(pos, b)
+		}
+	}
+	if b != nil {
+		if p, err = b.record(off); err != nil {
+			return nil, err
+		}
+	}
+
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+
+	if !forward {
+		// the record we read is the one at the cursor now
+		it.pos, it.posOK = pos, true
+		return record, nil
+	}
+	// records in a batch share its frame, so we only move on to the next frame after the batch's last record
+	next := pos
+	if b == nil || off+1 == b.first+uint64(len(b.records)) {
+		if size == 0 {
+			n, err := it.frameLen(s, pos)
+			if err != nil {
+				return nil, err
+			}
+			size = lenWidth + n
+		}
+		next += size
+	}
+	it.pos, it.posOK = next, true
+	return record, nil
+}
+
+// frame returns the decrypted record frame at the given position in the segment's store,
+// and the number of bytes it takes up in the store.
+func (it *Iterator) frame(s *segment, pos uint64) ([]byte, uint64, error) {
+	n, err := it.frameLen(s, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := it.window(s, pos+lenWidth, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.store.aead != nil {
+		if b, err = s.store.open(pos, b); err != nil {
+			return nil, 0, err
+		}
+	}
+	return b, lenWidth + n, nil
+}
+
+// frameLen returns the length of the record in the frame at the given position, as written in the frame's length prefix.
+func (it *Iterator) frameLen(s *segment, pos uint64) (uint64, error) {
+	b, err := it.window(s, pos, lenWidth)
+	if err != nil {
+		return 0, err
+	}
+	return enc.Uint64(b), nil
+}
+
+// window returns n bytes of the segment's store starting at pos, reading ahead into the iterator's buffer
+// if they aren't in it already. The caller must hold the log's read lock, which keeps the store's size stable.
+func (it *Iterator) window(s *segment, pos, n uint64) ([]byte, error) {
+	if m := s.store.mmap; m != nil {
+		// a closed store is mapped, so there's nothing to read ahead
+		if pos+n > uint64(len(m)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return m[pos : pos+n], nil
+	}
+	if pos < it.bufStart || pos+n > it.bufStart+uint64(len(it.buf)) {
+		if pos+n > s.store.size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := min(max(n, iteratorReadAhead), s.store.size-pos)
+		if uint64(cap(it.buf)) >= size {
+			it.buf = it.buf[:size]
+		} else {
+			it.buf = make([]byte, size)
+		}
+		if _, err := s.store.ReadAt(it.buf, int64(pos)); err != nil && err != io.EOF {
+			it.buf = it.buf[:0]
+			return nil, err
+		}
+		it.bufStart = pos
+	}
+	at := pos - it.bufStart
+	return it.buf[at : at+n], nil
+}
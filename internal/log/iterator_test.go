@@ -0,0 +1,164 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"iterates across segments":        testIterateForward,
+		"seeks and iterates in reverse":   testIterateReverse,
+		"picks up concurrent appends":     testIterateAppends,
+		"reports truncated offsets":       testIterateTruncated,
+		"iterates through record batches": testIterateBatches,
+		"iterates concurrently":           testIterateConcurrently,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			log, err := NewLog(t.TempDir(), c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+func appendRecords(t *testing.T, log *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+}
+
+func testIterateForward(t *testing.T, log *Log) {
+	appendRecords(t, log, 10)
+	require.Greater(t, len(log.segments), 2)
+
+	it := log.Iterator()
+	var off uint64
+	for it.Next() {
+		require.Equal(t, off, it.Record().Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(it.Record().Value))
+		off++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(10), off)
+}
+
+func testIterateReverse(t *testing.T, log *Log) {
+	appendRecords(t, log, 10)
+
+	it := log.Iterator()
+	it.Seek(10)
+	off := uint64(10)
+	for it.Prev() {
+		off--
+		require.Equal(t, off, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(0), off)
+
+	// Next after Prev returns the same record again
+	it.Seek(5)
+	require.True(t, it.Prev())
+	require.Equal(t, uint64(4), it.Record().Offset)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(4), it.Record().Offset)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(5), it.Record().Offset)
+}
+
+func testIterateAppends(t *testing.T, log *Log) {
+	appendRecords(t, log, 2)
+
+	it := log.Iterator()
+	require.True(t, it.Next())
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	// the iterator picks up where it left off, into the segments created since
+	appendRecords(t, log, 8)
+	off := uint64(2)
+	for it.Next() {
+		require.Equal(t, off, it.Record().Offset)
+		off++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(10), off)
+}
+
+func testIterateTruncated(t *testing.T, log *Log) {
+	appendRecords(t, log, 10)
+
+	it := log.Iterator()
+	require.True(t, it.Next())
+	require.NoError(t, log.Truncate(5))
+	require.False(t, it.Next())
+	require.IsType(t, api.ErrOffsetBelowLowest{}, it.Err())
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	it.Seek(lowest)
+	require.True(t, it.Next())
+	require.Equal(t, lowest, it.Record().Offset)
+}
+
+func testIterateBatches(t *testing.T, log *Log) {
+	log.Config.Compression = Snappy
+	var records []*api.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	_, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+
+	it := log.Iterator()
+	var values []string
+	for it.Next() {
+		values = append(values, string(it.Record().Value))
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []string{
+		"record 0", "record 1", "record 2", "record 3", "record 4",
+		"record 0", "record 1", "record 2",
+	}, values)
+}
+
+// testIterateConcurrently runs iterators alongside each other and an appender, like the server's streams do,
+// so the race detector catches them sharing the active store's buffer unsafely.
+func testIterateConcurrently(t *testing.T, log *Log) {
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		appendRecords(t, log, n)
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			it := log.Iterator()
+			var off uint64
+			for off < n {
+				if !it.Next() {
+					require.NoError(t, it.Err())
+					continue
+				}
+				require.Equal(t, off, it.Record().Offset)
+				require.Equal(t, fmt.Sprintf("record %d", off), string(it.Record().Value))
+				off++
+			}
+		}()
+	}
+	wg.Wait()
+}
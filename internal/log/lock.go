@@ -0,0 +1,61 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFileName is the file in the log's directory that NewLog locks,
+// so two processes never mmap and append to the same segments.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by NewLog when another process, or another Log in this process,
+// already holds a conflicting lock on the directory.
+type ErrLocked struct {
+	Dir string
+}
+
+func (e ErrLocked) Error() string {
+	return fmt.Sprintf("log directory %q is locked by another process", e.Dir)
+}
+
+// ErrReadOnly is returned when writing to a log that was opened read-only.
+var ErrReadOnly = errors.New("log is read-only")
+
+// lockDir takes a flock on the directory's lock file: an exclusive lock for a log we write to,
+// or a shared lock for a read-only log so several inspection tools can read it at once.
+// The lock is released when the returned file is closed, or when the process dies.
+func lockDir(dir string, shared bool) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked{Dir: dir}
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockDir releases the lock taken by lockDir.
+func unlockDir(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestDirLock(t *testing.T) {
+	dir := t.TempDir()
+
+	writer, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = writer.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+
+	// nobody else can open the directory while it's being written to
+	_, err = NewLog(dir, Config{})
+	var locked ErrLocked
+	require.ErrorAs(t, err, &locked)
+	require.Equal(t, dir, locked.Dir)
+	ro := Config{ReadOnly: true}
+	_, err = NewLog(dir, ro)
+	require.ErrorAs(t, err, &locked)
+
+	// closing the log releases the lock
+	require.NoError(t, writer.Close())
+
+	// several readers can share the directory, but they keep writers out
+	reader, err := NewLog(dir, ro)
+	require.NoError(t, err)
+	other, err := NewLog(dir, ro)
+	require.NoError(t, err)
+	_, err = NewLog(dir, Config{})
+	require.ErrorAs(t, err, &locked)
+
+	read, err := reader.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read.Value)
+	_, err = reader.Append(&api.Record{Value: write})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, reader.Truncate(1))
+
+	require.NoError(t, reader.Close())
+	require.NoError(t, other.Close())
+	writer, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+}
+
+func TestResetKeepsDirLocked(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = lenWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: write})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Reset())
+	var locked ErrLocked
+	_, err = NewLog(dir, Config{})
+	require.ErrorAs(t, err, &locked)
+
+	// the log starts over
+	require.Len(t, log.segments, 1)
+	off, err := log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read.Value)
+}
@@ -1,13 +1,19 @@
 package log
 
 import (
+	"cmp"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/ttaaoo/proglog/api/v1"
 )
@@ -20,7 +26,46 @@ type Log struct {
 	Config Config
 
 	activeSegment *segment
-	segments      []*segment
+	// segments holds both the local and the remote segments, oldest first.
+	// Remote segments are always older than the local ones since we only offload closed segments.
+	segments []*segment
+
+	// cacheMu guards the copies of remote segments that were fetched back into the cache dir,
+	// and the downloads of the segments being fetched, which readers of the same segment wait for.
+	cacheMu     sync.Mutex
+	cached      map[uint64]*segment
+	cacheOrder  []uint64
+	fetching    map[uint64]chan struct{}
+	cacheClosed bool
+	// how many readers are reading each cached copy, which keeps it from being removed,
+	// and the copies the cache evicted while they were being read, which fetch puts back instead of downloading them again
+	pins    map[*segment]int
+	evicted map[uint64]*segment
+	// serializes Offload calls, which upload segments without holding mu
+	offloadMu sync.Mutex
+
+	// the flock on the directory's lock file, held until the log is closed
+	lockFile *os.File
+	// the last sequence numbers of idempotent producers and the state of the transactions,
+	// which reflect the records up to the scanned offset
+	producers *producerTable
+	txns      *transactions
+	scanned   uint64
+	// serializes the scans of a follower's new records
+	scanMu  sync.Mutex
+	metrics *logMetrics
+	// the most recently appended records; nil when the config disables the cache
+	recordCache *recordCache
+	// closed, and replaced, whenever the log tracks new records, to wake the readers that wait for them
+	appended chan struct{}
+	// set for logs opened with OpenReadOnly, which follow the segments another process writes
+	follow bool
+	// the cache dir of a read-only log that doesn't have one configured, since it can't write to its own dir
+	tmpCacheDir string
+	// set when the last append failed because the disk is full or read-only
+	writeErr error
+	// set once the log is closed, so reads and appends return ErrLogClosed instead of failing on the closed files
+	closed bool
 }
 
 /*
@@ -33,19 +78,55 @@ our slice of segments to be in order from oldest to newest), and then create the
 method, which creates a segment for the base offset you pass in.
 */
 func NewLog(dir string, c Config) (*Log, error) {
+	return openLog(dir, c, false)
+}
+
+// OpenReadOnly opens the log in dir for sidecars and backup jobs that read a log another process is writing.
+// The log maps its indexes PROT_READ, never creates, resizes, or writes files, and refuses
+// Append and Truncate with ErrReadOnly. It doesn't lock the directory, so the writer can keep its
+// exclusive lock, and it picks up the records and segments the writer adds when Read runs past
+// the end of the log or when Refresh is called. The writer buffers its appends, so they only show up once
+// it has flushed them: when it reads, rolls over to a new segment, closes, or calls Flush.
+// Only the config's Encryption and Tier settings matter, for reading encrypted and offloaded segments.
+func OpenReadOnly(dir string, c Config) (*Log, error) {
+	c.ReadOnly = true
+	return openLog(dir, c, true)
+}
+
+func openLog(dir string, c Config, follow bool) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
 	}
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.IndexOffsetWidth == 0 {
+		c.Segment.IndexOffsetWidth = offWidth
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
 
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:         dir,
+		Config:      c,
+		follow:      follow,
+		recordCache: newRecordCache(c),
+		metrics:     newLogMetrics(),
+		appended:    make(chan struct{}),
 	}
 
-	return l, l.setup()
+	if !follow {
+		var err error
+		if l.lockFile, err = lockDir(dir, c.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.setup(); err != nil {
+		_ = unlockDir(l.lockFile)
+		return nil, err
+	}
+	return l, nil
 }
 
 // setup is a helper method that initializes the log from the segments on disk.
@@ -56,93 +137,586 @@ func (l *Log) setup() error {
 		return err
 	}
 
+	// each segment has a store and an index file named after its base offset, e.g. "16.store" and "16.index".
+	// Anything else in the directory, like the cache dir that remote segments are fetched into, key files,
+	// lock files, or temp files, isn't a segment and we skip it.
 	var baseOffsets []uint64
 	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+		if off, ok := segmentBaseOffset(file); ok {
+			baseOffsets = append(baseOffsets, off)
+		}
 	}
 
-	// sort the base offsets in ascending order
-	slices.SortFunc(baseOffsets, func(i, j uint64) int {
-		return int(i - j)
-	})
+	// sort the base offsets in ascending order and drop the duplicates, since both files of a segment share one
+	slices.Sort(baseOffsets)
+	baseOffsets = slices.Compact(baseOffsets)
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err := l.newSegment(baseOffsets[i]); err != nil {
+	for _, off := range baseOffsets {
+		if err := l.newSegment(off); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store files so we skip the dup
-		i++
 	}
 
+	remoteOffsets, err := l.remoteOffsets(baseOffsets)
+	if err != nil {
+		return err
+	}
+	if err := l.setupRemote(remoteOffsets); err != nil {
+		return err
+	}
+
+	if l.segments == nil && l.Config.ReadOnly {
+		return fmt.Errorf("no segments to read in %q", l.Dir)
+	}
 	if l.segments == nil {
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
+	} else if last := l.segments[len(l.segments)-1]; last.remote && !l.Config.ReadOnly {
+		// every segment was offloaded, so start a new active segment after the remote ones
+		if err = l.newSegment(last.nextOffset); err != nil {
+			return err
+		}
 	}
 
 	l.activeSegment = l.segments[len(l.segments)-1]
-	return nil
+	return l.setupState()
+}
+
+// setupState rebuilds the producer table and the transactions from the records in the local segments.
+// Offloaded segments are old enough that their producers and transactions have long moved on, so we don't fetch them.
+func (l *Log) setupState() error {
+	l.producers = newProducerTable(l.Config.Producers.MaxProducers)
+	l.txns = newTransactions(l.Config.Transactions.Timeout)
+	l.scanned = l.activeSegment.nextOffset
+	for _, s := range l.segments {
+		if !s.remote {
+			l.scanned = s.baseOffset
+			break
+		}
+	}
+	if err := l.scan(); err != nil {
+		return err
+	}
+	if l.Config.ReadOnly {
+		return nil
+	}
+	return l.abortOpenTransactions()
+}
+
+// scan feeds the records appended since the last scan to the producer table and the transactions.
+// The writer tracks its own appends as it goes, so it only scans when it starts,
+// but a follower scans the records its writer appended whenever it refreshes.
+func (l *Log) scan() error {
+	l.scanMu.Lock()
+	defer l.scanMu.Unlock()
+
+	it := &Iterator{log: l, scan: true}
+	it.Seek(l.scanned)
+	for it.Next() {
+		l.mu.Lock()
+		l.track(it.Record())
+		l.mu.Unlock()
+	}
+	return it.Err()
+}
+
+// track updates the producer table and the transactions with an appended record.
+// The caller must hold the log's write lock.
+func (l *Log) track(record *api.Record) {
+	if record.Offset < l.scanned {
+		return
+	}
+	l.producers.add(record)
+	l.txns.add(record)
+	l.scanned = record.Offset + 1
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Appended returns a channel that's closed once records are appended after the call or, for a log opened
+// with OpenReadOnly, once a refresh picks them up. Readers that caught up with the log wait on it for more.
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// segmentBaseOffset returns the base offset of the segment the file belongs to,
+// or false if it isn't a segment's store or index file.
+func segmentBaseOffset(file os.DirEntry) (uint64, bool) {
+	if !file.Type().IsRegular() {
+		return 0, false
+	}
+	ext := path.Ext(file.Name())
+	if ext != storeExt && ext != indexExt {
+		return 0, false
+	}
+	off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return off, true
 }
 
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	defer observeSince(l.metrics.appendLatency, time.Now())
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.append(record)
+}
+
+// AppendIf appends the record like Append, but only if the log's next offset is still the expected offset,
+// and returns ErrOffsetConflict otherwise. Event-sourced stores use it for optimistic concurrency:
+// they read up to the end of the log, decide what to append, and retry if someone appended in the meantime.
+// An idempotent producer's retry of a conditional append returns the record's original offset
+// even though the log has moved on.
+func (l *Log) AppendIf(record *api.Record, expected uint64) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	defer observeSince(l.metrics.appendLatency, time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off, retry, err := l.producers.check(record); err == nil && retry {
+		record.Offset = off
+		return off, nil
+	}
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	// expiring transactions appends their abort markers, which moves the next offset,
+	// so expire them before the check rather than in append, after it
+	if err := l.expireTransactions(); err != nil {
+		return 0, err
+	}
+	if next := l.segments[len(l.segments)-1].nextOffset; next != expected {
+		return 0, api.ErrOffsetConflict{Expected: expected, Actual: next}
+	}
+	return l.append(record)
+}
 
+// append appends the record to the active segment, unless it's an idempotent producer's retry
+// of a record that's already in the log, in which case it returns the record's original offset.
+// Records can't be transaction markers, which only appendMarker writes.
+func (l *Log) append(record *api.Record) (uint64, error) {
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	if record.Control != api.ControlType_CONTROL_NONE {
+		return 0, api.ErrControlRecord{Control: record.Control}
+	}
+	if err := l.expireTransactions(); err != nil {
+		return 0, err
+	}
+	if err := l.txns.check(record); err != nil {
+		return 0, err
+	}
+	return l.write(record)
+}
+
+// write appends the record to the active segment without checking it against the log's transactions.
+// The caller must hold the log's write lock.
+func (l *Log) write(record *api.Record) (uint64, error) {
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	if off, retry, err := l.producers.check(record); err != nil || retry {
+		record.Offset = off
+		return off, err
+	}
+	stamp(record)
+	size := l.activeSegment.store.size
 	off, err := l.activeSegment.Append(record)
-	if err != nil {
+	if err := l.noteWriteErr(err); err != nil {
 		return 0, err
 	}
+	l.metrics.appends.Inc()
+	l.metrics.bytesWritten.Add(float64(l.activeSegment.store.size - size))
+	l.track(record)
+	l.recordCache.add(record)
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
 	return off, err
 }
 
+// stamp sets the record's timestamp to the append time, unless the producer set it.
+func stamp(record *api.Record) {
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixMilli()
+	}
+}
+
+// AppendBatch appends the records as a single batch, compressed with Config.Compression if it's set,
+// and returns the offset of the first record. The batch is one store frame, so either all of its records
+// are appended or none are. A batch of an idempotent producer is deduplicated as a whole: if its first record
+// is a retry, none of its records are appended again. A batch with more records than a segment holds
+// fails with api.ErrBatchTooLarge.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, errors.New("empty batch")
+	}
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	defer observeSince(l.metrics.appendLatency, time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	if err := l.expireTransactions(); err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		if record.Control != api.ControlType_CONTROL_NONE {
+			return 0, api.ErrControlRecord{Control: record.Control}
+		}
+		if err := l.txns.check(record); err != nil {
+			return 0, err
+		}
+	}
+	if off, retry, err := l.producers.checkBatch(records); err != nil || retry {
+		return off, err
+	}
+	for _, record := range records {
+		stamp(record)
+	}
+	size := l.activeSegment.store.size
+	first, err := l.activeSegment.AppendBatch(records, l.Config.Compression)
+	if err == io.EOF && l.activeSegment.nextOffset != l.activeSegment.baseOffset {
+		// the batch doesn't fit in what's left of the active segment's index, so start a new segment for it
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return 0, err
+		}
+		size = 0
+		first, err = l.activeSegment.AppendBatch(records, l.Config.Compression)
+	}
+	if err == io.EOF {
+		// not even a new segment's index has room for the batch
+		return 0, api.ErrBatchTooLarge{Records: uint64(len(records)), MaxRecords: l.activeSegment.index.capacity()}
+	}
+	if err := l.noteWriteErr(err); err != nil {
+		return 0, err
+	}
+	l.metrics.appends.Add(float64(len(records)))
+	l.metrics.bytesWritten.Add(float64(l.activeSegment.store.size - size))
+	for _, record := range records {
+		l.track(record)
+		l.recordCache.add(record)
+	}
+	if l.activeSegment.IsMaxed() {
+		err = l.newSegment(l.activeSegment.nextOffset)
+	}
+	return first, err
+}
+
+// Read returns the record at the given offset. A log opened with OpenReadOnly
+// refreshes itself to look for the record when the offset is past the end of the log.
+// Records served from the record cache are shared with other readers, so callers mustn't modify them.
 func (l *Log) Read(offset uint64) (*api.Record, error) {
+	defer observeSince(l.metrics.readLatency, time.Now())
+	record, err := l.read(offset)
+	if _, ok := err.(api.ErrOffsetAboveHighest); ok && l.follow {
+		if err := l.Refresh(); err != nil {
+			return nil, err
+		}
+		return l.read(offset)
+	}
+	return record, err
+}
+
+func (l *Log) read(offset uint64) (*api.Record, error) {
+	if record, ok := l.recordCache.get(offset); ok {
+		l.metrics.reads.Inc()
+		return record, nil
+	}
+
 	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return nil, api.ErrLogClosed{}
+	}
+	s := l.segmentFor(offset)
+	if s == nil {
+		defer l.mu.RUnlock()
+		return nil, l.outOfRange(offset)
+	}
+	l.metrics.reads.Inc()
+	if s.remote {
+		// fetching the segment may download it, which appends mustn't wait for
+		l.mu.RUnlock()
+		return l.readRemote(s, offset)
+	}
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= offset && offset < segment.nextOffset {
-			s = segment
-			break
+
+	record, err := s.Read(offset)
+	if errors.Is(err, io.EOF) && l.follow {
+		// the writer indexed the record but hasn't flushed it to the store yet
+		return nil, l.outOfRange(offset)
+	}
+	if err != nil {
+		return nil, readError(s, offset, err)
+	}
+	return record, nil
+}
+
+// outOfRange returns the error for reading an offset that isn't in the log. The caller must hold the log's lock.
+func (l *Log) outOfRange(offset uint64) error {
+	lowest, next := l.segments[0].baseOffset, l.segments[len(l.segments)-1].nextOffset
+	if offset < lowest {
+		return api.ErrOffsetBelowLowest{Offset: offset, Lowest: lowest, HighWatermark: next}
+	}
+	return api.ErrOffsetAboveHighest{Offset: offset, Lowest: lowest, HighWatermark: next}
+}
+
+// readError translates the error of reading a record the segment should have.
+// Since the offset is in the segment's range, failing to find or decode the record means the segment is corrupt.
+func readError(s *segment, offset uint64, err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return api.ErrLogClosed{}
+	}
+	return api.ErrSegmentCorrupt{BaseOffset: s.baseOffset, Offset: offset, Cause: err}
+}
+
+// segmentFor returns the segment holding the given offset, or nil if the offset is out of the log's range.
+// The segments are sorted by base offset, so we binary search for the last one starting at or before the offset,
+// which keeps reads fast for logs with lots of short segments.
+// The caller must hold the log's lock.
+func (l *Log) segmentFor(offset uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	})
+	if i == 0 {
+		return nil
+	}
+	if s := l.segments[i-1]; offset < s.nextOffset {
+		return s
+	}
+	return nil
+}
+
+// Flush writes the records buffered in the active segment's store to its file,
+// so logs opened with OpenReadOnly in other processes can read them.
+func (l *Log) Flush() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.activeSegment.remote {
+		return nil
+	}
+	return l.activeSegment.store.flush()
+}
+
+// Refresh brings a log opened with OpenReadOnly up to date with the process writing it:
+// it picks up the records appended to its segments, opens the segments created since,
+// and lets go of the segments that were truncated or offloaded to the tier's object store.
+// It's a no-op for other logs.
+func (l *Log) Refresh() error {
+	if !l.follow {
+		return nil
+	}
+	if err := l.refreshSegments(); err != nil {
+		return err
+	}
+	return l.scan()
+}
+
+func (l *Log) refreshSegments() error {
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	// a segment only counts once both its files exist, since the writer creates the store before the index
+	found := make(map[uint64]int)
+	for _, file := range files {
+		if off, ok := segmentBaseOffset(file); ok {
+			found[off]++
 		}
 	}
-	if s == nil || s.nextOffset <= offset {
-		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	var remote []uint64
+	if l.Config.Tier.Store != nil {
+		if remote, err = l.remoteOffsets(nil); err != nil {
+			return err
+		}
 	}
 
-	return s.Read(offset)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var segments []*segment
+	for _, s := range l.segments {
+		switch {
+		case s.remote && !slices.Contains(remote, s.baseOffset):
+			// the writer truncated the offloaded segment
+			continue
+		case s.remote:
+		case found[s.baseOffset] == 0:
+			// the writer truncated or offloaded the segment; files it had open stay readable
+			// until we close them, but we can't tell which
+			if err := s.Close(); err != nil {
+				return err
+			}
+			if !slices.Contains(remote, s.baseOffset) {
+				continue
+			}
+			s = &segment{baseOffset: s.baseOffset, nextOffset: s.nextOffset, config: l.Config, remote: true}
+		default:
+			if err := s.refresh(); err != nil {
+				return err
+			}
+		}
+		segments = append(segments, s)
+	}
+
+	var newOffsets []uint64
+	for off, n := range found {
+		if n == 2 && (len(segments) == 0 || off > segments[len(segments)-1].baseOffset) {
+			newOffsets = append(newOffsets, off)
+		}
+	}
+	slices.Sort(newOffsets)
+	l.segments = segments
+	if len(segments) > 0 {
+		l.activeSegment = segments[len(segments)-1]
+	}
+	for _, off := range newOffsets {
+		if err := l.newSegment(off); err != nil {
+			return err
+		}
+	}
+	if len(l.segments) == 0 {
+		return fmt.Errorf("no segments to read in %q", l.Dir)
+	}
+
+	// a segment that went remote since we last looked may have gotten records we hadn't seen yet
+	for i, s := range l.segments[:len(l.segments)-1] {
+		if s.remote {
+			s.nextOffset = l.segments[i+1].baseOffset
+		}
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	return nil
 }
 
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.close(); err != nil {
+		return err
+	}
+	err := unlockDir(l.lockFile)
+	l.lockFile = nil
+	return err
+}
+
+// close closes the local segments and the cached copies of the remote ones.
+// The caller must hold the log's write lock.
+func (l *Log) close() error {
+	l.closed = true
 	for _, segment := range l.segments {
+		if segment.remote {
+			continue
+		}
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return l.closeCache()
 }
 
+// Remove closes the log and deletes its segments, including the ones offloaded to the tier's object store.
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
+	for _, s := range l.segments {
+		if !s.remote {
+			continue
+		}
+		if err := l.removeRemote(s); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.recordCache.reset()
 	return os.RemoveAll(l.Dir)
 }
 
+// Reset deletes the log's segments, including the ones offloaded to the tier's object store,
+// and starts the log over with an empty active segment at Config.Segment.InitialOffset.
+// The log keeps its directory locked throughout, so no other process can open it in the meantime.
+// If Reset fails, the log stays closed.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.close(); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if !s.remote {
+			continue
+		}
+		if err := l.removeRemote(s); err != nil {
+			return err
+		}
+	}
+	l.segments, l.activeSegment = nil, nil
+	l.recordCache.reset()
+	if err := l.removeContents(); err != nil {
 		return err
 	}
-	return l.setup()
+
+	l.cacheMu.Lock()
+	l.cacheClosed = false
+	l.cacheMu.Unlock()
+	l.producers = newProducerTable(l.Config.Producers.MaxProducers)
+	l.txns = newTransactions(l.Config.Transactions.Timeout)
+	l.scanned = l.Config.Segment.InitialOffset
+	l.writeErr = nil
+	if err := l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+		return err
+	}
+	l.closed = false
+	return nil
+}
+
+// removeContents deletes everything in the log's directory but the lock file, which the log holds on to.
+func (l *Log) removeContents() error {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == lockFileName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(l.Dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (l *Log) newSegment(offset uint64) error {
+	if a := l.activeSegment; a != nil && !a.remote {
+		// nothing is appended to the old active segment anymore, so we flush it
+		// and serve its reads from a read-only mapping of its store
+		if err := a.store.mapReadOnly(); err != nil {
+			return err
+		}
+	}
 	s, err := newSegment(l.Dir, offset, l.Config)
 	if err != nil {
 		return err
@@ -169,16 +743,32 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
-// Truncate removes all segments whose highest offset is lower than lowest.
+// NextOffset returns the offset the next appended record gets, the log's high watermark.
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[len(l.segments)-1].nextOffset
+}
+
+// Truncate removes all segments whose highest offset is lower than lowest, except the active segment,
+// which the log needs to append to and to know its next offset.
 // Because we don't have disks with infinite space, we'll periodically call Truncate()
 // to remove old segments and free up space.
 func (l *Log) Truncate(lowest uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest {
-			if err := s.Remove(); err != nil {
+		if s != l.activeSegment && s.nextOffset <= lowest {
+			remove := s.Remove
+			if s.remote {
+				remove = func() error { return l.removeRemote(s) }
+			}
+			if err := remove(); err != nil {
 				return err
 			}
 			continue
@@ -188,34 +778,78 @@ func (l *Log) Truncate(lowest uint64) error {
 
 	l.segments = segments
 	l.activeSegment = l.segments[len(l.segments)-1]
+	l.recordCache.truncate(l.segments[0].baseOffset)
+	l.txns.truncate(l.segments[0].baseOffset)
 	return nil
 }
 
+// CacheStats returns the record cache's hit and miss counters and its size.
+func (l *Log) CacheStats() CacheStats {
+	return l.recordCache.stats()
+}
+
 // Reader returns an io.Reader to read the whole log.
+// Segments that are offloaded while it reads them are read from their remote copy, and segments
+// that are truncated fail the read with api.ErrOffsetBelowLowest.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &segmentReader{log: l, segment: segment}
 	}
-
 	return io.MultiReader(readers...)
 }
 
-// originReader is a wrapper around a store that implements the io.Reader interface.
-// It reads from the store at the current offset and increments the offset after each read.
-type originReader struct {
-	*store
-	offset int64
+// segmentReader reads a segment's store as it's stored, from the current offset.
+// Offloading swaps the segment's store for a remote one and truncating closes it,
+// so we look at the segment under the log's read lock.
+type segmentReader struct {
+	log     *Log
+	segment *segment
+	offset  int64
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.offset)
-	o.offset += int64(n)
+func (r *segmentReader) Read(p []byte) (int, error) {
+	r.log.mu.RLock()
+	if r.segment.remote {
+		// fetching the segment may download it, which appends mustn't wait for
+		r.log.mu.RUnlock()
+		n, err := r.readRemote(p)
+		if err != nil && err != io.EOF {
+			err = r.log.remoteError(r.segment, r.segment.baseOffset, err)
+		}
+		return n, err
+	}
+	defer r.log.mu.RUnlock()
+	if r.log.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	if !r.log.contains(r.segment) {
+		return 0, r.log.outOfRange(r.segment.baseOffset)
+	}
+	n, err := r.segment.store.ReadAt(p, r.offset)
+	r.offset += int64(n)
 	return n, err
 }
 
-func (o *originReader) Close() error {
-	return nil
+// readRemote reads the remote segment's store from its cached copy, fetching it on first use.
+func (r *segmentReader) readRemote(p []byte) (int, error) {
+	cached, err := r.log.pin(r.segment)
+	if err != nil {
+		return 0, err
+	}
+	defer r.log.unpin(cached)
+	n, err := cached.store.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+// contains reports whether the segment is still one of the log's, rather than truncated or reset.
+// The caller must hold the log's lock.
+func (l *Log) contains(s *segment) bool {
+	i, ok := slices.BinarySearchFunc(l.segments, s.baseOffset, func(s *segment, off uint64) int {
+		return cmp.Compare(s.baseOffset, off)
+	})
+	return ok && l.segments[i] == s
 }
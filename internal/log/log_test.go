@@ -1,8 +1,13 @@
 package log
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -16,7 +21,13 @@ func TestLog(t *testing.T) {
 	){
 		"append and read a record succeeds": testAppendRead,
 		"offset out of range error":         testOutOfRangeErr,
+		"corrupt segment error":             testCorruptSegmentErr,
+		"closed log error":                  testClosedErr,
 		"init with existing segments":       testInitExisting,
+		"init skips stray files":            testInitStrayFiles,
+		"closed segments are mapped":        testClosedSegmentsMapped,
+		"conditional append":                testAppendIf,
+		"appends wake waiting readers":      testAppended,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
 	} {
@@ -49,8 +60,51 @@ func testAppendRead(t *testing.T, log *Log) {
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
-	apiErr := err.(api.ErrOffsetOutOfRange)
+	apiErr := err.(api.ErrOffsetAboveHighest)
 	require.Equal(t, uint64(1), apiErr.Offset)
+	require.Equal(t, uint64(0), apiErr.HighWatermark)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(2))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetBelowLowest{Offset: 0, Lowest: 2, HighWatermark: 3}, err)
+}
+
+func testCorruptSegmentErr(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// overwrite the record's bytes with garbage that doesn't unmarshal
+	s := log.activeSegment
+	require.NoError(t, s.store.flush())
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 8), lenWidth)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.Read(0)
+	var corrupt api.ErrSegmentCorrupt
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, s.baseOffset, corrupt.BaseOffset)
+	require.Equal(t, uint64(0), corrupt.Offset)
+}
+
+func testClosedErr(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrLogClosed{}, err)
 }
 
 func testInitExisting(t *testing.T, o *Log) {
@@ -82,6 +136,97 @@ func testInitExisting(t *testing.T, o *Log) {
 	require.Equal(t, uint64(2), off)
 }
 
+func testInitStrayFiles(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+	segments := len(o.segments)
+
+	for _, name := range []string{"LOCK", "0.store.tmp", "notes.txt", "x.index"} {
+		require.NoError(t, os.WriteFile(path.Join(o.Dir, name), []byte("stray"), 0644))
+	}
+	require.NoError(t, os.Mkdir(path.Join(o.Dir, "1.store"), 0755))
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Len(t, n.segments, segments)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testClosedSegmentsMapped(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: write})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	check := func(log *Log) {
+		t.Helper()
+		for _, s := range log.segments[:len(log.segments)-1] {
+			require.NotNil(t, s.store.mmap)
+		}
+		require.Nil(t, log.activeSegment.store.mmap)
+		for off := uint64(0); off < 5; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, write, read.Value)
+		}
+	}
+	check(log)
+
+	// the closed segments of a reopened log are mapped too
+	require.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+}
+
+func testAppended(t *testing.T, log *Log) {
+	appended := log.Appended()
+	select {
+	case <-appended:
+		t.Fatal("closed before an append")
+	default:
+	}
+	_, err := log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	<-appended
+	require.NotEqual(t, appended, log.Appended())
+}
+
+func testAppendIf(t *testing.T, log *Log) {
+	off, err := log.AppendIf(&api.Record{Value: write}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = log.AppendIf(&api.Record{Value: write}, 0)
+	require.Equal(t, api.ErrOffsetConflict{Expected: 0, Actual: 1}, err)
+	_, err = log.AppendIf(&api.Record{Value: write}, 2)
+	require.Equal(t, api.ErrOffsetConflict{Expected: 2, Actual: 1}, err)
+
+	// an idempotent producer's retry gets its original offset back
+	id, err := log.InitProducer()
+	require.NoError(t, err)
+	off, err = log.AppendIf(&api.Record{Value: write, ProducerId: id}, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = log.AppendIf(&api.Record{Value: write, ProducerId: id}, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), highest)
+}
+
 func testReader(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -115,4 +260,464 @@ func testTruncate(t *testing.T, log *Log) {
 
 	_, err = log.Read(0)
 	require.NoError(t, err)
+
+	// the active segment stays even when all its records are below lowest, so the log keeps its next offset
+	require.NoError(t, log.Truncate(100))
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+// BenchmarkLogRead reads a record from logs with a growing number of segments,
+// finding its segment with the log's binary search and, as a baseline, with a linear scan.
+// The record is in the last segment, the worst case for the scan. The segments before it are remote
+// stand-ins without files, so the log can have more segments than the process can open.
+func BenchmarkLogRead(b *testing.B) {
+	for _, segments := range []int{1, 10, 100, 1000, 10000, 50000} {
+		c := Config{}
+		c.Segment.InitialOffset = uint64(segments - 1)
+		log, err := NewLog(b.TempDir(), c)
+		require.NoError(b, err)
+		off, err := log.Append(&api.Record{Value: write})
+		require.NoError(b, err)
+		standIns := make([]*segment, 0, segments)
+		for i := 0; i < segments-1; i++ {
+			standIns = append(standIns, &segment{baseOffset: uint64(i), nextOffset: uint64(i + 1), remote: true})
+		}
+		log.segments = append(standIns, log.segments...)
+
+		b.Run(fmt.Sprintf("segments=%d/binary", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(off); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("segments=%d/linear", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := linearRead(log, off); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		require.NoError(b, log.Close())
+	}
+}
+
+// linearRead reads the record like Log.Read, but finds its segment by scanning the segments in order.
+func linearRead(l *Log, offset uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.baseOffset <= offset && offset < s.nextOffset {
+			return s.Read(offset)
+		}
+	}
+	return nil, l.outOfRange(offset)
+}
+
+func TestNewLogValidatesConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	c := Config{}
+	c.Segment.IndexOffsetWidth = 2
+	_, err := NewLog(dir, c)
+	require.Error(t, err)
+
+	c = Config{}
+	c.Segment.MaxIndexBytes = indexHeaderLen + entWidth - 1
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+
+	// 4 byte offsets can't address every entry of a huge index
+	c = Config{}
+	c.Segment.MaxIndexBytes = indexHeaderLen + entWidth*(math.MaxUint32+2)
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+	c.Segment.IndexOffsetWidth = 8
+	require.NoError(t, c.validate())
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := OpenReadOnly(dir, Config{})
+	require.Error(t, err)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer writer.Close()
+	_, err = writer.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	require.NoError(t, writer.Flush())
+
+	// the writer holds its lock, and opening the log read-only leaves its files as they are
+	before := dirSnapshot(t, dir)
+	reader, err := OpenReadOnly(dir, Config{})
+	require.NoError(t, err)
+	read, err := reader.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read.Value)
+	_, err = reader.Append(&api.Record{Value: write})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, reader.Truncate(1))
+	require.NoError(t, reader.Close())
+	require.Equal(t, before, dirSnapshot(t, dir))
+
+	reader, err = OpenReadOnly(dir, Config{})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	// reads past the end of the log pick up the records and segments the writer appended since
+	for range 4 {
+		_, err = writer.Append(&api.Record{Value: write})
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Flush())
+	require.Greater(t, len(writer.segments), 1)
+	read, err = reader.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), read.Offset)
+	_, err = reader.Read(5)
+	require.IsType(t, api.ErrOffsetAboveHighest{}, err)
+
+	// refreshing lets go of the segments the writer truncated
+	require.NoError(t, writer.Truncate(2))
+	require.NoError(t, reader.Refresh())
+	lowest, err := reader.LowestOffset()
+	require.NoError(t, err)
+	writerLowest, err := writer.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, writerLowest, lowest)
+	highest, err := reader.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+}
+
+// dirSnapshot returns the size and modification time of every file in dir.
+func dirSnapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	snapshot := make(map[string]string)
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		snapshot[entry.Name()] = fmt.Sprintf("%d %s", fi.Size(), fi.ModTime())
+	}
+	return snapshot
+}
+
+func TestLogTieredStorage(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	objects := newFakeObjectStore()
+	c := Config{}
+	// one record per segment
+	c.Segment.MaxStoreBytes = lenWidth
+	c.Tier.Store = objects
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	// every closed segment gets offloaded, but the active one stays local
+	require.NoError(t, log.Offload())
+	require.Len(t, objects.objects, 6)
+	for _, s := range log.segments[:3] {
+		require.True(t, s.remote)
+	}
+	require.False(t, log.activeSegment.remote)
+	_, err = os.Stat(path.Join(dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+
+	// reading an old offset fetches its segment back into the cache
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, read.Value)
+		require.Equal(t, off, read.Offset)
+	}
+
+	// the log rebuilds the remote segments from the object store on restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 4)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+
+	// the reader streams the remote segments too
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		size := enc.Uint64(b[:lenWidth])
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], read))
+		require.Equal(t, off, read.Offset)
+		b = b[lenWidth+size:]
+	}
+	require.Empty(t, b)
+
+	// truncating removes the remote segment's objects
+	require.NoError(t, log.Truncate(1))
+	require.Len(t, objects.objects, 4)
+	require.NoError(t, log.Remove())
+	require.Len(t, objects.objects, 0)
+}
+
+// TestTieredStorageDoesntBlockAppends holds the object store's uploads and downloads up,
+// like a slow network would, and checks that the log keeps appending and reading local segments meanwhile.
+func TestTieredStorageDoesntBlockAppends(t *testing.T) {
+	objects := &blockingObjectStore{fakeObjectStore: newFakeObjectStore(), called: make(chan struct{}), release: make(chan struct{})}
+	c := Config{}
+	c.Segment.MaxStoreBytes = lenWidth
+	c.Tier.Store = objects
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	appendAndRead := func() {
+		t.Helper()
+		off, err := log.Append(record)
+		require.NoError(t, err)
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+
+	offloaded := make(chan error)
+	go func() { offloaded <- log.Offload() }()
+	<-objects.called
+	appendAndRead()
+	objects.block(false)
+	objects.release <- struct{}{}
+	require.NoError(t, <-offloaded)
+	require.True(t, log.segments[0].remote)
+
+	objects.block(true)
+	fetched := make(chan error)
+	go func() {
+		_, err := log.Read(0)
+		fetched <- err
+	}()
+	<-objects.called
+	appendAndRead()
+	objects.block(false)
+	objects.release <- struct{}{}
+	require.NoError(t, <-fetched)
+}
+
+// TestTruncateDuringRemoteRead truncates a remote segment while a read is fetching it,
+// which fails the read with the same out of range error as reading a truncated local segment.
+func TestTruncateDuringRemoteRead(t *testing.T) {
+	objects := &blockingObjectStore{fakeObjectStore: newFakeObjectStore(), called: make(chan struct{}), release: make(chan struct{})}
+	objects.block(false)
+	c := Config{}
+	c.Segment.MaxStoreBytes = lenWidth
+	c.Tier.Store = objects
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload())
+	require.True(t, log.segments[0].remote)
+
+	objects.block(true)
+	read := make(chan error)
+	go func() {
+		_, err := log.Read(0)
+		read <- err
+	}()
+	<-objects.called
+	require.NoError(t, log.Truncate(1))
+	objects.block(false)
+	objects.release <- struct{}{}
+	require.Equal(t, api.ErrOffsetBelowLowest{Offset: 0, Lowest: 1, HighWatermark: 3}, <-read)
+}
+
+// TestReaderDuringOffloadAndTruncate offloads and truncates the segments that snapshot readers are reading.
+func TestReaderDuringOffloadAndTruncate(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = lenWidth
+	c.Tier.Store = newFakeObjectStore()
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// truncating a segment the readers have started on fails their next read
+	reader, plaintext := log.Reader(), log.PlaintextReader()
+	head := make([]byte, lenWidth)
+	_, err = io.ReadFull(reader, head)
+	require.NoError(t, err)
+	_, err = io.ReadFull(plaintext, head)
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(1))
+	truncated := api.ErrOffsetBelowLowest{Offset: 0, Lowest: 1, HighWatermark: 3}
+	_, err = io.ReadAll(reader)
+	require.Equal(t, truncated, err)
+	_, err = io.ReadAll(plaintext)
+	require.Equal(t, truncated, err)
+
+	// offloading a segment a reader has started on switches the reader over to the remote copy
+	want, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	reader = log.Reader()
+	_, err = io.ReadFull(reader, head)
+	require.NoError(t, err)
+	require.NoError(t, log.Offload())
+	require.True(t, log.segments[0].remote)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, append(head, rest...))
+}
+
+// TestEvictPinnedCopy evicts the cached copy of a remote segment while it's being read.
+func TestEvictPinnedCopy(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = lenWidth
+	c.Tier.Store = newFakeObjectStore()
+	c.Tier.MaxCachedSegments = 1
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload())
+
+	pinned, err := log.pin(log.segments[0])
+	require.NoError(t, err)
+	// reading the other segment evicts the pinned copy from the cache, but the copy stays readable
+	_, err = log.Read(1)
+	require.NoError(t, err)
+	require.NotContains(t, log.cached, uint64(0))
+	read, err := pinned.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	// and it's put back in the cache rather than downloaded again
+	again, err := log.pin(log.segments[0])
+	require.NoError(t, err)
+	require.Same(t, pinned, again)
+	require.NoError(t, log.unpin(again))
+	require.NoError(t, log.unpin(pinned))
+
+	// a copy evicted once its readers are done is removed
+	name := pinned.store.Name()
+	_, err = log.Read(1)
+	require.NoError(t, err)
+	_, err = os.Stat(name)
+	require.True(t, os.IsNotExist(err))
+}
+
+// blockingObjectStore holds Put and Get up until the test releases them, while blocking is on, which it is to start with.
+type blockingObjectStore struct {
+	*fakeObjectStore
+	called  chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	unblocked bool
+}
+
+func (b *blockingObjectStore) block(on bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unblocked = !on
+}
+
+func (b *blockingObjectStore) wait() {
+	b.mu.Lock()
+	unblocked := b.unblocked
+	b.mu.Unlock()
+	if unblocked {
+		return
+	}
+	b.called <- struct{}{}
+	<-b.release
+}
+
+func (b *blockingObjectStore) Put(key string, r io.Reader) error {
+	b.wait()
+	return b.fakeObjectStore.Put(key, r)
+}
+
+func (b *blockingObjectStore) Get(key string) (io.ReadCloser, error) {
+	b.wait()
+	return b.fakeObjectStore.Get(key)
+}
+
+// fakeObjectStore is an in-memory ObjectStore that stands in for a remote bucket.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string][]byte)}
+}
+
+func (f *fakeObjectStore) Put(key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = b
+	return nil
+}
+
+func (f *fakeObjectStore) Get(key string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (f *fakeObjectStore) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, key)
+	return nil
+}
+
+func (f *fakeObjectStore) List() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	return keys, nil
 }
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+The log is a Prometheus collector, so whoever runs the log can register it with their registry.
+Appends and reads count themselves and time themselves as they go, while the gauges that describe
+the log's shape, like its offsets and segment count, are read from the log when it's scraped.
+*/
+
+var _ prometheus.Collector = (*Log)(nil)
+
+type logMetrics struct {
+	appends       prometheus.Counter
+	reads         prometheus.Counter
+	bytesWritten  prometheus.Counter
+	appendLatency prometheus.Histogram
+	readLatency   prometheus.Histogram
+
+	segments          *prometheus.Desc
+	lowestOffset      *prometheus.Desc
+	highestOffset     *prometheus.Desc
+	activeStoreFill   *prometheus.Desc
+	activeIndexFill   *prometheus.Desc
+	recordCacheHits   *prometheus.Desc
+	recordCacheMisses *prometheus.Desc
+}
+
+func newLogMetrics() *logMetrics {
+	// latencies from 10µs to ~160ms
+	buckets := prometheus.ExponentialBuckets(0.00001, 2, 15)
+	return &logMetrics{
+		appends: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_log_appends_total",
+			Help: "The number of records appended to the log.",
+		}),
+		reads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_log_reads_total",
+			Help: "The number of records read from the log.",
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_log_written_bytes_total",
+			Help: "The number of bytes appended to the log's stores.",
+		}),
+		appendLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_log_append_duration_seconds",
+			Help:    "How long appending to the log takes.",
+			Buckets: buckets,
+		}),
+		readLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_log_read_duration_seconds",
+			Help:    "How long reading a record from the log takes.",
+			Buckets: buckets,
+		}),
+		segments: prometheus.NewDesc(
+			"proglog_log_segments",
+			"The number of segments in the log, including the ones offloaded to the tier's object store.",
+			nil, nil,
+		),
+		lowestOffset: prometheus.NewDesc(
+			"proglog_log_lowest_offset",
+			"The log's lowest offset.",
+			nil, nil,
+		),
+		highestOffset: prometheus.NewDesc(
+			"proglog_log_highest_offset",
+			"The log's highest offset.",
+			nil, nil,
+		),
+		activeStoreFill: prometheus.NewDesc(
+			"proglog_log_active_segment_store_fill_ratio",
+			"How full the active segment's store is, relative to MaxStoreBytes.",
+			nil, nil,
+		),
+		activeIndexFill: prometheus.NewDesc(
+			"proglog_log_active_segment_index_fill_ratio",
+			"How full the active segment's index is, relative to MaxIndexBytes.",
+			nil, nil,
+		),
+		recordCacheHits: prometheus.NewDesc(
+			"proglog_log_record_cache_hits_total",
+			"The number of reads served from the record cache.",
+			nil, nil,
+		),
+		recordCacheMisses: prometheus.NewDesc(
+			"proglog_log_record_cache_misses_total",
+			"The number of reads the record cache couldn't serve.",
+			nil, nil,
+		),
+	}
+}
+
+// observeSince observes how long an operation that started at the given time took.
+func observeSince(h prometheus.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (l *Log) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(l, ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *Log) Collect(ch chan<- prometheus.Metric) {
+	m := l.metrics
+	ch <- m.appends
+	ch <- m.reads
+	ch <- m.bytesWritten
+	ch <- m.appendLatency
+	ch <- m.readLatency
+
+	l.mu.RLock()
+	if len(l.segments) == 0 {
+		// the log was removed
+		l.mu.RUnlock()
+		return
+	}
+	segments := len(l.segments)
+	lowest := l.segments[0].baseOffset
+	next := l.segments[len(l.segments)-1].nextOffset
+	var storeFill, indexFill float64
+	if s := l.activeSegment; !s.remote {
+		// the same inputs IsMaxed looks at
+		storeFill = float64(s.store.size) / float64(s.config.Segment.MaxStoreBytes)
+		indexFill = float64(s.index.size) / float64(s.config.Segment.MaxIndexBytes)
+	}
+	l.mu.RUnlock()
+
+	var highest uint64
+	if next > 0 {
+		highest = next - 1
+	}
+	ch <- prometheus.MustNewConstMetric(m.segments, prometheus.GaugeValue, float64(segments))
+	ch <- prometheus.MustNewConstMetric(m.lowestOffset, prometheus.GaugeValue, float64(lowest))
+	ch <- prometheus.MustNewConstMetric(m.highestOffset, prometheus.GaugeValue, float64(highest))
+	ch <- prometheus.MustNewConstMetric(m.activeStoreFill, prometheus.GaugeValue, storeFill)
+	ch <- prometheus.MustNewConstMetric(m.activeIndexFill, prometheus.GaugeValue, indexFill)
+
+	stats := l.CacheStats()
+	ch <- prometheus.MustNewConstMetric(m.recordCacheHits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(m.recordCacheMisses, prometheus.CounterValue, float64(stats.Misses))
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMetrics(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.MaxIndexBytes = 1024
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(log))
+
+	appendRecords(t, log, 10)
+	for off := uint64(0); off < 3; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+	it := log.Iterator()
+	require.True(t, it.Next())
+
+	var written uint64
+	for _, s := range log.segments {
+		written += s.store.size
+	}
+	metrics := gather(t, reg)
+	require.Equal(t, 10.0, metrics["proglog_log_appends_total"])
+	require.Equal(t, 4.0, metrics["proglog_log_reads_total"])
+	require.Equal(t, float64(written), metrics["proglog_log_written_bytes_total"])
+	require.Equal(t, 10.0, metrics["proglog_log_append_duration_seconds"])
+	require.Equal(t, 3.0, metrics["proglog_log_read_duration_seconds"])
+
+	require.NoError(t, log.Truncate(5))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+
+	metrics = gather(t, reg)
+	require.Equal(t, float64(lowest), metrics["proglog_log_lowest_offset"])
+	require.Equal(t, 9.0, metrics["proglog_log_highest_offset"])
+	require.Equal(t, float64(len(log.segments)), metrics["proglog_log_segments"])
+	require.Equal(t,
+		float64(log.activeSegment.store.size)/float64(c.Segment.MaxStoreBytes),
+		metrics["proglog_log_active_segment_store_fill_ratio"],
+	)
+	require.Equal(t,
+		float64(log.activeSegment.index.size)/float64(c.Segment.MaxIndexBytes),
+		metrics["proglog_log_active_segment_index_fill_ratio"],
+	)
+
+	problems, err := testutil.GatherAndLint(reg)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+// gather returns the values of the registry's unlabelled metrics by name,
+// and the sample counts of its histograms.
+func gather(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		switch {
+		case m.Counter != nil:
+			values[f.GetName()] = m.Counter.GetValue()
+		case m.Gauge != nil:
+			values[f.GetName()] = m.Gauge.GetValue()
+		case m.Histogram != nil:
+			values[f.GetName()] = float64(m.Histogram.GetSampleCount())
+		}
+	}
+	return values
+}
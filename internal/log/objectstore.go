@@ -0,0 +1,101 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore is the secondary storage tier that the log offloads closed segments to.
+// Objects are keyed by the name of the segment file they hold, e.g. "16.store" and "16.index",
+// so each log needs its own store (or its own bucket prefix).
+// The first implementation is DirObjectStore, which keeps the objects on another local mount,
+// but the interface is small enough to be backed by an S3-compatible bucket.
+type ObjectStore interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	Put(key string, r io.Reader) error
+	// Get returns a reader for the object stored under key,
+	// or an error wrapping ErrObjectNotFound if there's no object under key.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key.
+	Delete(key string) error
+	// List returns the keys of all the objects in the store.
+	List() ([]string, error)
+}
+
+// ErrObjectNotFound is the error ObjectStore.Get wraps when there's no object under the key,
+// like the key file of a segment that isn't encrypted.
+var ErrObjectNotFound = errors.New("object not found")
+
+// tmpExt is the extension of the files DirObjectStore writes to before renaming them into place,
+// so a crash mid-upload never leaves a partial object behind.
+const tmpExt = ".tmp"
+
+// DirObjectStore is an ObjectStore that keeps objects as files in a directory,
+// typically on a bigger and slower mount than the log's data dir.
+type DirObjectStore struct {
+	Dir string
+}
+
+var _ ObjectStore = (*DirObjectStore)(nil)
+
+func NewDirObjectStore(dir string) (*DirObjectStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirObjectStore{Dir: dir}, nil
+}
+
+func (d *DirObjectStore) Put(key string, r io.Reader) error {
+	name := filepath.Join(d.Dir, key)
+	f, err := os.Create(name + tmpExt)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+tmpExt, name)
+}
+
+func (d *DirObjectStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.Dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return f, err
+}
+
+func (d *DirObjectStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(d.Dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DirObjectStore) List() ([]string, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), tmpExt) {
+			continue
+		}
+		keys = append(keys, entry.Name())
+	}
+	return keys, nil
+}
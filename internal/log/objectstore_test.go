@@ -0,0 +1,39 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirObjectStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	s, err := NewDirObjectStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Put("0.store", bytes.NewReader(write)))
+	// leftovers from an interrupted upload aren't listed
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1.store"+tmpExt), write, 0644))
+	keys, err := s.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store"}, keys)
+
+	r, err := s.Get("0.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, write, b)
+
+	require.NoError(t, s.Delete("0.store"))
+	require.NoError(t, s.Delete("0.store"))
+	_, err = s.Get("0.store")
+	require.ErrorIs(t, err, ErrObjectNotFound)
+	keys, err = s.List()
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
@@ -0,0 +1,179 @@
+package log
+
+import (
+	"container/list"
+	"crypto/rand"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+/*
+Idempotent producers tag each record with the producer ID they got from InitProducer and a sequence number
+that goes up by one with each record. When a producer retries a request that timed out, the log recognizes
+the sequence number and returns the offset the record was appended at the first time, instead of appending a duplicate.
+
+The log keeps the last few sequence numbers of the producers that appended most recently in a bounded table.
+The records carry their producer ID and sequence number into the store, so the table is rebuilt
+from the segments when the log starts.
+*/
+
+// producerWindow is the number of most recent sequence numbers the log remembers per producer,
+// so a producer with several requests in flight can retry any of them.
+const producerWindow = 5
+
+// defaultMaxProducers is the number of producers the table remembers when the config doesn't say.
+const defaultMaxProducers = 1024
+
+type producerTable struct {
+	max int
+	// the producers by ID; the elements hold *producerState and sit in lru, least recently used first
+	producers map[uint64]*list.Element
+	lru       *list.List
+}
+
+type producerState struct {
+	id uint64
+	// the producer's most recent sequence numbers and the offsets of their records, oldest first
+	sequences []uint64
+	offsets   []uint64
+}
+
+func newProducerTable(max int) *producerTable {
+	if max <= 0 {
+		max = defaultMaxProducers
+	}
+	return &producerTable{
+		max:       max,
+		producers: make(map[uint64]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// check returns the offset of the record's first append and true if the record is a retry.
+// It returns ErrOutOfOrderSequence if the record skips sequence numbers, or if it's a retry of
+// a record too old to remember. Records of producers the table doesn't know are always new.
+func (t *producerTable) check(record *api.Record) (uint64, bool, error) {
+	if record.ProducerId == 0 {
+		return 0, false, nil
+	}
+	e, ok := t.producers[record.ProducerId]
+	if !ok {
+		return 0, false, nil
+	}
+
+	p := e.Value.(*producerState)
+	last := p.sequences[len(p.sequences)-1]
+	if record.Sequence == last+1 {
+		return 0, false, nil
+	}
+	for i, seq := range p.sequences {
+		if seq == record.Sequence {
+			return p.offsets[i], true, nil
+		}
+	}
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+		Expected:   last + 1,
+	}
+}
+
+// checkBatch checks the records of a batch like check. The batch is a retry if its first record is,
+// and each producer's records in the batch must follow each other without gaps or duplicates.
+func (t *producerTable) checkBatch(records []*api.Record) (uint64, bool, error) {
+	if off, retry, err := t.check(records[0]); err != nil || retry {
+		return off, retry, err
+	}
+	// the sequence number each producer's next record in the batch must have
+	next := make(map[uint64]uint64)
+	for _, record := range records {
+		if record.ProducerId == 0 {
+			continue
+		}
+		expected, ok := next[record.ProducerId]
+		if !ok {
+			_, retry, err := t.check(record)
+			if err != nil {
+				return 0, false, err
+			}
+			// only the batch's first record may make it a retry
+			if retry {
+				expected = t.last(record.ProducerId) + 1
+			} else {
+				expected = record.Sequence
+			}
+		}
+		if record.Sequence != expected {
+			return 0, false, api.ErrOutOfOrderSequence{
+				ProducerID: record.ProducerId,
+				Sequence:   record.Sequence,
+				Expected:   expected,
+			}
+		}
+		next[record.ProducerId] = expected + 1
+	}
+	return 0, false, nil
+}
+
+// last returns the last sequence number the table has seen from the producer, which it must know.
+func (t *producerTable) last(id uint64) uint64 {
+	p := t.producers[id].Value.(*producerState)
+	return p.sequences[len(p.sequences)-1]
+}
+
+// add remembers the appended record's sequence number and offset,
+// evicting the least recently used producer if the table is full.
+func (t *producerTable) add(record *api.Record) {
+	if record.ProducerId == 0 {
+		return
+	}
+
+	var p *producerState
+	if e, ok := t.producers[record.ProducerId]; ok {
+		t.lru.MoveToBack(e)
+		p = e.Value.(*producerState)
+	} else {
+		p = &producerState{id: record.ProducerId}
+		t.producers[p.id] = t.lru.PushBack(p)
+	}
+	p.sequences = append(p.sequences, record.Sequence)
+	p.offsets = append(p.offsets, record.Offset)
+	if len(p.sequences) > producerWindow {
+		p.sequences = p.sequences[1:]
+		p.offsets = p.offsets[1:]
+	}
+
+	for t.lru.Len() > t.max {
+		oldest := t.lru.Remove(t.lru.Front()).(*producerState)
+		delete(t.producers, oldest.id)
+	}
+}
+
+func (t *producerTable) has(id uint64) bool {
+	_, ok := t.producers[id]
+	return ok
+}
+
+// InitProducer returns a new producer ID for an idempotent producer.
+// IDs are random, so they don't collide with the IDs handed out before the log restarted.
+func (l *Log) InitProducer() (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return randomID(l.producers.has), nil
+}
+
+// randomID returns a random, non-zero ID that isn't taken.
+func randomID(taken func(uint64) bool) uint64 {
+	b := make([]byte, 8)
+	for {
+		// crypto/rand.Read never returns an error
+		_, _ = rand.Read(b)
+		if id := enc.Uint64(b); id != 0 && !taken(id) {
+			return id
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestIdempotentProducer(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+
+	id, err := log.InitProducer()
+	require.NoError(t, err)
+	other, err := log.InitProducer()
+	require.NoError(t, err)
+	require.NotEqual(t, id, other)
+
+	produce := func(id, seq uint64) (uint64, error) {
+		return log.Append(&api.Record{Value: write, ProducerId: id, Sequence: seq})
+	}
+	for seq := uint64(0); seq < 8; seq++ {
+		off, err := produce(id, seq)
+		require.NoError(t, err)
+		require.Equal(t, seq, off)
+	}
+	// records without a producer are never deduplicated
+	_, err = log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+
+	// retries of the last few records return their offsets without appending
+	off, err := produce(id, 7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	off, err = produce(id, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), highest)
+
+	// records that skip ahead or are too old to tell apart from a retry are rejected
+	_, err = produce(id, 10)
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: id, Sequence: 10, Expected: 8}, err)
+	_, err = produce(id, 1)
+	require.ErrorAs(t, err, &api.ErrOutOfOrderSequence{})
+
+	// the table is rebuilt from the segments when the log restarts
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = produce(id, 7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	off, err = produce(id, 8)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+}
+
+func TestProducerTableEvicts(t *testing.T) {
+	table := newProducerTable(2)
+	for id := uint64(1); id <= 3; id++ {
+		table.add(&api.Record{ProducerId: id, Sequence: 0, Offset: id})
+	}
+	// the least recently used producer was forgotten, so its retry looks like a new record
+	require.False(t, table.has(1))
+	_, retry, err := table.check(&api.Record{ProducerId: 1, Sequence: 0})
+	require.NoError(t, err)
+	require.False(t, retry)
+
+	off, retry, err := table.check(&api.Record{ProducerId: 3, Sequence: 0})
+	require.NoError(t, err)
+	require.True(t, retry)
+	require.Equal(t, uint64(3), off)
+}
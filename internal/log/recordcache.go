@@ -0,0 +1,172 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+recordCache holds the most recently appended records, already unmarshalled, so consumers reading
+near the head of the log are served from memory without touching the store.
+
+The records sit in a ring buffer in offset order: appends add records at the tail and,
+once the cache holds more records or bytes than it's configured to, evict the oldest ones at the head.
+Since the cached offsets are contiguous, finding a record is a matter of subtracting the oldest cached offset.
+*/
+type recordCache struct {
+	mu sync.RWMutex
+	// the ring buffer; the oldest record is at head, and there are n records in it
+	ring []cachedRecord
+	head int
+	n    int
+	// the offset of the oldest record and the marshalled size of all the records in the cache
+	first uint64
+	bytes uint64
+
+	maxRecords int
+	maxBytes   uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cachedRecord struct {
+	record *api.Record
+	size   uint64
+}
+
+// CacheStats describes the log's record cache.
+type CacheStats struct {
+	// The number of reads served from the cache and of the reads that had to go to the store.
+	Hits, Misses uint64
+	// The number of records in the cache and their marshalled size.
+	Records int
+	Bytes   uint64
+}
+
+// newRecordCache returns a cache bounded by the config, or nil if the config disables it.
+func newRecordCache(c Config) *recordCache {
+	if c.RecordCache.MaxRecords <= 0 && c.RecordCache.MaxBytes == 0 {
+		return nil
+	}
+	size := c.RecordCache.MaxRecords
+	if size <= 0 {
+		// bounded by bytes only, so the ring grows as needed
+		size = 64
+	}
+	return &recordCache{
+		ring:       make([]cachedRecord, size),
+		maxRecords: c.RecordCache.MaxRecords,
+		maxBytes:   c.RecordCache.MaxBytes,
+	}
+}
+
+// add caches a copy of the record, which must have the offset following the newest cached record's.
+// A record with any other offset means the cache missed some appends, so it starts over from the record.
+func (c *recordCache) add(record *api.Record) {
+	if c == nil {
+		return
+	}
+	record = proto.Clone(record).(*api.Record)
+	size := uint64(proto.Size(record))
+	if c.maxBytes > 0 && size > c.maxBytes {
+		c.reset()
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n > 0 && record.Offset != c.first+uint64(c.n) {
+		c.clear()
+	}
+	if c.n == 0 {
+		c.first = record.Offset
+	}
+	for c.n > 0 && ((c.maxRecords > 0 && c.n >= c.maxRecords) || (c.maxBytes > 0 && c.bytes+size > c.maxBytes)) {
+		c.evict()
+	}
+	if c.n == len(c.ring) {
+		c.grow()
+	}
+	c.ring[(c.head+c.n)%len(c.ring)] = cachedRecord{record: record, size: size}
+	c.n++
+	c.bytes += size
+}
+
+// get returns the cached record with the given offset. Callers share the record with the cache and mustn't modify it.
+func (c *recordCache) get(offset uint64) (*api.Record, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.n == 0 || offset < c.first || offset-c.first >= uint64(c.n) {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return c.ring[(c.head+int(offset-c.first))%len(c.ring)].record, true
+}
+
+// truncate evicts the records with offsets lower than lowest.
+func (c *recordCache) truncate(lowest uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.n > 0 && c.first < lowest {
+		c.evict()
+	}
+}
+
+// reset empties the cache.
+func (c *recordCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+}
+
+func (c *recordCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Records: c.n,
+		Bytes:   c.bytes,
+	}
+}
+
+// evict removes the oldest record. The caller must hold the lock.
+func (c *recordCache) evict() {
+	c.bytes -= c.ring[c.head].size
+	c.ring[c.head] = cachedRecord{}
+	c.head = (c.head + 1) % len(c.ring)
+	c.n--
+	c.first++
+}
+
+// clear removes every record. The caller must hold the lock.
+func (c *recordCache) clear() {
+	clear(c.ring)
+	c.head, c.n, c.bytes = 0, 0, 0
+}
+
+// grow doubles the ring of a cache that's only bounded by bytes. The caller must hold the lock.
+func (c *recordCache) grow() {
+	ring := make([]cachedRecord, 2*len(c.ring))
+	for i := 0; i < c.n; i++ {
+		ring[i] = c.ring[(c.head+i)%len(c.ring)]
+	}
+	c.ring, c.head = ring, 0
+}
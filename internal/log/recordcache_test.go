@@ -0,0 +1,111 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecordCache(t *testing.T) {
+	c := Config{}
+	c.RecordCache.MaxRecords = 3
+	cache := newRecordCache(c)
+
+	for off := uint64(0); off < 5; off++ {
+		cache.add(&api.Record{Value: write, Offset: off})
+	}
+	// only the 3 most recent records are kept
+	_, ok := cache.get(1)
+	require.False(t, ok)
+	for off := uint64(2); off < 5; off++ {
+		record, ok := cache.get(off)
+		require.True(t, ok)
+		require.Equal(t, off, record.Offset)
+	}
+	stats := cache.stats()
+	require.Equal(t, uint64(3), stats.Hits)
+	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, 3, stats.Records)
+
+	cache.truncate(4)
+	_, ok = cache.get(3)
+	require.False(t, ok)
+	_, ok = cache.get(4)
+	require.True(t, ok)
+
+	// a gap in the offsets starts the cache over
+	cache.add(&api.Record{Value: write, Offset: 10})
+	_, ok = cache.get(4)
+	require.False(t, ok)
+	require.Equal(t, 1, cache.stats().Records)
+
+	require.Nil(t, newRecordCache(Config{}))
+}
+
+func TestRecordCacheMaxBytes(t *testing.T) {
+	// the offsets all take up 2 bytes, so the records are the same size
+	size := uint64(proto.Size(&api.Record{Value: write, Offset: 200}))
+	c := Config{}
+	c.RecordCache.MaxBytes = 100 * size
+	cache := newRecordCache(c)
+
+	// the ring grows past its initial size until the cache holds MaxBytes
+	for off := uint64(200); off < 350; off++ {
+		cache.add(&api.Record{Value: write, Offset: off})
+	}
+	stats := cache.stats()
+	require.Equal(t, 100, stats.Records)
+	require.Equal(t, 100*size, stats.Bytes)
+	_, ok := cache.get(249)
+	require.False(t, ok)
+	record, ok := cache.get(250)
+	require.True(t, ok)
+	require.Equal(t, uint64(250), record.Offset)
+
+	// records bigger than the whole cache aren't cached
+	cache.add(&api.Record{Value: make([]byte, 100*size), Offset: 350})
+	require.Equal(t, 0, cache.stats().Records)
+}
+
+func TestLogRecordCache(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.RecordCache.MaxRecords = 4
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appended := &api.Record{Value: write}
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(appended)
+		require.NoError(t, err)
+	}
+	// the cache holds a copy, so the caller can reuse its record
+	appended.Value = []byte("changed")
+
+	for off := uint64(0); off < 8; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, write, read.Value)
+	}
+	stats := log.CacheStats()
+	require.Equal(t, uint64(4), stats.Hits)
+	require.Equal(t, uint64(4), stats.Misses)
+
+	// streaming consumers at the head are served from the cache too
+	it := log.Iterator()
+	it.Seek(6)
+	require.True(t, it.Next())
+	require.True(t, it.Next())
+	require.Equal(t, uint64(6), log.CacheStats().Hits)
+
+	require.NoError(t, log.Truncate(7))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	for off := uint64(0); off < lowest; off++ {
+		_, err := log.Read(off)
+		require.Error(t, err)
+	}
+}
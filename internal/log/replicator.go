@@ -5,6 +5,7 @@ import (
 	"os"
 	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	api "github.com/ttaaoo/proglog/api/v1"
 	"google.golang.org/grpc"
@@ -27,8 +28,12 @@ type Replicator struct {
 	servers map[string]chan struct{}
 	closed  bool
 	close   chan struct{}
+	// how many records behind each server the local log is, by server name
+	lag *prometheus.GaugeVec
 }
 
+var _ prometheus.Collector = (*Replicator)(nil)
+
 // Join adds the given server address to the list of
 // servers to replicate and kicks off the add goroutine to run the actual
 // replication logic.
@@ -48,12 +53,12 @@ func (r *Replicator) Join(name, addr string) error {
 
 	r.servers[name] = make(chan struct{})
 
-	go r.replicate(addr, r.servers[name])
+	go r.replicate(name, addr, r.servers[name])
 	return nil
 }
 
 // Pull based replication
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
+func (r *Replicator) replicate(name, addr string, leave chan struct{}) {
 	cc, err := grpc.NewClient(addr, r.DialOptions...)
 	if err != nil {
 		r.logError(err, "failed to dial", addr)
@@ -63,15 +68,18 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 
 	client := api.NewLogClient(cc)
 	ctx := context.Background()
+	// we only replicate the records of committed transactions, once they're committed,
+	// so the local log never holds records of transactions that end up aborted
 	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
-		Offset: 0,
+		Offset:    0,
+		Isolation: api.IsolationLevel_READ_COMMITTED,
 	})
 	if err != nil {
 		r.logError(err, "failed to consume", addr)
 		return
 	}
 
-	records := make(chan *api.Record)
+	records := make(chan *api.ConsumeResponse)
 	go func() {
 		for {
 			recv, err := stream.Recv()
@@ -79,7 +87,7 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 				r.logError(err, "failed to receive", addr)
 				return
 			}
-			records <- recv.Record
+			records <- recv
 		}
 	}()
 
@@ -96,12 +104,17 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 			return
 		case <-leave:
 			return
-		case record := <-records:
-			_, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: record})
+		case recv := <-records:
+			// transactions belong to the log they began on: the local log never began them and would refuse
+			// their records, so we append committed records as plain ones
+			recv.Record.TransactionId = 0
+			_, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: recv.Record})
 			if err != nil {
 				r.logError(err, "failed to produce", addr)
 				return
 			}
+			// the records the server had appended past this one when it sent it
+			r.lag.WithLabelValues(name).Set(float64(recv.HighWatermark - recv.Record.Offset - 1))
 		}
 	}
 }
@@ -121,6 +134,7 @@ func (r *Replicator) Leave(name string) error {
 
 	close(r.servers[name])
 	delete(r.servers, name)
+	r.lag.DeleteLabelValues(name)
 	return nil
 }
 
@@ -137,6 +151,28 @@ func (r *Replicator) init() {
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+	if r.lag == nil {
+		r.lag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proglog_replication_lag_records",
+			Help: "How many records the local log is behind each server it replicates, as of the last replicated record.",
+		}, []string{"peer"})
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (r *Replicator) Describe(ch chan<- *prometheus.Desc) {
+	r.mu.Lock()
+	r.init()
+	r.mu.Unlock()
+	r.lag.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *Replicator) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	r.init()
+	r.mu.Unlock()
+	r.lag.Collect(ch)
 }
 
 // Close closes the replicator so it doesn't replicate new servers that join
@@ -0,0 +1,94 @@
+package log_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"github.com/ttaaoo/proglog/internal/log"
+	"github.com/ttaaoo/proglog/internal/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestReplicatorTransactions(t *testing.T) {
+	leaderLog, leader := serve(t)
+	followerLog, follower := serve(t)
+
+	r := &log.Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		LocalServer: dial(t, follower),
+	}
+	defer r.Close()
+	require.NoError(t, r.Join("leader", leader))
+
+	client := dial(t, leader)
+	ctx := context.Background()
+	transact := func(value string, end func(context.Context, *api.EndTransactionRequest, ...grpc.CallOption) (*api.EndTransactionResponse, error)) {
+		t.Helper()
+		txn, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+		require.NoError(t, err)
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), TransactionId: txn.TransactionId},
+		})
+		require.NoError(t, err)
+		_, err = end(ctx, &api.EndTransactionRequest{TransactionId: txn.TransactionId})
+		require.NoError(t, err)
+	}
+	transact("committed", client.CommitTransaction)
+	transact("aborted", client.AbortTransaction)
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("after")}})
+	require.NoError(t, err)
+	highest, err := leaderLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+
+	// the follower gets the committed record as a plain one, and neither the aborted record nor the markers
+	require.Eventually(t, func() bool {
+		highest, err := followerLog.HighestOffset()
+		return err == nil && highest == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	committed, err := followerLog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "committed", string(committed.Value))
+	require.Zero(t, committed.TransactionId)
+	after, err := followerLog.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "after", string(after.Value))
+}
+
+// serve serves a new log on a local port and returns the log and the server's address.
+func serve(t *testing.T) (*log.Log, string) {
+	t.Helper()
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:  server.LogCommitLog{Log: clog},
+		Authorizer: allowAll{},
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Stop()
+		_ = clog.Close()
+	})
+	return clog, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) api.LogClient {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api.NewLogClient(conn)
+}
+
+// allowAll authorizes every request, since the servers here don't identify their clients.
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error { return nil }
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path"
 
@@ -23,6 +25,13 @@ type segment struct {
 	// the next (global) offset to write to the segment
 	nextOffset uint64
 	config     Config
+	// remote is set once the segment's files have been offloaded to the tier's object store.
+	// A remote segment has no store or index of its own; reads go through a copy fetched into the cache dir.
+	remote bool
+	// the segment's most recently decompressed record batches
+	batches *batchCache
+	// the file holding the ID of the key the store is encrypted with
+	keyFile string
 }
 
 // The log calls newSegment when it needs to add a new segment, such as when the current active segment
@@ -31,13 +40,19 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		batches:    newBatchCache(),
+	}
+
+	// open or create the store and index files; a read-only segment opens them as they are
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE|os.O_APPEND, os.O_RDWR|os.O_CREATE
+	if c.ReadOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
 	}
 
 	var err error
-	// open or create the store file
 	storeFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		storeFlag,
 		0644,
 	)
 	if err != nil {
@@ -48,9 +63,14 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	s.keyFile = path.Join(dir, fmt.Sprintf("%d%s", baseOffset, keyExt))
+	if s.store.aead, err = segmentCipher(s.keyFile, s.store.size, c.Encryption.Keys, c.ReadOnly); err != nil {
+		return nil, err
+	}
+
 	indexFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
+		indexFlag,
 		0644,
 	)
 	if err != nil {
@@ -60,6 +80,11 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if c.ReadOnly {
+		if err := s.index.scan(s.store.size); err != nil {
+			return nil, err
+		}
+	}
 
 	// set the segment's next offset to prepare for the next appended record.
 	// If the index is empty, then the next record appended to the segment would be the first record.
@@ -67,12 +92,31 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		s.nextOffset = baseOffset
 	} else {
 		// e.g. baseOffset = 10, off = 10, then the next record appended to the segment would be the 21st record.
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = baseOffset + off + 1
 	}
 
 	return s, nil
 }
 
+// refresh picks up the records another process appended to a read-only segment since it was opened.
+func (s *segment) refresh() error {
+	if err := s.store.refresh(); err != nil {
+		return err
+	}
+	if s.store.aead == nil && s.config.Encryption.Keys != nil {
+		// the segment was brand new when we opened it and its writer may have recorded its key since
+		var err error
+		if s.store.aead, err = segmentCipher(s.keyFile, s.store.size, s.config.Encryption.Keys, true); err != nil {
+			return err
+		}
+	}
+	if err := s.index.scan(s.store.size); err != nil {
+		return err
+	}
+	s.nextOffset = s.baseOffset + s.index.entries()
+	return nil
+}
+
 // Append writes the record to the segment and returns the newly appended record's offset.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
@@ -89,7 +133,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 
 	if err = s.index.Write(
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		s.nextOffset-s.baseOffset,
 		pos,
 	); err != nil {
 		return 0, err
@@ -98,6 +142,43 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	return cur, nil
 }
 
+// AppendBatch writes the records to the segment as a single store frame compressed with the given codec,
+// and returns the offset of the first record. Each record still gets its own index entry,
+// so the batch must fit in the index as a whole.
+func (s *segment) AppendBatch(records []*api.Record, codec Codec) (offset uint64, err error) {
+	n := uint64(len(records))
+	if !s.index.hasRoom(n) {
+		return 0, io.EOF
+	}
+
+	first := s.nextOffset
+	ps := make([][]byte, n)
+	for i, record := range records {
+		record.Offset = first + uint64(i)
+		if ps[i], err = proto.Marshal(record); err != nil {
+			return 0, err
+		}
+	}
+
+	frame, err := encodeBatch(codec, first, ps)
+	if err != nil {
+		return 0, err
+	}
+	_, pos, err := s.store.Append(frame)
+	if err != nil {
+		return 0, err
+	}
+
+	// every record in the batch points at the batch's frame
+	for i := range n {
+		if err = s.index.Write(first+i-s.baseOffset, pos); err != nil {
+			return 0, err
+		}
+	}
+	s.nextOffset += n
+	return first, nil
+}
+
 // Read returns the record for the given offset.
 // Similar to writes, to read a record the segment must first translate the absolute index into a relative index
 // and get the associated index entry.
@@ -109,7 +190,12 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 		return nil, err
 	}
 
-	p, err := s.store.Read(pos)
+	var p []byte
+	if b, ok := s.batches.get(pos); ok {
+		p, err = b.record(off)
+	} else if p, err = s.store.Read(pos); err == nil && isBatch(p) {
+		p, err = s.readBatch(pos, p, off)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -119,6 +205,22 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// readBatch decompresses the batch frame read from the given position, caches it,
+// and returns the marshalled record at the given offset.
+func (s *segment) readBatch(pos uint64, p []byte, off uint64) ([]byte, error) {
+	// the cache keeps the batch's records after the read, so they mustn't be slices of the store's mapping
+	if batchCodec(p) == NoCompression {
+		p = bytes.Clone(p)
+	}
+	first, records, err := decodeBatch(p)
+	if err != nil {
+		return nil, err
+	}
+	b := &batch{first: first, records: records}
+	s.batches.put(pos, b)
+	return b.record(off)
+}
+
 // The log uses this method to know it needs to create a new segment.
 // if you wrote a small number of long logs, then you'd hit the segment bytes limit.
 // if you wrote a large number of short logs, then you'd hit the index bytes limit.
@@ -136,6 +238,10 @@ func (s *segment) Remove() error {
 		return err
 	}
 
+	if err := os.Remove(s.keyFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	return os.Remove(s.store.Name())
 }
 
@@ -2,13 +2,21 @@ package log
 
 import (
 	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"io"
 	"os"
 	"sync"
+
+	"github.com/tysonmote/gommap"
 )
 
 var (
 	enc = binary.BigEndian
+
+	errShortCiphertext = errors.New("ciphertext shorter than its nonce")
 )
 
 const (
@@ -20,8 +28,16 @@ type store struct {
 	mu   sync.RWMutex
 	buf  *bufio.Writer
 	size uint64
+	// aead encrypts each record when the store is encrypted at rest; it's nil for plaintext stores.
+	aead cipher.AEAD
+	// mmap maps the store's file once its segment is closed for appends. Closed stores never change,
+	// so reads are served from the mapping without flushing the buffer, making a system call, or copying the record.
+	// Reads hold the read lock while they use the mapping, so Close can't unmap it out from under them.
+	mmap gommap.MMap
 }
 
+var errStoreMapped = errors.New("can't append to a store that's mapped read-only")
+
 func newStore(f *os.File) (*store, error) {
 	// get the file size
 	fi, err := os.Stat(f.Name())
@@ -45,8 +61,14 @@ func newStore(f *os.File) (*store, error) {
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.mmap != nil {
+		return 0, 0, errStoreMapped
+	}
 
 	pos = s.size
+	if s.aead != nil {
+		p = s.seal(pos, p)
+	}
 	// write the length of the record first
 	// so that when we read the record, we know how many bytes to read
 	err = binary.Write(s.buf, enc, uint64(len(p)))
@@ -67,7 +89,17 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	return uint64(w), pos, nil
 }
 
+// Read returns the record at the given position. The plaintext records of a mapped store are slices of the mapping,
+// which are only valid until the store is closed: callers must keep it open while they use the record,
+// like the log's readers do by holding the log's read lock, and copy whatever outlives that.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	s.mu.RLock()
+	if s.mmap != nil {
+		defer s.mu.RUnlock()
+		return s.readMapped(pos)
+	}
+	s.mu.RUnlock()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -91,15 +123,133 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
+	if s.aead != nil {
+		return s.open(pos, b)
+	}
 	return b, nil
 }
 
+// readMapped reads the record at the given position from the store's mapping.
+// The caller holds the read lock. Plaintext records aren't copied out of the mapping; encrypted ones are decrypted into new memory.
+func (s *store) readMapped(pos uint64) ([]byte, error) {
+	size := uint64(len(s.mmap))
+	if pos+lenWidth > size {
+		return nil, io.EOF
+	}
+	end := pos + lenWidth + enc.Uint64(s.mmap[pos:pos+lenWidth])
+	if end > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := s.mmap[pos+lenWidth : end]
+
+	if s.aead != nil {
+		return s.open(pos, b)
+	}
+	return b, nil
+}
+
+// mapReadOnly flushes the store and maps its file, after which the store only serves reads.
+// The log calls it once the store's segment is no longer the active segment.
+func (s *store) mapReadOnly() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// an empty file can't be mapped, and has nothing to read anyway
+	if s.mmap != nil || s.size == 0 {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	m, err := gommap.MapRegion(s.File.Fd(), 0, int64(s.size), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap = m
+	return nil
+}
+
+/*
+An encrypted record is stored as
+
+	[nonce][ciphertext and GCM tag]
+
+The record's position in the store is the additional data, so records can't be moved around
+in, or between, stores without failing to decrypt.
+*/
+
+func (s *store) seal(pos uint64, p []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(p)+s.aead.Overhead())
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(nonce)
+	return s.aead.Seal(nonce, nonce, p, additionalData(pos))
+}
+
+func (s *store) open(pos uint64, b []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(b) < n {
+		return nil, errShortCiphertext
+	}
+	return s.aead.Open(nil, b[:n], b[n:], additionalData(pos))
+}
+
+func additionalData(pos uint64) []byte {
+	ad := make([]byte, 8)
+	enc.PutUint64(ad, pos)
+	return ad
+}
+
+// frameSize returns the number of bytes the frame holding the given record takes up in the store.
+func (s *store) frameSize(p []byte) uint64 {
+	size := uint64(lenWidth + len(p))
+	if s.aead != nil {
+		size += uint64(s.aead.NonceSize() + s.aead.Overhead())
+	}
+	return size
+}
+
+// flush writes the buffered records to the file, so other processes reading the file can see them.
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// refresh picks up the size of a read-only store that another process may be appending to.
+func (s *store) refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap != nil {
+		// the store's segment was closed for appends before it was mapped
+		return nil
+	}
+	fi, err := s.File.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = uint64(fi.Size())
+	return nil
+}
+
 // ReadAt reads len(p) bytes into p starting at the off offset in the store's file.
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if s.mmap != nil {
+		defer s.mu.RUnlock()
+		if off >= int64(len(s.mmap)) {
+			return 0, io.EOF
+		}
+		n := copy(p, s.mmap[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	s.mu.RUnlock()
 
-	if err := s.buf.Flush(); err != nil {
+	// flushing writes to the buffer, so it takes the exclusive lock: two readers flushing the same buffer at once
+	// could write its bytes to the file twice. Reading the file itself doesn't need the lock
+	if err := s.flush(); err != nil {
 		return 0, err
 	}
 
@@ -110,6 +260,13 @@ func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+
 	err := s.buf.Flush()
 	if err != nil {
 		return err
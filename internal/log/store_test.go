@@ -2,6 +2,7 @@ package log
 
 import (
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -69,6 +70,77 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreMapReadOnly(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_map_read_only_test")
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	// mapping the store flushes its buffer and serves reads from the mapping
+	require.NoError(t, s.mapReadOnly())
+	require.Len(t, s.mmap, int(width*3))
+	testRead(t, s)
+	testReadAt(t, s)
+
+	_, _, err = s.Append(write)
+	require.Equal(t, errStoreMapped, err)
+	require.NoError(t, s.Close())
+	require.Nil(t, s.mmap)
+}
+
+func TestStoreMappedReadsRaceClose(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_mapped_reads_race_close_test")
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.mapReadOnly())
+
+	// reads either see the mapping or fail on the closed file, never an unmapped region
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, lenWidth)
+			for {
+				if _, err := s.Read(0); err != nil {
+					return
+				}
+				if _, err := s.ReadAt(p, 0); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	require.NoError(t, s.Close())
+	wg.Wait()
+}
+
+func TestStoreMappedReadsDontCopy(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_mapped_reads_dont_copy_test")
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+	require.NoError(t, s.mapReadOnly())
+
+	b, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, b)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := s.Read(0); err != nil {
+			t.Fatal(err)
+		}
+	})
+	require.Zero(t, allocs)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
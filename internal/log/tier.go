@@ -0,0 +1,500 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+const (
+	storeExt = ".store"
+	indexExt = ".index"
+)
+
+// segmentKeys returns the object store keys of the segment's files, with the store last
+// so that a store object's presence means the whole segment was uploaded.
+// The key file only exists for encrypted segments.
+func segmentKeys(baseOffset uint64) []string {
+	return []string{
+		fmt.Sprintf("%d%s", baseOffset, keyExt),
+		fmt.Sprintf("%d%s", baseOffset, indexExt),
+		fmt.Sprintf("%d%s", baseOffset, storeExt),
+	}
+}
+
+// Offload moves the closed segments whose store file hasn't been written to for
+// Config.Tier.OffloadAfter to the tier's object store and removes their local files.
+// The active segment is never offloaded. Offload is a no-op when no object store is configured;
+// the log's owner is expected to call it periodically.
+//
+// Closed segments never change, so Offload uploads them without holding the log's lock,
+// and appends and reads carry on while it does. It only takes the lock to pick the segments
+// and, once a segment's uploaded, to switch it over to the remote copy.
+func (l *Log) Offload() error {
+	if l.Config.Tier.Store == nil {
+		return nil
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+	segments, err := l.offloadable()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if err := l.offload(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offloadable returns the closed local segments whose store file hasn't been written to for Config.Tier.OffloadAfter.
+func (l *Log) offloadable() ([]*segment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, api.ErrLogClosed{}
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s == l.activeSegment || s.remote {
+			continue
+		}
+		fi, err := os.Stat(s.store.Name())
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(fi.ModTime()) < l.Config.Tier.OffloadAfter {
+			continue
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// offload uploads the segment's files, and then switches the segment over to its remote copy
+// and deletes the files from the local disk.
+func (l *Log) offload(s *segment) error {
+	uploadErr := l.upload(s)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+	if !slices.Contains(l.segments, s) {
+		// the log truncated the segment while we uploaded it, so its objects mustn't outlive it
+		return l.deleteObjects(s.baseOffset)
+	}
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+	names := []string{s.keyFile, s.index.Name(), s.store.Name()}
+	s.remote = true
+	s.store, s.index = nil, nil
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload copies the closed segment's files to the object store. The index file of a segment that's still open
+// is padded to its maximum size, so we only upload the part that holds entries.
+func (l *Log) upload(s *segment) error {
+	files := []struct {
+		name string
+		size int64
+	}{
+		{s.keyFile, -1},
+		{s.index.Name(), int64(s.index.size)},
+		{s.store.Name(), int64(s.store.size)},
+	}
+	for i, key := range segmentKeys(s.baseOffset) {
+		f, err := os.Open(files[i].name)
+		if os.IsNotExist(err) && files[i].name == s.keyFile {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var r io.Reader = f
+		if files[i].size >= 0 {
+			r = io.LimitReader(f, files[i].size)
+		}
+		err = l.Config.Tier.Store.Put(key, r)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObjects deletes the objects of the segment with the given base offset from the object store.
+func (l *Log) deleteObjects(baseOffset uint64) error {
+	for _, key := range segmentKeys(baseOffset) {
+		if err := l.Config.Tier.Store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteOffsets returns the base offsets of the segments in the tier's object store that
+// aren't also on the local disk (which happens when we crash between uploading and removing a segment).
+func (l *Log) remoteOffsets(local []uint64) ([]uint64, error) {
+	if l.Config.Tier.Store == nil {
+		return nil, nil
+	}
+	keys, err := l.Config.Tier.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets []uint64
+	for _, key := range keys {
+		if path.Ext(key) != storeExt {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(key, storeExt), 10, 64)
+		if err != nil || slices.Contains(local, off) {
+			continue
+		}
+		offsets = append(offsets, off)
+	}
+	slices.Sort(offsets)
+	return offsets, nil
+}
+
+// setupRemote tracks the given remote segments ahead of the local ones.
+// Segments are contiguous, so a remote segment's next offset is the following segment's base offset.
+// If there are no local segments, we fetch the newest remote segment to learn where to start the active segment.
+func (l *Log) setupRemote(offsets []uint64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	remote := make([]*segment, len(offsets))
+	for i, off := range offsets {
+		remote[i] = &segment{
+			baseOffset: off,
+			config:     l.Config,
+			remote:     true,
+		}
+		if i > 0 {
+			remote[i-1].nextOffset = off
+		}
+	}
+	last := remote[len(remote)-1]
+	if len(l.segments) > 0 {
+		last.nextOffset = l.segments[0].baseOffset
+	} else {
+		l.cacheMu.Lock()
+		cached, err := l.fetch(last)
+		l.cacheMu.Unlock()
+		if err != nil {
+			return err
+		}
+		last.nextOffset = cached.nextOffset
+	}
+	l.segments = append(remote, l.segments...)
+	return nil
+}
+
+// readRemote reads the record at the given offset from a remote segment,
+// fetching the segment into the cache dir if it isn't already there.
+// The caller mustn't hold the log's lock, so appends don't wait for the download.
+func (l *Log) readRemote(s *segment, off uint64) (*api.Record, error) {
+	record, err := l.readCached(s, off)
+	if err != nil {
+		return nil, l.remoteError(s, off, err)
+	}
+	return record, nil
+}
+
+func (l *Log) readCached(s *segment, off uint64) (*api.Record, error) {
+	cached, err := l.pin(s)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unpin(cached)
+	return cached.Read(off)
+}
+
+// pin returns the cached copy of the remote segment, fetching it if needed, and keeps the copy from being removed
+// until the caller unpins it, so the caller can read the copy without holding cacheMu.
+func (l *Log) pin(s *segment) (*segment, error) {
+	l.cacheMu.Lock()
+	defer l.cacheMu.Unlock()
+	cached, err := l.fetch(s)
+	if err != nil {
+		return nil, err
+	}
+	if l.pins == nil {
+		l.pins = make(map[*segment]int)
+	}
+	l.pins[cached]++
+	return cached, nil
+}
+
+// unpin lets go of a copy pin returned, removing it if it's no longer cached and nothing else reads it.
+func (l *Log) unpin(cached *segment) error {
+	l.cacheMu.Lock()
+	defer l.cacheMu.Unlock()
+	if l.pins[cached]--; l.pins[cached] > 0 {
+		return nil
+	}
+	delete(l.pins, cached)
+	if l.cached[cached.baseOffset] == cached {
+		return nil
+	}
+	if l.evicted[cached.baseOffset] == cached {
+		delete(l.evicted, cached.baseOffset)
+	}
+	if l.cacheClosed {
+		return cached.Close()
+	}
+	return cached.Remove()
+}
+
+// remoteError translates the error of reading the given offset of a remote segment, which readers do without
+// the log's lock. A truncation may have removed the segment's objects since the reader let go of the lock,
+// in which case the offset is out of range, just like the offsets of a truncated local segment.
+// The caller mustn't hold cacheMu, since truncations take it while they hold the log's lock.
+func (l *Log) remoteError(s *segment, off uint64, err error) error {
+	if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+	if len(l.segments) == 0 || l.segmentFor(off) == s {
+		return err
+	}
+	return l.outOfRange(off)
+}
+
+// fetch returns the cached copy of the remote segment, downloading it first if needed.
+// When the cache is full, the least recently fetched segment is evicted.
+// The caller must hold cacheMu, which fetch releases while it downloads, so reads of other cached segments
+// carry on in the meantime. Readers of a segment that's being downloaded wait for that download.
+// A copy that was evicted while it was being read is put back instead of downloaded again.
+func (l *Log) fetch(s *segment) (*segment, error) {
+	for {
+		if l.cacheClosed {
+			return nil, api.ErrLogClosed{}
+		}
+		if cached, ok := l.cached[s.baseOffset]; ok {
+			return cached, nil
+		}
+		if cached, ok := l.evicted[s.baseOffset]; ok {
+			delete(l.evicted, s.baseOffset)
+			if err := l.cache(cached); err != nil {
+				return nil, err
+			}
+			return cached, nil
+		}
+		done, ok := l.fetching[s.baseOffset]
+		if !ok {
+			break
+		}
+		l.cacheMu.Unlock()
+		<-done
+		l.cacheMu.Lock()
+	}
+
+	dir, err := l.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	if l.fetching == nil {
+		l.fetching = make(map[uint64]chan struct{})
+	}
+	done := make(chan struct{})
+	l.fetching[s.baseOffset] = done
+	l.cacheMu.Unlock()
+	cached, err := l.download(dir, s.baseOffset)
+	l.cacheMu.Lock()
+	delete(l.fetching, s.baseOffset)
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	if l.cacheClosed {
+		// the log closed while we downloaded
+		cached.Remove()
+		return nil, api.ErrLogClosed{}
+	}
+	if err := l.cache(cached); err != nil {
+		cached.Remove()
+		return nil, err
+	}
+	return cached, nil
+}
+
+// cache adds the copy to the cache, evicting the least recently fetched copies if the cache is full.
+// The caller must hold cacheMu.
+func (l *Log) cache(cached *segment) error {
+	if l.cached == nil {
+		l.cached = make(map[uint64]*segment)
+	}
+	max := l.Config.Tier.MaxCachedSegments
+	if max <= 0 {
+		max = 1
+	}
+	for len(l.cacheOrder) >= max {
+		if err := l.evict(l.cacheOrder[0]); err != nil {
+			return err
+		}
+	}
+	l.cached[cached.baseOffset] = cached
+	l.cacheOrder = append(l.cacheOrder, cached.baseOffset)
+	return nil
+}
+
+// download fetches the objects of the remote segment with the given base offset into the dir
+// and opens them as a read-only segment.
+func (l *Log) download(dir string, baseOffset uint64) (*segment, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, key := range segmentKeys(baseOffset) {
+		err := l.downloadObject(key, filepath.Join(dir, key))
+		if errors.Is(err, ErrObjectNotFound) && path.Ext(key) == keyExt {
+			// the segment isn't encrypted
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	cached, err := newSegment(dir, baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	// remote segments never change
+	if err := cached.store.mapReadOnly(); err != nil {
+		cached.Close()
+		return nil, err
+	}
+	return cached, nil
+}
+
+func (l *Log) downloadObject(key, name string) error {
+	r, err := l.Config.Tier.Store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// evict removes the cached copy of the segment with the given base offset.
+// A copy that's being read is removed once its last reader unpins it.
+// The caller must hold cacheMu.
+func (l *Log) evict(baseOffset uint64) error {
+	l.cacheOrder = slices.DeleteFunc(l.cacheOrder, func(off uint64) bool {
+		return off == baseOffset
+	})
+	cached, ok := l.cached[baseOffset]
+	if !ok {
+		return nil
+	}
+	delete(l.cached, baseOffset)
+	if l.pins[cached] > 0 {
+		if l.evicted == nil {
+			l.evicted = make(map[uint64]*segment)
+		}
+		l.evicted[baseOffset] = cached
+		return nil
+	}
+	return cached.Remove()
+}
+
+// removeRemote deletes a remote segment's objects and its cached copy.
+func (l *Log) removeRemote(s *segment) error {
+	l.cacheMu.Lock()
+	defer l.cacheMu.Unlock()
+	if err := l.evict(s.baseOffset); err != nil {
+		return err
+	}
+	// the segment is gone, so a copy that's still being read mustn't be put back in the cache
+	delete(l.evicted, s.baseOffset)
+	return l.deleteObjects(s.baseOffset)
+}
+
+// closeCache closes the cached copies of remote segments.
+func (l *Log) closeCache() error {
+	l.cacheMu.Lock()
+	defer l.cacheMu.Unlock()
+	for off, cached := range l.cached {
+		delete(l.cached, off)
+		// unpin closes the copies that are still being read
+		if l.pins[cached] > 0 {
+			continue
+		}
+		if err := cached.Close(); err != nil {
+			return err
+		}
+	}
+	l.cacheOrder = nil
+	l.evicted = nil
+	l.cacheClosed = true
+	if l.tmpCacheDir != "" {
+		if err := os.RemoveAll(l.tmpCacheDir); err != nil {
+			return err
+		}
+		l.tmpCacheDir = ""
+	}
+	return nil
+}
+
+// cacheDir returns the directory remote segments are fetched into.
+// A read-only log mustn't write to the log's directory, so it defaults to a temp dir that's removed on close.
+// The caller must hold cacheMu.
+func (l *Log) cacheDir() (string, error) {
+	if l.Config.Tier.CacheDir != "" {
+		return l.Config.Tier.CacheDir, nil
+	}
+	if !l.Config.ReadOnly {
+		return filepath.Join(l.Dir, "cache"), nil
+	}
+	if l.tmpCacheDir == "" {
+		dir, err := os.MkdirTemp("", "proglog-cache-")
+		if err != nil {
+			return "", err
+		}
+		l.tmpCacheDir = dir
+	}
+	return l.tmpCacheDir, nil
+}
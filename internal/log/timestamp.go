@@ -0,0 +1,74 @@
+package log
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+/*
+OffsetForTime finds where a consumer that wants the records produced since some time starts reading.
+Records carry the time they were produced, which the log sets to the append time unless the producer sets it,
+so the timestamps go up along the log, give or take the producers' clocks. That lets us binary search the segments
+by the timestamp of their first record for the last segment that starts before the time,
+and then scan that segment, and the ones after it if need be, for the first record at or after the time.
+*/
+
+// OffsetForTime returns the offset of the first record produced at or after the given time,
+// or the log's next offset if there's no such record yet.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	ts := t.UnixMilli()
+
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return 0, api.ErrLogClosed{}
+	}
+	bases := make([]uint64, len(l.segments))
+	for i, s := range l.segments {
+		bases[i] = s.baseOffset
+	}
+	l.mu.RUnlock()
+
+	var searchErr error
+	i := sort.Search(len(bases), func(i int) bool {
+		record, err := l.read(bases[i])
+		var (
+			below api.ErrOffsetBelowLowest
+			above api.ErrOffsetAboveHighest
+		)
+		switch {
+		case errors.As(err, &below):
+			// the segment was truncated since, so its records were older still
+			return false
+		case errors.As(err, &above):
+			// the active segment is empty, so its records, if any, are still to come
+			return true
+		case err != nil:
+			searchErr = err
+			return true
+		}
+		return record.Timestamp >= ts
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+
+	start := bases[0]
+	if i > 0 {
+		start = bases[i-1]
+	}
+	it := l.Iterator()
+	it.Seek(start)
+	for it.Next() {
+		if it.Record().Timestamp >= ts {
+			return it.Record().Offset, nil
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return l.NextOffset(), nil
+}
@@ -0,0 +1,48 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestOffsetForTime(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// records produced every 10ms from 1000ms on, with two produced at the same time
+	for _, ts := range []int64{1000, 1010, 1020, 1020, 1030, 1040, 1050, 1060} {
+		_, err := log.Append(&api.Record{Value: []byte("hello world"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	for ts, want := range map[int64]uint64{
+		0:    0,
+		1000: 0,
+		1005: 1,
+		1020: 2,
+		1021: 4,
+		1060: 7,
+		// no records at or after the time yet
+		1061: 8,
+	} {
+		off, err := log.OffsetForTime(time.UnixMilli(ts))
+		require.NoError(t, err)
+		require.Equal(t, want, off, "timestamp %d", ts)
+	}
+
+	// records the producer didn't stamp get the append time
+	before := time.Now().UnixMilli()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, record.Timestamp, before)
+	require.LessOrEqual(t, record.Timestamp, time.Now().UnixMilli())
+}
@@ -0,0 +1,224 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+/*
+Transactions let producers append a group of records that consumers see all of or none of.
+A producer begins a transaction, appends records tagged with the transaction's ID, and then commits or aborts it,
+which appends a marker record with the transaction's ID and the outcome.
+
+Read-committed consumers skip the markers and the records of aborted transactions. They also stop at the
+last stable offset, the offset of the first record of the oldest transaction that's still open,
+so they never skip the records of a transaction that's yet to commit, and they see records in log order.
+Read-uncommitted consumers see every record as it's appended, markers included.
+
+Like the producer table, the log rebuilds the transactions' state from the records in the segments when it starts.
+Transactions that were still open when the log stopped can't be finished, so the log aborts them.
+*/
+
+// defaultTransactionTimeout is how long an open transaction may go without appends when the config doesn't say.
+const defaultTransactionTimeout = time.Minute
+
+type transactions struct {
+	timeout time.Duration
+	open    map[uint64]*transaction
+	// the aborted transactions, by the offset of their abort marker
+	aborted map[uint64]uint64
+}
+
+type transaction struct {
+	// the offset of the transaction's first record, if it has any
+	first      uint64
+	hasRecords bool
+	// when the transaction is aborted if it doesn't append or end before then
+	deadline time.Time
+}
+
+func newTransactions(timeout time.Duration) *transactions {
+	if timeout <= 0 {
+		timeout = defaultTransactionTimeout
+	}
+	return &transactions{
+		timeout: timeout,
+		open:    make(map[uint64]*transaction),
+		aborted: make(map[uint64]uint64),
+	}
+}
+
+func (t *transactions) has(id uint64) bool {
+	_, open := t.open[id]
+	_, aborted := t.aborted[id]
+	return open || aborted
+}
+
+func (t *transactions) begin(id uint64) {
+	t.open[id] = &transaction{deadline: time.Now().Add(t.timeout)}
+}
+
+// check returns ErrUnknownTransaction if the record belongs to a transaction that isn't open.
+func (t *transactions) check(record *api.Record) error {
+	if record.TransactionId == 0 {
+		return nil
+	}
+	if _, ok := t.open[record.TransactionId]; !ok {
+		return api.ErrUnknownTransaction{TransactionID: record.TransactionId}
+	}
+	return nil
+}
+
+// add updates the transactions with an appended record.
+func (t *transactions) add(record *api.Record) {
+	id := record.TransactionId
+	if id == 0 {
+		return
+	}
+
+	switch record.Control {
+	case api.ControlType_CONTROL_COMMIT:
+		delete(t.open, id)
+	case api.ControlType_CONTROL_ABORT:
+		delete(t.open, id)
+		t.aborted[id] = record.Offset
+	default:
+		txn, ok := t.open[id]
+		if !ok {
+			// the transaction began before the log restarted
+			txn = &transaction{}
+			t.open[id] = txn
+		}
+		if !txn.hasRecords {
+			txn.first, txn.hasRecords = record.Offset, true
+		}
+		txn.deadline = time.Now().Add(t.timeout)
+	}
+}
+
+// stableOffset returns the offset of the first record of the oldest open transaction,
+// or end if no open transaction has records.
+func (t *transactions) stableOffset(end uint64) uint64 {
+	stable := end
+	for _, txn := range t.open {
+		if txn.hasRecords && txn.first < stable {
+			stable = txn.first
+		}
+	}
+	return stable
+}
+
+// expired returns the IDs of the open transactions that went past their deadline.
+func (t *transactions) expired(now time.Time) []uint64 {
+	var ids []uint64
+	for id, txn := range t.open {
+		if now.After(txn.deadline) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// truncate forgets the aborted transactions whose records were all truncated.
+func (t *transactions) truncate(lowest uint64) {
+	for id, marker := range t.aborted {
+		if marker < lowest {
+			delete(t.aborted, id)
+		}
+	}
+}
+
+// BeginTransaction starts a transaction and returns its ID.
+func (l *Log) BeginTransaction() (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.expireTransactions(); err != nil {
+		return 0, err
+	}
+	id := randomID(l.txns.has)
+	l.txns.begin(id)
+	return id, nil
+}
+
+// CommitTransaction commits the transaction, making its records visible to read-committed consumers,
+// and returns the offset of its commit marker.
+func (l *Log) CommitTransaction(id uint64) (uint64, error) {
+	return l.endTransaction(id, api.ControlType_CONTROL_COMMIT)
+}
+
+// AbortTransaction aborts the transaction, so read-committed consumers never see its records,
+// and returns the offset of its abort marker.
+func (l *Log) AbortTransaction(id uint64) (uint64, error) {
+	return l.endTransaction(id, api.ControlType_CONTROL_ABORT)
+}
+
+func (l *Log) endTransaction(id uint64, control api.ControlType) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.appendMarker(id, control)
+}
+
+// appendMarker appends the marker that ends the transaction. The caller must hold the log's write lock.
+func (l *Log) appendMarker(id uint64, control api.ControlType) (uint64, error) {
+	if _, ok := l.txns.open[id]; !ok {
+		return 0, api.ErrUnknownTransaction{TransactionID: id}
+	}
+	return l.write(&api.Record{TransactionId: id, Control: control})
+}
+
+// expireTransactions aborts the open transactions that went past their deadline,
+// so an abandoned transaction doesn't hold read-committed consumers back forever.
+// The caller must hold the log's write lock.
+func (l *Log) expireTransactions() error {
+	for _, id := range l.txns.expired(time.Now()) {
+		if _, err := l.appendMarker(id, api.ControlType_CONTROL_ABORT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortOpenTransactions aborts the transactions left open when the log stopped.
+func (l *Log) abortOpenTransactions() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id := range l.txns.open {
+		if _, err := l.appendMarker(id, api.ControlType_CONTROL_ABORT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stableOffset returns the offset read-committed consumers read up to.
+func (l *Log) stableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.txns.stableOffset(l.segments[len(l.segments)-1].nextOffset)
+}
+
+// committed reports whether a read-committed consumer sees the record.
+func (l *Log) committed(record *api.Record) bool {
+	if record.Control != api.ControlType_CONTROL_NONE {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if record.Offset >= l.txns.stableOffset(l.segments[len(l.segments)-1].nextOffset) {
+		return false
+	}
+	if record.TransactionId == 0 {
+		return true
+	}
+	_, aborted := l.txns.aborted[record.TransactionId]
+	return !aborted
+}
@@ -0,0 +1,142 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+)
+
+func TestTransactions(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+
+	produce := func(value string, txn uint64) uint64 {
+		t.Helper()
+		off, err := log.Append(&api.Record{Value: []byte(value), TransactionId: txn})
+		require.NoError(t, err)
+		return off
+	}
+	committed := func(log *Log) []string {
+		t.Helper()
+		it := log.Iterator()
+		it.SetIsolation(api.IsolationLevel_READ_COMMITTED)
+		var values []string
+		for it.Next() {
+			values = append(values, string(it.Record().Value))
+		}
+		require.NoError(t, it.Err())
+		return values
+	}
+
+	committing, err := log.BeginTransaction()
+	require.NoError(t, err)
+	aborting, err := log.BeginTransaction()
+	require.NoError(t, err)
+	produce("before", 0)
+	produce("committed 1", committing)
+	produce("outside", 0)
+	produce("aborted", aborting)
+	produce("committed 2", committing)
+
+	// only committing or aborting a transaction appends its marker
+	_, err = log.Append(&api.Record{TransactionId: aborting, Control: api.ControlType_CONTROL_COMMIT})
+	require.Equal(t, api.ErrControlRecord{Control: api.ControlType_CONTROL_COMMIT}, err)
+
+	// read-committed consumers stop at the first record of the oldest open transaction
+	require.Equal(t, []string{"before"}, committed(log))
+
+	_, err = log.AbortTransaction(aborting)
+	require.NoError(t, err)
+	require.Equal(t, []string{"before"}, committed(log))
+	_, err = log.CommitTransaction(committing)
+	require.NoError(t, err)
+	want := []string{"before", "committed 1", "outside", "committed 2"}
+	require.Equal(t, want, committed(log))
+
+	// read-uncommitted consumers see every record, markers included
+	it := log.Iterator()
+	var n int
+	for it.Next() {
+		n++
+	}
+	require.Equal(t, 7, n)
+
+	// read-committed consumers skip the same records going backwards
+	it = log.Iterator()
+	it.SetIsolation(api.IsolationLevel_READ_COMMITTED)
+	it.Seek(7)
+	var reversed []string
+	for it.Prev() {
+		reversed = append([]string{string(it.Record().Value)}, reversed...)
+	}
+	require.Equal(t, want, reversed)
+
+	// ended and unknown transactions can't be produced to or ended again
+	_, err = log.Append(&api.Record{Value: write, TransactionId: committing})
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: committing}, err)
+	_, err = log.CommitTransaction(aborting)
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: aborting}, err)
+
+	// the transactions are rebuilt when the log restarts, and the ones left open are aborted
+	open, err := log.BeginTransaction()
+	require.NoError(t, err)
+	produce("left open", open)
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, want, committed(log))
+	_, err = log.Append(&api.Record{Value: write, TransactionId: open})
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: open}, err)
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	c := Config{}
+	c.Transactions.Timeout = time.Millisecond
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	txn, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: write, TransactionId: txn})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	_, err = log.CommitTransaction(txn)
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: txn}, err)
+
+	// the abandoned transaction no longer holds read-committed consumers back
+	it := log.Iterator()
+	it.SetIsolation(api.IsolationLevel_READ_COMMITTED)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(2), it.Record().Offset)
+}
+
+func TestAppendIfExpiresTransactionsFirst(t *testing.T) {
+	c := Config{}
+	c.Transactions.Timeout = time.Millisecond
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	txn, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: write, TransactionId: txn})
+	require.NoError(t, err)
+
+	// the expired transaction's abort marker takes offset 1, so the record can't land where expected
+	time.Sleep(10 * time.Millisecond)
+	_, err = log.AppendIf(&api.Record{Value: write}, 1)
+	require.Equal(t, api.ErrOffsetConflict{Expected: 1, Actual: 2}, err)
+
+	off, err := log.AppendIf(&api.Record{Value: write}, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
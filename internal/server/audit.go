@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+/*
+The server audits every authorization decision it makes: who asked to do what to which log, whether the ACL let them,
+and, for the requests it let through, how they ended and the offsets they produced to or consumed from.
+Denials are audited when the server makes them; requests it let through are audited once they're done, so their events
+can hold the offsets. A stream is audited once, with the offset it starts at, rather than once per record.
+The events go to the server's AuditSink, like a file of JSON lines, or a log of their own that the sink appends
+to directly, so writing an event doesn't go through the server and set off another authorization to audit.
+*/
+
+// The decisions of audit events.
+const (
+	DecisionAllow = "allow"
+	DecisionDeny  = "deny"
+)
+
+// AuditEvent records an authorization decision and, for requests the server let through, how they ended.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Subject  string    `json:"subject"`
+	Action   string    `json:"action"`
+	Object   string    `json:"object"`
+	Decision string    `json:"decision"`
+	// the RPC's full method name and the client's address
+	Method string `json:"method"`
+	Peer   string `json:"peer"`
+	// the offsets the request produced to or consumed from, or the offset a stream started at
+	Offsets []uint64 `json:"offsets,omitempty"`
+	// why the request failed after the server let it through
+	Error string `json:"error,omitempty"`
+}
+
+// AuditSink stores audit events. Audit may be called concurrently.
+type AuditSink interface {
+	Audit(event AuditEvent) error
+}
+
+// authorize checks that the client may perform the action on the object, the topic of the log the request is for,
+// and returns the event that the caller audits once the request is done. It audits denials itself.
+func (g *grpcServer) authorize(ctx context.Context, object, action string) (AuditEvent, error) {
+	event := AuditEvent{
+		Time:     time.Now(),
+		Subject:  subject(ctx),
+		Action:   action,
+		Object:   object,
+		Decision: DecisionAllow,
+	}
+	event.Method, _ = grpc.Method(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		event.Peer = p.Addr.String()
+	}
+
+	err := g.Authorizer.Authorize(event.Subject, event.Object, action)
+	if err != nil {
+		var denied api.ErrPermissionDenied
+		if errors.As(err, &denied) {
+			event.Decision = DecisionDeny
+			g.audit(event, nil)
+		}
+		return event, err
+	}
+	return event, nil
+}
+
+// audit sends the event of a request the server let through to the audit sink, with the request's error or offsets.
+func (g *grpcServer) audit(event AuditEvent, err error, offsets ...uint64) {
+	if g.AuditSink == nil {
+		return
+	}
+	if err != nil {
+		event.Error = err.Error()
+	} else {
+		event.Offsets = offsets
+	}
+	if err := g.AuditSink.Audit(event); err != nil {
+		g.metrics.auditErrors.Inc()
+	}
+}
+
+// AuditSinks sends audit events to every one of its sinks.
+type AuditSinks []AuditSink
+
+// Audit implements AuditSink.
+func (s AuditSinks) Audit(event AuditEvent) error {
+	var errs []error
+	for _, sink := range s {
+		errs = append(errs, sink.Audit(event))
+	}
+	return errors.Join(errs...)
+}
+
+var _ AuditSink = (*FileAuditSink)(nil)
+
+// FileAuditSink appends audit events to a file as lines of JSON.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: f}, nil
+}
+
+// Audit implements AuditSink.
+func (s *FileAuditSink) Audit(event AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+var _ AuditSink = (*LogAuditSink)(nil)
+
+// LogAuditSink appends audit events to a log as records whose value is the event's JSON, whose key is the subject,
+// and whose headers hold the action and decision, so consumers can filter on them.
+// The log should be one of its own rather than the one the server serves, so clients don't consume audit events as data.
+type LogAuditSink struct {
+	Log interface {
+		Append(record *api.Record) (uint64, error)
+	}
+}
+
+// Audit implements AuditSink.
+func (s *LogAuditSink) Audit(event AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.Log.Append(&api.Record{
+		Value: b,
+		Key:   []byte(event.Subject),
+		Headers: map[string]string{
+			"action":   event.Action,
+			"decision": event.Decision,
+		},
+		Timestamp: event.Time.UnixMilli(),
+	})
+	return err
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"github.com/ttaaoo/proglog/internal/log"
+)
+
+// auditRecorder is an AuditSink that keeps the events in memory.
+type auditRecorder struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (r *auditRecorder) Audit(event AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *auditRecorder) Events() []AuditEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]AuditEvent(nil), r.events...)
+}
+
+func TestAudit(t *testing.T) {
+	recorder := &auditRecorder{}
+	root, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.AuditSink = recorder
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = root.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = root.Consume(ctx, &api.ConsumeRequest{Offset: 5})
+	require.Error(t, err)
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Error(t, err)
+	_, err = root.ConsumeStream(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_LATEST})
+	require.NoError(t, err)
+	// the stream is audited once it has started
+	require.Eventually(t, func() bool { return len(recorder.Events()) == 5 }, time.Second, 10*time.Millisecond)
+
+	type want struct {
+		subject, action, decision, method string
+		offsets                           []uint64
+		failed                            bool
+	}
+	wants := []want{
+		{"root", produceAction, DecisionAllow, "/log.v1.Log/Produce", []uint64{0}, false},
+		{"root", consumeAction, DecisionAllow, "/log.v1.Log/Consume", []uint64{0}, false},
+		{"root", consumeAction, DecisionAllow, "/log.v1.Log/Consume", nil, true},
+		{"nobody", produceAction, DecisionDeny, "/log.v1.Log/Produce", nil, false},
+		{"root", consumeAction, DecisionAllow, "/log.v1.Log/ConsumeStream", []uint64{1}, false},
+	}
+	for i, event := range recorder.Events() {
+		w := wants[i]
+		require.Equal(t, w.subject, event.Subject, i)
+		require.Equal(t, w.action, event.Action, i)
+		require.Equal(t, defaultTopic, event.Object, i)
+		require.Equal(t, w.decision, event.Decision, i)
+		require.Equal(t, w.method, event.Method, i)
+		require.Equal(t, w.offsets, event.Offsets, i)
+		require.Equal(t, w.failed, event.Error != "", i)
+		require.NotEmpty(t, event.Peer, i)
+		require.False(t, event.Time.IsZero(), i)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	require.NoError(t, err)
+	events := []AuditEvent{
+		{Time: time.UnixMilli(1000).UTC(), Subject: "root", Action: produceAction, Decision: DecisionAllow, Offsets: []uint64{7}},
+		{Time: time.UnixMilli(2000).UTC(), Subject: "nobody", Action: consumeAction, Decision: DecisionDeny},
+	}
+	for _, event := range events {
+		require.NoError(t, sink.Audit(event))
+	}
+	require.NoError(t, sink.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var got []AuditEvent
+	for scanner.Scan() {
+		var event AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		got = append(got, event)
+	}
+	require.Equal(t, events, got)
+}
+
+func TestLogAuditSink(t *testing.T) {
+	auditLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	sink := &LogAuditSink{Log: auditLog}
+	event := AuditEvent{Time: time.UnixMilli(1000).UTC(), Subject: "nobody", Action: produceAction, Decision: DecisionDeny}
+	require.NoError(t, sink.Audit(event))
+
+	record, err := auditLog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("nobody"), record.Key)
+	require.Equal(t, map[string]string{"action": produceAction, "decision": DecisionDeny}, record.Headers)
+	require.Equal(t, int64(1000), record.Timestamp)
+	var got AuditEvent
+	require.NoError(t, json.Unmarshal(record.Value, &got))
+	require.Equal(t, event, got)
+}
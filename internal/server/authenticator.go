@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Authenticator identifies the client of an RPC from its credentials. It returns the empty subject and no error
+// if the RPC doesn't carry the kind of credentials it checks, so the next authenticator can try,
+// and api.ErrUnauthenticated if the credentials are invalid.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (subject string, err error)
+}
+
+var _ Authenticator = TLSAuthenticator{}
+
+// TLSAuthenticator identifies clients by the common name of the certificate they connected with over mutual TLS.
+type TLSAuthenticator struct{}
+
+// Authenticate implements Authenticator.
+func (TLSAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	peer, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo)
+	// the server only verifies the certificates of clients that send one, depending on its TLS config
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+	// extract the subject from the client's cert
+	return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName, nil
+}
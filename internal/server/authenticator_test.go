@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// authenticatorFunc adapts a function to Authenticator.
+type authenticatorFunc func(ctx context.Context) (string, error)
+
+func (f authenticatorFunc) Authenticate(ctx context.Context) (string, error) { return f(ctx) }
+
+// tokenAuthenticator stands in for a bearer token authenticator: the token is the subject, and "bad" is invalid.
+var tokenAuthenticator = authenticatorFunc(func(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("authorization")
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	if tokens[0] == "bad" {
+		return "", api.ErrUnauthenticated{Cause: "bad token"}
+	}
+	return tokens[0], nil
+})
+
+func TestAuthenticatorChain(t *testing.T) {
+	_, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.Authenticators = []Authenticator{tokenAuthenticator, TLSAuthenticator{}}
+	})
+	defer teardown()
+
+	produce := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	// without a token, the client's certificate identifies it
+	_, err := nobody.Produce(context.Background(), produce)
+	require.Equal(t, api.ErrPermissionDenied{Subject: "nobody", Object: defaultTopic, Action: produceAction}, api.FromError(err))
+
+	// a token takes precedence over the certificate
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "root")
+	_, err = nobody.Produce(ctx, produce)
+	require.NoError(t, err)
+
+	// invalid credentials fail the RPC instead of falling through to the next authenticator
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "bad")
+	_, err = nobody.Produce(ctx, produce)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, api.ErrUnauthenticated{Cause: "bad token"}, api.FromError(err))
+
+	stream, err := nobody.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+type otherAuthInfo struct{}
+
+func (otherAuthInfo) AuthType() string { return "other" }
+
+func TestTLSAuthenticator(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	cert := &x509.Certificate{}
+	cert.Subject.CommonName = "root"
+
+	for scenario, tc := range map[string]struct {
+		ctx     context.Context
+		subject string
+	}{
+		"no peer": {context.Background(), ""},
+		"other credentials": {
+			peer.NewContext(context.Background(), &peer.Peer{Addr: addr, AuthInfo: otherAuthInfo{}}),
+			"",
+		},
+		"no client certificate": {
+			peer.NewContext(context.Background(), &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{}}),
+			"",
+		},
+		"client certificate": {
+			peer.NewContext(context.Background(), &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{
+				State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			}}),
+			"root",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			subject, err := TLSAuthenticator{}.Authenticate(tc.ctx)
+			require.NoError(t, err)
+			require.Equal(t, tc.subject, subject)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"github.com/ttaaoo/proglog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+The errors the log returns on purpose are the typed errors of api/v1, which carry their own gRPC status.
+The error interceptors make sure nothing else reaches clients raw: they translate the log's own errors to
+their api/v1 counterparts, and turn the errors nobody expected into Internal statuses, so clients never see Unknown.
+*/
+
+func unaryErrorInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	resp, err := handler(ctx, req)
+	return resp, toStatus(err)
+}
+
+func streamErrorInterceptor(
+	srv any,
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return toStatus(handler(srv, ss))
+}
+
+// toStatus returns the error as one gRPC can send with a meaningful code.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, log.ErrReadOnly) {
+		// the log follows another process's writes, so the client should produce there
+		return api.ErrNotLeader{}
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
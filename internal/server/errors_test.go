@@ -0,0 +1,27 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"github.com/ttaaoo/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToStatus(t *testing.T) {
+	require.NoError(t, toStatus(nil))
+	require.Equal(t, api.ErrNotLeader{}, toStatus(fmt.Errorf("append: %w", log.ErrReadOnly)))
+	require.Equal(t, api.ErrDiskFull{}, toStatus(api.ErrDiskFull{}))
+	require.Equal(t, codes.Canceled, status.Code(toStatus(context.Canceled)))
+	require.Equal(t, codes.DeadlineExceeded, status.Code(toStatus(context.DeadlineExceeded)))
+
+	// errors nobody expected don't reach clients as Unknown
+	err := toStatus(io.EOF)
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Contains(t, err.Error(), io.EOF.Error())
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	api "github.com/ttaaoo/proglog/api/v1"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Streams can filter the records they send, so consumers that only want some records don't pay to receive
+and throw away the others. The server reads every record as usual and only skips sending the ones that don't
+match, so the stream's position in the log still advances past them. A filter's CEL expression is compiled
+once when the stream starts and evaluated with a cost limit, so an expensive expression can't stall the server.
+*/
+
+// filterCostLimit bounds how much work evaluating a filter's expression on one record may take, in CEL's cost units.
+const filterCostLimit = 10000
+
+// filterEnv declares the variables filter expressions can use.
+var filterEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("key", cel.BytesType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("timestamp", cel.TimestampType),
+	)
+})
+
+type filter struct {
+	headers   map[string]string
+	keyPrefix []byte
+	program   cel.Program
+}
+
+// newFilter compiles the request's filter. It returns nil, which matches every record, if the request has none.
+func newFilter(f *api.Filter) (*filter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	compiled := &filter{headers: f.Headers, keyPrefix: f.KeyPrefix}
+	if f.Expression == "" {
+		return compiled, nil
+	}
+
+	env, err := filterEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(f.Expression)
+	if issues.Err() != nil {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "invalid filter expression: %v", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, status.Errorf(
+			grpccodes.InvalidArgument,
+			"invalid filter expression: got type %v, want bool",
+			ast.OutputType(),
+		)
+	}
+	compiled.program, err = env.Program(ast, cel.CostLimit(filterCostLimit))
+	if err != nil {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "invalid filter expression: %v", err)
+	}
+	return compiled, nil
+}
+
+// match reports whether the record matches every condition of the filter.
+func (f *filter) match(record *api.Record) bool {
+	if f == nil {
+		return true
+	}
+	for k, v := range f.headers {
+		if got, ok := record.Headers[k]; !ok || got != v {
+			return false
+		}
+	}
+	if !bytes.HasPrefix(record.Key, f.keyPrefix) {
+		return false
+	}
+	if f.program == nil {
+		return true
+	}
+	headers := record.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	out, _, err := f.program.Eval(map[string]any{
+		"key":       record.Key,
+		"headers":   headers,
+		"timestamp": time.UnixMilli(record.Timestamp),
+	})
+	if err != nil {
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFilter(t *testing.T) {
+	order := &api.Record{
+		Key:       []byte("user-1"),
+		Headers:   map[string]string{"type": "order"},
+		Timestamp: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC).UnixMilli(),
+	}
+	refund := &api.Record{Key: []byte("user-2"), Headers: map[string]string{"type": "refund"}}
+	bare := &api.Record{}
+
+	for scenario, tc := range map[string]struct {
+		filter *api.Filter
+		match  []*api.Record
+	}{
+		"no filter": {
+			filter: nil,
+			match:  []*api.Record{order, refund, bare},
+		},
+		"header equality": {
+			filter: &api.Filter{Headers: map[string]string{"type": "order"}},
+			match:  []*api.Record{order},
+		},
+		"key prefix": {
+			filter: &api.Filter{KeyPrefix: []byte("user-")},
+			match:  []*api.Record{order, refund},
+		},
+		"expression": {
+			filter: &api.Filter{Expression: `headers["type"] == "order" && timestamp > timestamp("2024-01-01T00:00:00Z")`},
+			match:  []*api.Record{order},
+		},
+		"expression over the key": {
+			filter: &api.Filter{Expression: `key.size() == 0`},
+			match:  []*api.Record{bare},
+		},
+		"every condition": {
+			filter: &api.Filter{KeyPrefix: []byte("user-"), Expression: `headers["type"] != "order"`},
+			match:  []*api.Record{refund},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := newFilter(tc.filter)
+			require.NoError(t, err)
+			for _, record := range []*api.Record{order, refund, bare} {
+				require.Equal(t, contains(tc.match, record), f.match(record), "key %q", record.Key)
+			}
+		})
+	}
+
+	for _, expr := range []string{`headers[`, `key`, `unknown == 1`} {
+		_, err := newFilter(&api.Filter{Expression: expr})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), expr)
+	}
+}
+
+func contains(records []*api.Record, record *api.Record) bool {
+	for _, r := range records {
+		if r == record {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConsumeStreamFilter(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i, typ := range []string{"order", "refund", "refund", "order", "refund"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{
+			Value:   []byte("hello world"),
+			Key:     []byte{byte('a' + i)},
+			Headers: map[string]string{"type": typ},
+		}})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Filter:        &api.Filter{Headers: map[string]string{"type": "order"}},
+		MaxBatchBytes: 1 << 20,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, uint64(0), res.Records[0].Offset)
+	require.Equal(t, uint64(3), res.Records[1].Offset)
+
+	// the stream skipped the refunds, so the next record it sends is the next order
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Headers: map[string]string{"type": "order"}}})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(5), res.Records[0].Offset)
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Filter: &api.Filter{Expression: `key == b"c"`}})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Filter: &api.Filter{Expression: `headers[`}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
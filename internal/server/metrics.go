@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// metrics are the server's Prometheus metrics. The interceptors count and time every RPC,
+// labelled by its full method name and the code it returned.
+type metrics struct {
+	requests      *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	subscriptions prometheus.Gauge
+	slowConsumers prometheus.Counter
+	// what clients used of their quotas, and how often the server rejected or held back their requests, by subject and quota
+	quotaUsage     *prometheus.CounterVec
+	quotaThrottled *prometheus.CounterVec
+	auditErrors    prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_grpc_requests_total",
+			Help: "The number of RPCs the server handled, by method and code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proglog_grpc_request_duration_seconds",
+			Help:    "How long the server took to handle RPCs, by method. Streams count until they end.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		subscriptions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proglog_consume_stream_subscriptions",
+			Help: "The number of open ConsumeStream and Subscribe calls.",
+		}),
+		slowConsumers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_consume_stream_slow_consumers_total",
+			Help: "The number of streams the server disconnected because their consumer didn't take a response within the send timeout.",
+		}),
+		quotaUsage: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_quota_usage_total",
+			Help: "What clients used of their quotas, in bytes or requests, by subject and quota.",
+		}, []string{"subject", "quota"}),
+		quotaThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_quota_throttled_total",
+			Help: "The number of requests the server rejected or held back because the client was over its quota, by subject and quota.",
+		}, []string{"subject", "quota"}),
+		auditErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_audit_errors_total",
+			Help: "The number of audit events the server failed to store.",
+		}),
+	}
+}
+
+func (m *metrics) register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m.requests, m.latency, m.subscriptions, m.slowConsumers, m.quotaUsage, m.quotaThrottled, m.auditErrors} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *metrics) observe(method string, start time.Time, err error) {
+	m.requests.WithLabelValues(method, status.Code(err).String()).Inc()
+	m.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) unaryInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+func (m *metrics) streamInterceptor(
+	srv any,
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	m.observe(info.FullMethod, start, err)
+	return err
+}
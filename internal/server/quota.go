@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Quotas stop one client from saturating the server. Each client, identified by the subject authenticate reads
+from its certificate, gets its own token buckets for the bytes it produces, the bytes it consumes, and the requests it makes.
+Like Kafka's quotas, a client may go over a byte quota by one request, and then has to wait until it's paid the overage off:
+the server fails the client's unary calls with api.ErrQuotaExceeded, whose RetryInfo says how long to wait,
+and slows its streams down by holding their messages back until the client is within its quota again.
+A stream that would reach its deadline before then fails with api.ErrQuotaExceeded too.
+The server forgets the buckets of clients that have been idle for quotaIdleTimeout, and their metrics,
+once the buckets have filled up again, so they're the same as the new buckets the client would get.
+*/
+
+// Quota limits what a client may do per second. Zero fields don't limit.
+type Quota struct {
+	// ProduceBytes is how many bytes of records the client may produce per second.
+	ProduceBytes int
+	// ConsumeBytes is how many bytes of records the client may consume per second.
+	ConsumeBytes int
+	// Requests is how many requests the client may make per second,
+	// counting every RPC and every record produced on a stream.
+	Requests float64
+}
+
+// The names of the quotas, in metrics and api.ErrQuotaExceeded.
+const (
+	produceBytesQuota = "produce_bytes"
+	consumeBytesQuota = "consume_bytes"
+	requestsQuota     = "requests"
+)
+
+// quotaIdleTimeout is how long after a client's last request the server may forget its token buckets.
+const quotaIdleTimeout = 10 * time.Minute
+
+// quotaLimiters are one client's token buckets, nil for the quotas that don't limit it.
+type quotaLimiters struct {
+	produceBytes *rate.Limiter
+	consumeBytes *rate.Limiter
+	requests     *rate.Limiter
+	// when the client last made a request, and how many of its streams are open, guarded by quotas.mu
+	lastUsed time.Time
+	streams  int
+}
+
+// full reports whether the buckets hold all the tokens they can, as new buckets do.
+func (l *quotaLimiters) full() bool {
+	for _, limiter := range []*rate.Limiter{l.produceBytes, l.consumeBytes, l.requests} {
+		if limiter != nil && limiter.Tokens() < float64(limiter.Burst()) {
+			return false
+		}
+	}
+	return true
+}
+
+type quotas struct {
+	// the quotas by subject, with the quota of subjects that don't have their own under objectWildcard
+	config  map[string]Quota
+	metrics *metrics
+
+	mu       sync.Mutex
+	limiters map[string]*quotaLimiters
+	// when the server last looked for idle clients to forget
+	lastEviction time.Time
+}
+
+func newQuotas(config map[string]Quota, metrics *metrics) *quotas {
+	return &quotas{
+		config:   config,
+		metrics:  metrics,
+		limiters: make(map[string]*quotaLimiters),
+	}
+}
+
+// limitersFor returns the subject's token buckets, or nil if no quota applies to the subject.
+func (q *quotas) limitersFor(subject string) *quotaLimiters {
+	quota, ok := q.config[subject]
+	if !ok {
+		if quota, ok = q.config[objectWildcard]; !ok {
+			return nil
+		}
+	}
+	if quota == (Quota{}) {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.evictIdle(now)
+	l, ok := q.limiters[subject]
+	if !ok {
+		l = &quotaLimiters{
+			produceBytes: newLimiter(float64(quota.ProduceBytes)),
+			consumeBytes: newLimiter(float64(quota.ConsumeBytes)),
+			requests:     newLimiter(quota.Requests),
+		}
+		q.limiters[subject] = l
+	}
+	l.lastUsed = now
+	return l
+}
+
+// evictIdle forgets the buckets and metrics of the clients without open streams that have been idle
+// for quotaIdleTimeout and whose buckets are full. It looks for them at most once per quotaIdleTimeout.
+// The caller must hold q.mu.
+func (q *quotas) evictIdle(now time.Time) {
+	if now.Sub(q.lastEviction) < quotaIdleTimeout {
+		return
+	}
+	q.lastEviction = now
+	for subject, l := range q.limiters {
+		if l.streams > 0 || now.Sub(l.lastUsed) < quotaIdleTimeout || !l.full() {
+			continue
+		}
+		delete(q.limiters, subject)
+		q.metrics.quotaUsage.DeletePartialMatch(prometheus.Labels{"subject": subject})
+		q.metrics.quotaThrottled.DeletePartialMatch(prometheus.Labels{"subject": subject})
+	}
+}
+
+// openStream and closeStream count the client's open streams, whose buckets the server keeps while they're open.
+func (q *quotas) openStream(l *quotaLimiters) {
+	q.mu.Lock()
+	l.streams++
+	q.mu.Unlock()
+}
+
+func (q *quotas) closeStream(l *quotaLimiters) {
+	q.mu.Lock()
+	l.streams--
+	l.lastUsed = time.Now()
+	q.mu.Unlock()
+}
+
+// newLimiter returns a token bucket that holds a second's worth of tokens, or nil if perSecond doesn't limit.
+func newLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), int(math.Max(1, math.Ceil(perSecond))))
+}
+
+// quotaDirection tells which byte quota an RPC counts against.
+type quotaDirection int
+
+const (
+	noDirection quotaDirection = iota
+	produceDirection
+	consumeDirection
+)
+
+// direction returns which byte quota the method counts against. Methods of services other than the log's,
+// like health checks, return false: quotas don't apply to them.
+func direction(fullMethod string) (quotaDirection, bool) {
+	method, ok := strings.CutPrefix(fullMethod, "/"+api.Log_ServiceDesc.ServiceName+"/")
+	if !ok {
+		return noDirection, false
+	}
+	switch method {
+	case "Produce", "ProduceStream":
+		return produceDirection, true
+	case "Consume", "ConsumeStream", "Subscribe":
+		return consumeDirection, true
+	}
+	return noDirection, true
+}
+
+func (l *quotaLimiters) bytes(dir quotaDirection) (*rate.Limiter, string) {
+	switch dir {
+	case produceDirection:
+		return l.produceBytes, produceBytesQuota
+	case consumeDirection:
+		return l.consumeBytes, consumeBytesQuota
+	}
+	return nil, ""
+}
+
+// admit counts a request against the subject's quotas, or returns api.ErrQuotaExceeded
+// if the subject is over its request quota or the byte quota of the request's direction.
+func (q *quotas) admit(subject string, l *quotaLimiters, dir quotaDirection) error {
+	var reservation *rate.Reservation
+	if l.requests != nil {
+		reservation = l.requests.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			return q.exceeded(subject, requestsQuota, delay)
+		}
+		q.metrics.quotaUsage.WithLabelValues(subject, requestsQuota).Inc()
+	}
+	if limiter, quota := l.bytes(dir); limiter != nil {
+		if delay := debt(limiter); delay > 0 {
+			if reservation != nil {
+				reservation.Cancel()
+			}
+			return q.exceeded(subject, quota, delay)
+		}
+	}
+	return nil
+}
+
+func (q *quotas) exceeded(subject, quota string, retryAfter time.Duration) error {
+	q.metrics.quotaThrottled.WithLabelValues(subject, quota).Inc()
+	return api.ErrQuotaExceeded{Subject: subject, Quota: quota, RetryAfter: retryAfter}
+}
+
+// charge takes n tokens from the limiter, going into debt if it doesn't have them.
+func (q *quotas) charge(subject, quota string, limiter *rate.Limiter, n int) {
+	if limiter == nil {
+		return
+	}
+	q.metrics.quotaUsage.WithLabelValues(subject, quota).Add(float64(n))
+	now := time.Now()
+	// ReserveN refuses to take more than the bucket holds at once, so we take large charges a bucket at a time
+	for n > 0 {
+		take := min(n, limiter.Burst())
+		limiter.ReserveN(now, take)
+		n -= take
+	}
+}
+
+// throttle holds a stream's message back until the subject has paid off its debt on the limiters.
+// It returns api.ErrQuotaExceeded if the stream's deadline comes before then,
+// and the status of the stream's context if the stream ends while it waits.
+func (q *quotas) throttle(ctx context.Context, subject string, limiters map[string]*rate.Limiter) error {
+	var (
+		delay time.Duration
+		over  string
+	)
+	for quota, limiter := range limiters {
+		if d := debt(limiter); d > 0 {
+			q.metrics.quotaThrottled.WithLabelValues(subject, quota).Inc()
+			if d > delay {
+				delay, over = d, quota
+			}
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return api.ErrQuotaExceeded{Subject: subject, Quota: over, RetryAfter: delay}
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// debt returns how long until the limiter has paid off the tokens it went into debt for, or zero if it's not in debt.
+func debt(limiter *rate.Limiter) time.Duration {
+	if limiter == nil {
+		return 0
+	}
+	tokens := limiter.Tokens()
+	if tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / float64(limiter.Limit()) * float64(time.Second))
+}
+
+func (q *quotas) unaryInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	dir, ok := direction(info.FullMethod)
+	if !ok {
+		return handler(ctx, req)
+	}
+	subject := subject(ctx)
+	l := q.limitersFor(subject)
+	if l == nil {
+		return handler(ctx, req)
+	}
+	if err := q.admit(subject, l, dir); err != nil {
+		return nil, err
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	limiter, quota := l.bytes(dir)
+	switch dir {
+	case produceDirection:
+		q.charge(subject, quota, limiter, recordBytes(req.(*api.ProduceRequest)))
+	case consumeDirection:
+		q.charge(subject, quota, limiter, proto.Size(resp.(*api.ConsumeResponse)))
+	}
+	return resp, nil
+}
+
+func (q *quotas) streamInterceptor(
+	srv any,
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	dir, ok := direction(info.FullMethod)
+	if !ok {
+		return handler(srv, ss)
+	}
+	subject := subject(ss.Context())
+	l := q.limitersFor(subject)
+	if l == nil {
+		return handler(srv, ss)
+	}
+	if err := q.admit(subject, l, dir); err != nil {
+		return err
+	}
+	q.openStream(l)
+	defer q.closeStream(l)
+	qs := &quotaStream{ServerStream: ss, quotas: q, subject: subject, limiters: l}
+	qs.ctx = context.WithValue(ss.Context(), quotaStreamContextKey{}, qs)
+	return handler(srv, qs)
+}
+
+// quotaStream charges the messages of a stream against its client's quotas and throttles the stream
+// while the client is over them.
+type quotaStream struct {
+	grpc.ServerStream
+	// the stream's context, which waitQuota finds the stream in
+	ctx      context.Context
+	quotas   *quotas
+	subject  string
+	limiters *quotaLimiters
+}
+
+// RecvMsg charges the records of produce streams against the client's request and produce quotas,
+// and holds them back while the client is over either.
+func (s *quotaStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	req, ok := m.(*api.ProduceRequest)
+	if !ok {
+		return nil
+	}
+	s.quotas.charge(s.subject, requestsQuota, s.limiters.requests, max(1, len(req.Records)))
+	s.quotas.charge(s.subject, produceBytesQuota, s.limiters.produceBytes, recordBytes(req))
+	return s.quotas.throttle(s.Context(), s.subject, map[string]*rate.Limiter{
+		requestsQuota:     s.limiters.requests,
+		produceBytesQuota: s.limiters.produceBytes,
+	})
+}
+
+// SendMsg charges the responses of consume streams against the client's consume quota. The stream waits until the client
+// is within its quota before it reads the next batch, in waitQuota, rather than here, so the wait doesn't count toward the send timeout.
+func (s *quotaStream) SendMsg(m any) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	if res, ok := m.(*api.ConsumeResponse); ok {
+		s.quotas.charge(s.subject, consumeBytesQuota, s.limiters.consumeBytes, proto.Size(res))
+	}
+	return nil
+}
+
+// recordBytes returns the size of the request's record, or of its batch of records, which the produce quota counts.
+func recordBytes(req *api.ProduceRequest) int {
+	n := proto.Size(req.Record)
+	for _, record := range req.Records {
+		n += proto.Size(record)
+	}
+	return n
+}
+
+func (s *quotaStream) Context() context.Context {
+	return s.ctx
+}
+
+type quotaStreamContextKey struct{}
+
+// waitQuota waits until the client of the stream whose context it is has paid off its consume quota's debt.
+// It fails like throttle if the stream can't wait that long.
+func waitQuota(ctx context.Context) error {
+	s, ok := ctx.Value(quotaStreamContextKey{}).(*quotaStream)
+	if !ok {
+		return nil
+	}
+	return s.quotas.throttle(ctx, s.subject, map[string]*rate.Limiter{
+		consumeBytesQuota: s.limiters.consumeBytes,
+	})
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotas(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		quotas map[string]Quota
+		fn     func(t *testing.T, root, nobody api.LogClient, config *Config)
+	}{
+		"requests over the quota fail": {
+			quotas: map[string]Quota{"root": {Requests: 2}},
+			fn:     testRequestQuota,
+		},
+		"produce bytes over the quota fail": {
+			quotas: map[string]Quota{objectWildcard: {ProduceBytes: 100}},
+			fn:     testProduceBytesQuota,
+		},
+		"batches count against the produce quota": {
+			quotas: map[string]Quota{objectWildcard: {ProduceBytes: 100}},
+			fn:     testProduceBatchBytesQuota,
+		},
+		"streams over the consume quota slow down": {
+			quotas: map[string]Quota{"root": {ConsumeBytes: 10000}},
+			fn:     testConsumeBytesQuota,
+		},
+		"streams that can't wait for the consume quota fail": {
+			quotas: map[string]Quota{"root": {ConsumeBytes: 10000}},
+			fn:     testConsumeBytesQuotaDeadline,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			root, nobody, config, teardown := setupTest(t, func(c *Config) {
+				c.Quotas = tc.quotas
+			})
+			defer teardown()
+			tc.fn(t, root, nobody, config)
+		})
+	}
+}
+
+func testRequestQuota(t *testing.T, root, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	for i := 0; i < 2; i++ {
+		_, err := root.Produce(ctx, produce)
+		require.NoError(t, err)
+	}
+	_, err := root.Produce(ctx, produce)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	var exceeded api.ErrQuotaExceeded
+	require.ErrorAs(t, api.FromError(err), &exceeded)
+	require.Equal(t, "root", exceeded.Subject)
+	require.Equal(t, requestsQuota, exceeded.Quota)
+	require.Greater(t, exceeded.RetryAfter, time.Duration(0))
+	require.LessOrEqual(t, exceeded.RetryAfter, time.Second)
+
+	// the quota is root's alone, so other clients aren't limited
+	for i := 0; i < 3; i++ {
+		_, err = nobody.Consume(ctx, &api.ConsumeRequest{})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+
+	// the client may retry once the retry delay passed
+	time.Sleep(exceeded.RetryAfter)
+	_, err = root.Produce(ctx, produce)
+	require.NoError(t, err)
+
+	require.Equal(t, 3.0, quotaMetric(t, config, "proglog_quota_usage_total", requestsQuota))
+	require.Equal(t, 1.0, quotaMetric(t, config, "proglog_quota_throttled_total", requestsQuota))
+}
+
+func testProduceBytesQuota(t *testing.T, root, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+	// the client may go over its quota with one request, but has to wait until it's paid the overage off
+	_, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: bytes.Repeat([]byte("a"), 150)}})
+	require.NoError(t, err)
+	_, err = root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("a")}})
+	var exceeded api.ErrQuotaExceeded
+	require.ErrorAs(t, api.FromError(err), &exceeded)
+	require.Equal(t, produceBytesQuota, exceeded.Quota)
+	require.Greater(t, exceeded.RetryAfter, 200*time.Millisecond)
+}
+
+func testProduceBatchBytesQuota(t *testing.T, root, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("a"), 50)
+	_, err := root.Produce(ctx, &api.ProduceRequest{Records: []*api.Record{{Value: value}, {Value: value}, {Value: value}}})
+	require.NoError(t, err)
+	_, err = root.Produce(ctx, &api.ProduceRequest{Records: []*api.Record{{Value: []byte("a")}}})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	var exceeded api.ErrQuotaExceeded
+	require.ErrorAs(t, api.FromError(err), &exceeded)
+	require.Equal(t, produceBytesQuota, exceeded.Quota)
+	require.Greater(t, quotaMetric(t, config, "proglog_quota_usage_total", produceBytesQuota), 150.0)
+}
+
+func testConsumeBytesQuota(t *testing.T, root, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("a"), 5000)
+	for i := 0; i < 4; i++ {
+		_, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+	}
+
+	// two records use up the second's worth of the quota, so the stream goes into debt with the third
+	// and holds the fourth back until the client has paid it off
+	start := time.Now()
+	stream, err := root.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	require.Greater(t, quotaMetric(t, config, "proglog_quota_usage_total", consumeBytesQuota), 20000.0)
+	require.GreaterOrEqual(t, quotaMetric(t, config, "proglog_quota_throttled_total", consumeBytesQuota), 1.0)
+}
+
+func testConsumeBytesQuotaDeadline(t *testing.T, root, _ api.LogClient, _ *Config) {
+	value := bytes.Repeat([]byte("a"), 5000)
+	for i := 0; i < 4; i++ {
+		_, err := root.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+	}
+
+	// the third record puts the stream half a second into debt, which is past the stream's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	stream, err := root.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	var exceeded api.ErrQuotaExceeded
+	require.ErrorAs(t, api.FromError(err), &exceeded)
+	require.Equal(t, consumeBytesQuota, exceeded.Quota)
+}
+
+// quotaMetric returns the value of root's counter for the quota.
+func quotaMetric(t *testing.T, config *Config, name, quota string) float64 {
+	t.Helper()
+	families, err := config.Registerer.(*prometheus.Registry).Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["subject"] == "root" && labels["quota"] == quota {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestDirection(t *testing.T) {
+	for method, want := range map[string]quotaDirection{
+		"/log.v1.Log/Produce":          produceDirection,
+		"/log.v1.Log/ProduceStream":    produceDirection,
+		"/log.v1.Log/Consume":          consumeDirection,
+		"/log.v1.Log/ConsumeStream":    consumeDirection,
+		"/log.v1.Log/Subscribe":        consumeDirection,
+		"/log.v1.Log/BeginTransaction": noDirection,
+	} {
+		got, ok := direction(method)
+		require.True(t, ok, method)
+		require.Equal(t, want, got, method)
+	}
+	_, ok := direction("/grpc.health.v1.Health/Check")
+	require.False(t, ok)
+}
+
+func TestThrottle(t *testing.T) {
+	q := newQuotas(nil, newMetrics())
+	limiter := newLimiter(100)
+	// a second's worth of debt
+	q.charge("root", consumeBytesQuota, limiter, 200)
+	limiters := map[string]*rate.Limiter{consumeBytesQuota: limiter}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var exceeded api.ErrQuotaExceeded
+	require.ErrorAs(t, q.throttle(ctx, "root", limiters), &exceeded)
+	require.Equal(t, consumeBytesQuota, exceeded.Quota)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	require.Equal(t, codes.Canceled, status.Code(q.throttle(ctx, "root", limiters)))
+}
+
+func TestQuotaEviction(t *testing.T) {
+	m := newMetrics()
+	q := newQuotas(map[string]Quota{objectWildcard: {Requests: 10}}, m)
+	idle := q.limitersFor("idle")
+	require.NoError(t, q.admit("idle", idle, noDirection))
+	indebted := q.limitersFor("indebted")
+	q.charge("indebted", requestsQuota, indebted.requests, 1000)
+	streaming := q.limitersFor("streaming")
+	q.openStream(streaming)
+	require.Eventually(t, idle.full, time.Second, 10*time.Millisecond)
+
+	// an idle timeout later, only the client whose buckets are as good as new is forgotten
+	q.mu.Lock()
+	q.lastEviction = q.lastEviction.Add(-quotaIdleTimeout)
+	for _, l := range q.limiters {
+		l.lastUsed = l.lastUsed.Add(-quotaIdleTimeout)
+	}
+	q.mu.Unlock()
+	q.limitersFor("other")
+	require.NotContains(t, q.limiters, "idle")
+	require.Contains(t, q.limiters, "indebted")
+	require.Contains(t, q.limiters, "streaming")
+	require.Zero(t, testutil.ToFloat64(m.quotaUsage.WithLabelValues("idle", requestsQuota)))
+	require.Equal(t, 1000.0, testutil.ToFloat64(m.quotaUsage.WithLabelValues("indebted", requestsQuota)))
+}
@@ -2,27 +2,82 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 
 	api "github.com/ttaaoo/proglog/api/v1"
+	"github.com/ttaaoo/proglog/internal/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 )
 
 type CommitLog interface {
 	Append(record *api.Record) (uint64, error)
+	// AppendIf appends the record only if the log's next offset is the expected offset.
+	AppendIf(record *api.Record, expected uint64) (uint64, error)
+	// AppendBatch appends the records together, compressed if the log is configured to, and returns the first offset.
+	AppendBatch(records []*api.Record) (uint64, error)
 	Read(offset uint64) (*api.Record, error)
+	// Iterator returns an iterator that streams read through the log with.
+	Iterator() Iterator
+	// InitProducer returns a new ID for an idempotent producer.
+	InitProducer() (uint64, error)
+	BeginTransaction() (uint64, error)
+	CommitTransaction(id uint64) (uint64, error)
+	AbortTransaction(id uint64) (uint64, error)
+	LowestOffset() (uint64, error)
+	// Truncate removes the segments whose records are all below lowest.
+	Truncate(lowest uint64) error
+	// Reader reads the whole log as its segments store it, with encrypted records left encrypted,
+	// and PlaintextReader reads it with them decrypted.
+	Reader() io.Reader
+	PlaintextReader() io.Reader
+	// OffsetForTime returns the offset of the first record produced at or after the time.
+	OffsetForTime(t time.Time) (uint64, error)
+	// NextOffset returns the log's high watermark, which consume responses carry.
+	NextOffset() uint64
+	// Appended returns a channel that's closed once the log appends more records, which caught-up streams wait on.
+	Appended() <-chan struct{}
 }
 
+// Iterator walks a commit log's records in order, as *log.Iterator does.
+type Iterator interface {
+	// Seek moves the iterator so that Next reads the record at the offset.
+	Seek(offset uint64)
+	// SetIsolation sets which records of transactions the iterator returns.
+	SetIsolation(level api.IsolationLevel)
+	// Next reads the next record, returning false once it caught up with the log or on an error, which Err returns.
+	Next() bool
+	Record() *api.Record
+	Err() error
+}
+
+// LogCommitLog adapts *log.Log to CommitLog, whose Iterator returns the Iterator interface
+// rather than the log's concrete iterator.
+type LogCommitLog struct {
+	*log.Log
+}
+
+func (l LogCommitLog) Iterator() Iterator {
+	return l.Log.Iterator()
+}
+
+var _ CommitLog = LogCommitLog{}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
@@ -32,11 +87,37 @@ const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	truncateAction = "truncate"
+	decryptAction  = "decrypt"
 )
 
+// defaultTopic is the object the server authorizes requests on when Config.Topic isn't set.
+const defaultTopic = "log"
+
 type Config struct {
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	// Topic names the log the server serves. It's the object ACL policies grant actions on,
+	// so a policy on orders.* covers the servers of the orders.eu and orders.us topics. Defaults to "log".
+	Topic string
+	// Registerer registers the server's metrics. The server doesn't register them if it's nil.
+	Registerer prometheus.Registerer
+	// TracerProvider provides the tracer of the server's spans. The server uses the global provider if it's nil.
+	TracerProvider trace.TracerProvider
+	// Health reports whether the server is ready to serve, under the "" and log.v1.Log services of grpc.health.v1.
+	// Whoever runs the server sets the statuses; if it's nil, the server always reports SERVING.
+	Health *health.Server
+	// SendTimeout is how long a stream waits for its consumer to take a response before the server disconnects it
+	// with api.ErrSlowConsumer, so a stuck consumer doesn't pin the server's memory. Streams wait forever if it's zero.
+	SendTimeout time.Duration
+	// Quotas limit what each client may do per second, by the subject of the client's certificate.
+	// The quota under "*" applies to the clients without their own; clients without a quota aren't limited.
+	Quotas map[string]Quota
+	// Authenticators identify clients, in order: the first to return a subject identifies the client.
+	// Clients none of them identifies get the empty subject. Defaults to TLSAuthenticator.
+	Authenticators []Authenticator
+	// AuditSink stores the audit events of the server's authorization decisions. The server doesn't audit if it's nil.
+	AuditSink AuditSink
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -44,66 +125,349 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	metrics *metrics
+	quotas  *quotas
 }
 
 // Consume implements log_v1.LogServer.
 func (g *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := g.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		consumeAction,
-	); err != nil {
+	event, err := g.authorize(ctx, g.Topic, consumeAction)
+	if err != nil {
 		return nil, err
 	}
 
-	record, err := g.CommitLog.Read(req.Offset)
+	offset, err := g.startOffset(req)
 	if err != nil {
+		g.audit(event, err)
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, nil
+	record, err := g.read(req, offset)
+	if offset, ok := g.reset(req, err); ok {
+		record, err = g.read(req, offset)
+	}
+	if err != nil {
+		g.audit(event, err)
+		return nil, err
+	}
+	g.audit(event, nil, record.Offset)
+	return g.consumed(ctx, record), nil
+}
+
+// read returns the record at the offset, or, for read-committed consumers, the first record they see from the offset on.
+func (g *grpcServer) read(req *api.ConsumeRequest, offset uint64) (*api.Record, error) {
+	if req.Isolation != api.IsolationLevel_READ_COMMITTED {
+		return g.CommitLog.Read(offset)
+	}
+
+	// the record at the offset may be one the consumer doesn't see, so we return the next one it does
+	it := g.CommitLog.Iterator()
+	it.SetIsolation(req.Isolation)
+	it.Seek(offset)
+	if !it.Next() {
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		return nil, g.aboveHighest(offset)
+	}
+	return it.Record(), nil
+}
+
+func (g *grpcServer) aboveHighest(offset uint64) error {
+	lowest, err := g.CommitLog.LowestOffset()
+	if err != nil {
+		return err
+	}
+	return api.ErrOffsetAboveHighest{
+		Offset:        offset,
+		Lowest:        lowest,
+		HighWatermark: g.CommitLog.NextOffset(),
+	}
+}
+
+// startOffset returns the offset the consumer starts reading from.
+func (g *grpcServer) startOffset(req *api.ConsumeRequest) (uint64, error) {
+	switch req.Start {
+	case api.StartPosition_START_EARLIEST:
+		return g.CommitLog.LowestOffset()
+	case api.StartPosition_START_LATEST:
+		return g.CommitLog.NextOffset(), nil
+	case api.StartPosition_START_TIMESTAMP:
+		return g.CommitLog.OffsetForTime(time.UnixMilli(req.Timestamp))
+	}
+	return req.Offset, nil
+}
+
+// reset applies the consumer's out of range policy to the error of reading from an offset retention truncated,
+// or from one past the log's next offset. It returns the offset the consumer carries on from,
+// or false if the consumer gets the error.
+// Reading at the next offset itself isn't out of range: the consumer has just caught up.
+func (g *grpcServer) reset(req *api.ConsumeRequest, err error) (uint64, bool) {
+	var (
+		below        api.ErrOffsetBelowLowest
+		above        api.ErrOffsetAboveHighest
+		lowest, next uint64
+	)
+	switch {
+	case errors.As(err, &below):
+		lowest, next = below.Lowest, below.HighWatermark
+	case errors.As(err, &above) && above.Offset > above.HighWatermark:
+		lowest, next = above.Lowest, above.HighWatermark
+	default:
+		return 0, false
+	}
+
+	switch req.OutOfRange {
+	case api.OutOfRangePolicy_OUT_OF_RANGE_EARLIEST:
+		return lowest, true
+	case api.OutOfRangePolicy_OUT_OF_RANGE_LATEST:
+		return next, true
+	}
+	return 0, false
+}
+
+// consumed records the consumer reading the record in a span of the record's trace and returns the response for it.
+func (g *grpcServer) consumed(ctx context.Context, record *api.Record) *api.ConsumeResponse {
+	trace.SpanFromContext(ctx).SetAttributes(recordAttributes(record)...)
+	_, span := g.startConsumeSpan(ctx, record)
+	span.End()
+	return &api.ConsumeResponse{Record: record, HighWatermark: g.CommitLog.NextOffset()}
 }
 
 // ConsumeStream implements log_v1.LogServer.
+// It reads the log with an iterator, which reads the store sequentially instead of
+// looking every record up in the index.
 func (g *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream grpc.ServerStreamingServer[api.ConsumeResponse]) error {
-	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := g.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				// if the server has read to the end of the log and there is no more data,
-				// just wait until someone produces another record to the client
-				continue
-			default:
-				return err
-			}
-			if err := stream.Send(res); err != nil {
-				return err
+	event, err := g.authorize(stream.Context(), g.Topic, consumeAction)
+	if err != nil {
+		return err
+	}
+
+	return g.stream(stream.Context(), event, req, nil, stream.Send)
+}
+
+// Subscribe implements log_v1.LogServer.
+// The client's first message says what to consume and the following ones grant credit for more records.
+// Once the client closes its side, the stream ends after sending the records the client has granted credit for.
+func (g *grpcServer) Subscribe(stream grpc.BidiStreamingServer[api.SubscribeRequest, api.ConsumeResponse]) error {
+	event, err := g.authorize(stream.Context(), g.Topic, consumeAction)
+	if err != nil {
+		return err
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		g.audit(event, err)
+		return err
+	}
+	req := first.GetConsume()
+	if req == nil {
+		err := status.Error(grpccodes.InvalidArgument, "the first subscribe request must say what to consume")
+		g.audit(event, err)
+		return err
+	}
+
+	credit := newCredit()
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				// the client closed its side or the stream ended
+				credit.close()
+				return
 			}
-			req.Offset++
+			credit.grant(req.GetCredit())
 		}
-	}
+	}()
+	return g.stream(stream.Context(), event, req, credit, stream.Send)
 }
 
 // Produce implements log_v1.LogServer.
+// A request carries either a record or a batch of records, which the log appends together.
 func (g *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := g.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	event, err := g.authorize(ctx, g.Topic, produceAction)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProduce(req); err != nil {
+		g.audit(event, err)
 		return nil, err
 	}
-	offset, err := g.CommitLog.Append(req.Record)
+	records := req.Records
+	if len(records) == 0 {
+		records = []*api.Record{req.Record}
+	}
+	for _, record := range records {
+		// transaction markers are only appended by CommitTransaction and AbortTransaction,
+		// so a producer can't end a transaction it doesn't own
+		if control := record.GetControl(); control != api.ControlType_CONTROL_NONE {
+			err := api.ErrControlRecord{Control: control}
+			g.audit(event, err)
+			return nil, err
+		}
+		// consumers of the record continue the produce's trace
+		injectTraceContext(ctx, record)
+	}
+	var offset uint64
+	switch {
+	case len(req.Records) > 0:
+		offset, err = g.CommitLog.AppendBatch(req.Records)
+	case req.ExpectedOffset != nil:
+		offset, err = g.CommitLog.AppendIf(req.Record, *req.ExpectedOffset)
+	default:
+		offset, err = g.CommitLog.Append(req.Record)
+	}
+	g.audit(event, err, offset)
 	if err != nil {
 		return nil, err
 	}
+	trace.SpanFromContext(ctx).SetAttributes(recordAttributes(records[0])...)
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// checkProduce checks that a request carries a record or a batch of records,
+// and that a batch doesn't use the fields that only apply to single records.
+func checkProduce(req *api.ProduceRequest) error {
+	if len(req.Records) == 0 {
+		if req.Record == nil {
+			return status.Error(grpccodes.InvalidArgument, "a produce request carries a record or a batch of records")
+		}
+		return nil
+	}
+	if req.Record != nil {
+		return status.Error(grpccodes.InvalidArgument, "a produce request carries a record or a batch of records, not both")
+	}
+	if req.ExpectedOffset != nil {
+		return status.Error(grpccodes.InvalidArgument, "batches can't be produced conditionally")
+	}
+	return nil
+}
+
+// InitProducer implements log_v1.LogServer.
+// Producers that set the returned ID and a sequence number on their records can retry
+// Produce calls without appending duplicates.
+func (g *grpcServer) InitProducer(ctx context.Context, req *api.InitProducerRequest) (*api.InitProducerResponse, error) {
+	event, err := g.authorize(ctx, g.Topic, produceAction)
+	if err != nil {
+		return nil, err
+	}
+	id, err := g.CommitLog.InitProducer()
+	g.audit(event, err)
+	if err != nil {
+		return nil, err
+	}
+	return &api.InitProducerResponse{ProducerId: id}, nil
+}
+
+// BeginTransaction implements log_v1.LogServer.
+func (g *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	event, err := g.authorize(ctx, g.Topic, produceAction)
+	if err != nil {
+		return nil, err
+	}
+	id, err := g.CommitLog.BeginTransaction()
+	g.audit(event, err)
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+// CommitTransaction implements log_v1.LogServer.
+func (g *grpcServer) CommitTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	return g.endTransaction(ctx, req, g.CommitLog.CommitTransaction)
+}
+
+// AbortTransaction implements log_v1.LogServer.
+func (g *grpcServer) AbortTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	return g.endTransaction(ctx, req, g.CommitLog.AbortTransaction)
+}
+
+func (g *grpcServer) endTransaction(
+	ctx context.Context,
+	req *api.EndTransactionRequest,
+	end func(id uint64) (uint64, error),
+) (*api.EndTransactionResponse, error) {
+	event, err := g.authorize(ctx, g.Topic, produceAction)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := end(req.TransactionId)
+	g.audit(event, err, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{Offset: offset}, nil
+}
+
+// Truncate implements log_v1.LogServer.
+func (g *grpcServer) Truncate(ctx context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	event, err := g.authorize(ctx, g.Topic, truncateAction)
+	if err != nil {
+		return nil, err
+	}
+	err = g.CommitLog.Truncate(req.Lowest)
+	if err != nil {
+		g.audit(event, err)
+		return nil, err
+	}
+	lowest, err := g.CommitLog.LowestOffset()
+	g.audit(event, err, lowest)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TruncateResponse{LowestOffset: lowest}, nil
+}
+
+// snapshotChunkSize is the most bytes of the log a snapshot chunk holds.
+const snapshotChunkSize = 64 * 1024
+
+// Snapshot implements log_v1.LogServer.
+// Plaintext snapshots hand out the records of encrypted segments decrypted, so they need the decrypt action too.
+// Each action the call is authorized for gets its own audit event.
+func (g *grpcServer) Snapshot(req *api.SnapshotRequest, stream grpc.ServerStreamingServer[api.SnapshotChunk]) error {
+	ctx := stream.Context()
+	event, err := g.authorize(ctx, g.Topic, consumeAction)
+	if err != nil {
+		return err
+	}
+	events := []AuditEvent{event}
+	audit := func(err error) {
+		for _, event := range events {
+			g.audit(event, err)
+		}
+	}
+	r := g.CommitLog.Reader()
+	if req.Plaintext {
+		event, err := g.authorize(ctx, g.Topic, decryptAction)
+		if err != nil {
+			// authorize audited the denial; the consume event records that the call failed on it
+			audit(err)
+			return err
+		}
+		events = append(events, event)
+		r = g.CommitLog.PlaintextReader()
+	}
+
+	buf := make([]byte, snapshotChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.Send(&api.SnapshotChunk{Data: buf[:n]}); err != nil {
+				audit(err)
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			audit(nil)
+			return nil
+		}
+		if err != nil {
+			audit(err)
+			return err
+		}
+	}
+}
+
 // ProduceStream implements log_v1.LogServer.
 func (g *grpcServer) ProduceStream(stream grpc.BidiStreamingServer[api.ProduceRequest, api.ProduceResponse]) error {
 	for {
@@ -114,10 +478,15 @@ func (g *grpcServer) ProduceStream(stream grpc.BidiStreamingServer[api.ProduceRe
 		if err != nil {
 			return err
 		}
-		res, err := g.Produce(stream.Context(), req)
+		// each record gets its own span, so its consumers' traces start at the record instead of the whole stream
+		ctx, span := g.tracer().Start(stream.Context(), "produce record", trace.WithSpanKind(trace.SpanKindProducer))
+		res, err := g.Produce(ctx, req)
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
 			return err
 		}
+		span.End()
 		if err := stream.Send(res); err != nil {
 			return err
 		}
@@ -126,73 +495,103 @@ func (g *grpcServer) ProduceStream(stream grpc.BidiStreamingServer[api.ProduceRe
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
-		Config: config,
+		Config:  config,
+		metrics: newMetrics(),
+	}
+	srv.quotas = newQuotas(config.Quotas, srv.metrics)
+	if config.Topic == "" {
+		config.Topic = defaultTopic
+	}
+	if config.Authenticators == nil {
+		config.Authenticators = []Authenticator{TLSAuthenticator{}}
+	}
+	if config.Registerer != nil {
+		if err := srv.metrics.register(config.Registerer); err != nil {
+			return nil, err
+		}
 	}
 
 	return srv, nil
 }
 
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+
 	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
 	loggingOpts := []logging.Option{
 		logging.WithLogOnEvents(logging.StartCall, logging.FinishCall),
 		// Add any other option (check functions starting with logging.With).
 	}
 
+	tracingOpts := []otelgrpc.Option{otelgrpc.WithPropagators(Propagator)}
+	if config.TracerProvider != nil {
+		tracingOpts = append(tracingOpts, otelgrpc.WithTracerProvider(config.TracerProvider))
+	}
+
 	opts = append(opts,
+		// otelgrpc traces RPCs with a stats handler rather than interceptors,
+		// so the span covers the whole RPC, including the interceptors
+		grpc.StatsHandler(otelgrpc.NewServerHandler(tracingOpts...)),
 		grpc.ChainUnaryInterceptor(
+			srv.metrics.unaryInterceptor,
+			unaryErrorInterceptor,
 			logging.UnaryServerInterceptor(InterceptorLogger(logger), loggingOpts...),
-			grpc_auth.UnaryServerInterceptor(authenticate),
+			grpc_auth.UnaryServerInterceptor(srv.authenticate),
+			srv.quotas.unaryInterceptor,
 		),
 		grpc.ChainStreamInterceptor(
+			srv.metrics.streamInterceptor,
+			streamErrorInterceptor,
 			logging.StreamServerInterceptor(InterceptorLogger(logger), loggingOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
+			grpc_auth.StreamServerInterceptor(srv.authenticate),
+			srv.quotas.streamInterceptor,
 		),
 		// grpc.ChainStreamInterceptor(
 		// 	logging.StreamServerInterceptor(grpczerolog.InterceptorLogger(logger), loggingOpts...),
-		// 	grpc_auth.StreamServerInterceptor(authenticate),
+		// 	grpc_auth.StreamServerInterceptor(srv.authenticate),
 		// ),
 		// grpc.ChainUnaryInterceptor(
 		// 	logging.UnaryServerInterceptor(grpczerolog.InterceptorLogger(logger), loggingOpts...),
-		// 	grpc_auth.UnaryServerInterceptor(authenticate),
+		// 	grpc_auth.UnaryServerInterceptor(srv.authenticate),
 		// ),
 	)
 	gsrv := grpc.NewServer(opts...)
-	srv, err := newgrpcServer(config)
-	if err != nil {
-		return nil, err
-	}
-
 	api.RegisterLogServer(gsrv, srv)
+	if config.Health == nil {
+		config.Health = health.NewServer()
+		config.Health.SetServingStatus(api.Log_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(gsrv, config.Health)
 	return gsrv, nil
 }
 
 type subjectContextKey struct{}
 
-// return the client's cert's subject so we can indetify a client and check their access.
+// return the client's subject so we can indetify a client and check their access.
+// Clients that no authenticator identified have the empty subject.
 func subject(ctx context.Context) string {
-	return ctx.Value(subjectContextKey{}).(string)
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
 }
 
-// this is an interceptor that reads the subject out of the client's cert
-// and writes it to the RPC's context.
+// this is an interceptor that identifies the client with the server's authenticators
+// and writes the client's subject to the RPC's context.
 // With interceptors, you can intercept and modify the execution of each RPC call,
 // allowing you to break the request handling into smaller, reusable chunks.
-func authenticate(ctx context.Context) (context.Context, error) {
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
-	}
-
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+func (g *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	for _, authenticator := range g.Authenticators {
+		subject, err := authenticator.Authenticate(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		if subject != "" {
+			return context.WithValue(ctx, subjectContextKey{}, subject), nil
+		}
 	}
-
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	// extract the subject from the client's cert
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-	return ctx, nil
+	return context.WithValue(ctx, subjectContextKey{}, ""), nil
 }
 
 // InterceptorLogger adapts zerolog logger to interceptor logger.
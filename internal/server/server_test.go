@@ -1,16 +1,26 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	api "github.com/ttaaoo/proglog/api/v1"
 	"github.com/ttaaoo/proglog/internal/auth"
 	"github.com/ttaaoo/proglog/internal/config"
 	"github.com/ttaaoo/proglog/internal/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -28,6 +38,11 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
 		"unauthorized fails":                                 testUnauthorized,
+		"idempotent producer retries don't duplicate":        testIdempotentProduce,
+		"read-committed consumers skip aborted records":      testTransactions,
+		"conditional produce fails on offset conflict":       testConditionalProduce,
+		"records request metrics":                            testMetrics,
+		"consume from a start position":                      testStartPosition,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -61,7 +76,11 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		})
 		require.NoError(t, err)
 		tlsCreds := credentials.NewTLS(tlsConfig)
-		opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
+		opts := []grpc.DialOption{
+			grpc.WithTransportCredentials(tlsCreds),
+			// propagates the trace context of the test's calls to the server
+			grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithPropagators(Propagator))),
+		}
 		conn, err := grpc.NewClient(l.Addr().String(), opts...)
 		require.NoError(t, err)
 		client := api.NewLogClient(conn)
@@ -100,8 +119,9 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	require.NoError(t, err)
 
 	cfg = &Config{
-		CommitLog:  clog,
+		CommitLog:  LogCommitLog{Log: clog},
 		Authorizer: authorizer,
+		Registerer: prometheus.NewRegistry(),
 	}
 
 	if fn != nil {
@@ -158,10 +178,15 @@ func testConsumePastBoundary(t *testing.T, client, _ api.LogClient, config *Conf
 	}
 
 	got := status.Code(err)
-	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	want := codes.OutOfRange
 	if got != want {
 		t.Fatalf("got err %v, want %v", got, want)
 	}
+	require.Equal(t, api.ErrOffsetAboveHighest{
+		Offset:        produceRes.Offset + 1,
+		Lowest:        0,
+		HighWatermark: produceRes.Offset + 1,
+	}, api.FromError(err))
 }
 
 func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Config) {
@@ -202,9 +227,12 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// the log stamps records produced without a timestamp with the time it appended them
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 		// Close the stream to signal end of consumption
@@ -212,6 +240,107 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 	}
 }
 
+func testIdempotentProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	producer, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, producer.ProducerId)
+
+	produce := func(seq uint64) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:      []byte("hello world"),
+				ProducerId: producer.ProducerId,
+				Sequence:   seq,
+			},
+		})
+	}
+	first, err := produce(0)
+	require.NoError(t, err)
+	second, err := produce(1)
+	require.NoError(t, err)
+
+	// retrying returns the original offset
+	retry, err := produce(0)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+
+	// skipping sequence numbers fails
+	_, err = produce(5)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: second.Offset + 1})
+	require.Error(t, err)
+}
+
+func testTransactions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func(value string, txn uint64) {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), TransactionId: txn},
+		})
+		require.NoError(t, err)
+	}
+
+	aborted, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce("aborted", aborted.TransactionId)
+	_, err = client.AbortTransaction(ctx, &api.EndTransactionRequest{TransactionId: aborted.TransactionId})
+	require.NoError(t, err)
+
+	committed, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce("committed", committed.TransactionId)
+
+	// producers can't end a transaction by producing its marker themselves
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{TransactionId: committed.TransactionId, Control: api.ControlType_CONTROL_ABORT},
+	})
+	require.Equal(t, api.ErrControlRecord{Control: api.ControlType_CONTROL_ABORT}, api.FromError(err))
+
+	// the open transaction's record isn't stable yet
+	req := &api.ConsumeRequest{Offset: 0, Isolation: api.IsolationLevel_READ_COMMITTED}
+	_, err = client.Consume(ctx, req)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{TransactionId: committed.TransactionId})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), consume.Record.Value)
+
+	stream, err := client.ConsumeStream(ctx, req)
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), res.Record.Value)
+
+	_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{TransactionId: committed.TransactionId})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testConditionalProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func(expected uint64) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Record:         &api.Record{Value: []byte("hello world")},
+			ExpectedOffset: &expected,
+		})
+	}
+
+	res, err := produce(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// someone else appended at offset 0 already
+	_, err = produce(0)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	res, err = produce(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+}
+
 func testUnauthorized(
 	t *testing.T,
 	_,
@@ -233,6 +362,11 @@ func testUnauthorized(
 	if gotCode != wantCode {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
+	require.Equal(t, api.ErrPermissionDenied{
+		Subject: "nobody",
+		Object:  defaultTopic,
+		Action:  produceAction,
+	}, api.FromError(err))
 	consume, err := client.Consume(ctx, &api.ConsumeRequest{
 		Offset: 0,
 	})
@@ -246,3 +380,365 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testMetrics(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), consume.HighWatermark)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	m := config.Registerer.(*prometheus.Registry)
+	require.NoError(t, testutil.GatherAndCompare(m, strings.NewReader(`
+# HELP proglog_consume_stream_subscriptions The number of open ConsumeStream and Subscribe calls.
+# TYPE proglog_consume_stream_subscriptions gauge
+proglog_consume_stream_subscriptions 1
+# HELP proglog_grpc_requests_total The number of RPCs the server handled, by method and code.
+# TYPE proglog_grpc_requests_total counter
+proglog_grpc_requests_total{code="OK",method="/log.v1.Log/Consume"} 1
+proglog_grpc_requests_total{code="OK",method="/log.v1.Log/Produce"} 1
+proglog_grpc_requests_total{code="OutOfRange",method="/log.v1.Log/Consume"} 1
+`), "proglog_consume_stream_subscriptions", "proglog_grpc_requests_total"))
+	require.Equal(t, 2, testutil.CollectAndCount(
+		config.Registerer.(*prometheus.Registry), "proglog_grpc_request_duration_seconds",
+	))
+}
+
+func testStartPosition(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, ts := range []int64{1000, 2000, 3000} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world"), Timestamp: ts},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_EARLIEST})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_TIMESTAMP, Timestamp: 1500})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+
+	// there's nothing to read at the latest offset until someone produces
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_LATEST})
+	require.Equal(t, api.ErrOffsetAboveHighest{Offset: 3, Lowest: 0, HighWatermark: 3}, api.FromError(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_LATEST})
+	require.NoError(t, err)
+	res = recvProducing(t, client, stream)
+	require.GreaterOrEqual(t, res.Record.Offset, uint64(3))
+	require.Equal(t, []byte("latest"), res.Record.Value)
+}
+
+/*
+recvProducing produces records with the value "latest" until the stream receives one. Streams resolve
+their start position when the server handles them, which may be after ConsumeStream returns,
+so a test can't produce a single record and know whether a stream starting at the latest offset will see it.
+*/
+func recvProducing(t *testing.T, client api.LogClient, stream grpc.ServerStreamingClient[api.ConsumeResponse]) *api.ConsumeResponse {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _ = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("latest")}})
+			}
+		}
+	}()
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	return res
+}
+
+func TestProduceBatch(t *testing.T) {
+	var clog *log.Log
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		lc := log.Config{}
+		lc.Compression = log.Zstd
+		var err error
+		clog, err = log.NewLog(t.TempDir(), lc)
+		require.NoError(t, err)
+		c.CommitLog = LogCommitLog{Log: clog}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("first")}})
+	require.NoError(t, err)
+	var (
+		records []*api.Record
+		size    int
+	)
+	for i := 0; i < 10; i++ {
+		value := []byte(fmt.Sprintf(`{"id":%d,"kind":"event","payload":"hello world"}`, i))
+		records = append(records, &api.Record{Value: value})
+		size += len(value)
+	}
+	res, err := client.Produce(ctx, &api.ProduceRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	for i, want := range records {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(1 + i)})
+		require.NoError(t, err)
+		require.Equal(t, want.Value, res.Record.Value)
+	}
+	// the log stored the batch compressed, in less space than its records take
+	stored, err := io.ReadAll(clog.Reader())
+	require.NoError(t, err)
+	require.Less(t, len(stored), size)
+
+	// batches are records on their own
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: records[0], Records: records})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	expected := uint64(11)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Records: records, ExpectedOffset: &expected})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	// and a request without either has nothing to produce
+	_, err = client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestConsumeOutOfRange(t *testing.T) {
+	var clog *log.Log
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		lc := log.Config{}
+		lc.Segment.MaxStoreBytes = 64
+		var err error
+		clog, err = log.NewLog(t.TempDir(), lc)
+		require.NoError(t, err)
+		c.CommitLog = LogCommitLog{Log: clog}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+			require.NoError(t, err)
+		}
+	}
+	produce(10)
+	require.NoError(t, clog.Truncate(5))
+	lowest, err := clog.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(0))
+
+	// by default, consumers get the error
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, api.ErrOffsetBelowLowest{Offset: 0, Lowest: lowest, HighWatermark: 10}, api.FromError(err))
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 20})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, api.ErrOffsetAboveHighest{Offset: 20, Lowest: lowest, HighWatermark: 10}, api.FromError(err))
+
+	// or they carry on from either end of the log
+	res, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:     0,
+		OutOfRange: api.OutOfRangePolicy_OUT_OF_RANGE_EARLIEST,
+	})
+	require.NoError(t, err)
+	require.Equal(t, lowest, res.Record.Offset)
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     20,
+		OutOfRange: api.OutOfRangePolicy_OUT_OF_RANGE_LATEST,
+	})
+	require.NoError(t, err)
+	res = recvProducing(t, client, stream)
+	require.GreaterOrEqual(t, res.Record.Offset, uint64(10))
+	require.Equal(t, []byte("latest"), res.Record.Value)
+
+	// streams whose iterator finds its records truncated, like a slow consumer's, apply the policy too
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	require.True(t, api.IsOffsetOutOfRange(err))
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     0,
+		OutOfRange: api.OutOfRangePolicy_OUT_OF_RANGE_EARLIEST,
+	})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, lowest, res.Record.Offset)
+}
+
+func TestTopicPolicies(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		policy string
+		topic  string
+		fn     func(t *testing.T, root api.LogClient)
+	}{
+		"a prefix policy grants its topics": {
+			policy: "p, root, orders.*, produce\n",
+			topic:  "orders.eu",
+			fn: func(t *testing.T, root api.LogClient) {
+				_, err := root.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("a")}})
+				require.NoError(t, err)
+			},
+		},
+		"a prefix policy doesn't grant other topics": {
+			policy: "p, root, orders.*, produce\n",
+			topic:  "payments",
+			fn: func(t *testing.T, root api.LogClient) {
+				_, err := root.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("a")}})
+				require.Equal(t, api.ErrPermissionDenied{
+					Subject: "root",
+					Object:  "payments",
+					Action:  produceAction,
+				}, api.FromError(err))
+			},
+		},
+		"truncating needs the truncate action": {
+			policy: "p, root, orders.*, produce\n",
+			topic:  "orders.eu",
+			fn: func(t *testing.T, root api.LogClient) {
+				_, err := root.Truncate(context.Background(), &api.TruncateRequest{Lowest: 1})
+				require.Equal(t, codes.PermissionDenied, status.Code(err))
+			},
+		},
+		"admin grants every action through a role": {
+			policy: "p, ops, orders.*, admin\ng, root, ops\n",
+			topic:  "orders.eu",
+			fn: func(t *testing.T, root api.LogClient) {
+				ctx := context.Background()
+				_, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("a")}})
+				require.NoError(t, err)
+				res, err := root.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+				require.NoError(t, err)
+				// the only segment holds the record, so it stays
+				require.Equal(t, uint64(0), res.LowestOffset)
+			},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			policy := t.TempDir() + "/policy.csv"
+			require.NoError(t, os.WriteFile(policy, []byte(tc.policy), 0o600))
+			authorizer, err := auth.New(config.ACLModelFile, policy)
+			require.NoError(t, err)
+			root, _, _, teardown := setupTest(t, func(c *Config) {
+				c.Authorizer = authorizer
+				c.Topic = tc.topic
+			})
+			defer teardown()
+			tc.fn(t, root)
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	key := make([]byte, 32)
+	keys := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(keys, []byte("v1 "+base64.StdEncoding.EncodeToString(key)+"\n"), 0o600))
+	provider, err := log.NewKeyFileProvider(keys)
+	require.NoError(t, err)
+
+	for scenario, tc := range map[string]struct {
+		policy string
+		check  func(t *testing.T, encrypted, plaintext []byte, plaintextErr error)
+		// the action and decision of each audit event, and whether the call failed
+		audited []string
+	}{
+		"plaintext snapshots need the decrypt action": {
+			policy: "p, root, *, consume\n",
+			audited: []string{
+				"consume allow ok",
+				// the denial is audited as it happens, and the consume event once the call fails on it
+				"decrypt deny ok",
+				"consume allow failed",
+			},
+			check: func(t *testing.T, encrypted, _ []byte, plaintextErr error) {
+				require.NotEmpty(t, encrypted)
+				require.False(t, bytes.Contains(encrypted, []byte("secret")))
+				require.Equal(t, api.ErrPermissionDenied{
+					Subject: "root",
+					Object:  defaultTopic,
+					Action:  decryptAction,
+				}, api.FromError(plaintextErr))
+			},
+		},
+		"the decrypt action gets plaintext snapshots": {
+			policy:  "p, root, *, consume\np, root, *, decrypt\n",
+			audited: []string{"consume allow ok", "consume allow ok", "decrypt allow ok"},
+			check: func(t *testing.T, encrypted, plaintext []byte, plaintextErr error) {
+				require.NoError(t, plaintextErr)
+				require.False(t, bytes.Contains(encrypted, []byte("secret")))
+				require.True(t, bytes.Contains(plaintext, []byte("secret")))
+			},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			policy := filepath.Join(t.TempDir(), "policy.csv")
+			require.NoError(t, os.WriteFile(policy, []byte(tc.policy), 0o600))
+			authorizer, err := auth.New(config.ACLModelFile, policy)
+			require.NoError(t, err)
+			recorder := &auditRecorder{}
+			root, _, _, teardown := setupTest(t, func(c *Config) {
+				c.AuditSink = recorder
+				lc := log.Config{}
+				lc.Encryption.Keys = provider
+				clog, err := log.NewLog(t.TempDir(), lc)
+				require.NoError(t, err)
+				_, err = clog.Append(&api.Record{Value: []byte("secret")})
+				require.NoError(t, err)
+				c.CommitLog = LogCommitLog{Log: clog}
+				c.Authorizer = authorizer
+			})
+			defer teardown()
+
+			encrypted, err := snapshot(root, false)
+			require.NoError(t, err)
+			plaintext, err := snapshot(root, true)
+			tc.check(t, encrypted, plaintext, err)
+
+			var audited []string
+			for _, event := range recorder.Events() {
+				outcome := "ok"
+				if event.Error != "" {
+					outcome = "failed"
+				}
+				audited = append(audited, event.Action+" "+event.Decision+" "+outcome)
+			}
+			require.Equal(t, tc.audited, audited)
+		})
+	}
+}
+
+// snapshot reads the whole of a snapshot stream.
+func snapshot(client api.LogClient, plaintext bool) ([]byte, error) {
+	stream, err := client.Snapshot(context.Background(), &api.SnapshotRequest{Plaintext: plaintext})
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk.Data...)
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+ConsumeStream and Subscribe share how they read the log and send the records to consumers.
+A stream only sends the records that match its filter, if it has one.
+A stream that asks for batches gets the records it has fallen behind on in as few responses as the batch limit allows,
+and may linger for max_wait before sending a batch that isn't full. Subscribe streams also only send the records
+the client has granted credit for, so a consumer that falls behind holds the server back instead of making it buffer.
+gRPC's own flow control stops a stream's Send once the client stops reading, so the server's send timeout
+is what frees a stream whose consumer got stuck.
+A stream that has caught up with the log waits for the log to append more records instead of polling it,
+except for a slow poll that picks up the records of logs other processes write, like logs opened with OpenReadOnly.
+*/
+
+// caughtUpPoll is how often a caught-up stream looks for records the log didn't tell it about.
+const caughtUpPoll = 100 * time.Millisecond
+
+// subscription is a stream's position in the log and the state of its current batch.
+type subscription struct {
+	*grpcServer
+	req *api.ConsumeRequest
+	it  Iterator
+	// the records the consumer wants, or nil for every record
+	filter *filter
+	// a record read for a batch it didn't fit in, which starts the next batch
+	pending *api.Record
+}
+
+// stream sends the log's records to the consumer from the request's start position, until the context is done,
+// the consumer fails to take a response, or a Subscribe stream runs out of credit after the client closed its side.
+// Streams without credit, like ConsumeStream's, may send as many records as they read.
+func (g *grpcServer) stream(
+	ctx context.Context,
+	event AuditEvent,
+	req *api.ConsumeRequest,
+	credit *credit,
+	send func(*api.ConsumeResponse) error,
+) error {
+	g.metrics.subscriptions.Inc()
+	defer g.metrics.subscriptions.Dec()
+
+	filter, err := newFilter(req.Filter)
+	if err != nil {
+		g.audit(event, err)
+		return err
+	}
+	offset, err := g.startOffset(req)
+	if err != nil {
+		g.audit(event, err)
+		return err
+	}
+	// streams wait at the log's next offset for new records, but offsets past it are out of range
+	if offset > g.CommitLog.NextOffset() {
+		err := g.aboveHighest(offset)
+		var ok bool
+		if offset, ok = g.reset(req, err); !ok {
+			g.audit(event, err)
+			return err
+		}
+	}
+	g.audit(event, nil, offset)
+
+	it := g.CommitLog.Iterator()
+	it.SetIsolation(req.Isolation)
+	it.Seek(offset)
+	s := &subscription{grpcServer: g, req: req, it: it, filter: filter}
+	for {
+		limit := uint64(math.MaxUint64)
+		if credit != nil {
+			if limit = credit.wait(ctx); limit == 0 {
+				return nil
+			}
+		}
+		if err := waitQuota(ctx); err != nil {
+			return err
+		}
+		records, err := s.batch(ctx, limit)
+		if err != nil || records == nil {
+			return err
+		}
+		if err := s.send(ctx, records, send); err != nil {
+			return err
+		}
+		if credit != nil {
+			credit.take(uint64(len(records)))
+		}
+	}
+}
+
+// batch reads the records of the stream's next response, at most limit of them.
+// It returns no records once the context is done.
+func (s *subscription) batch(ctx context.Context, limit uint64) ([]*api.Record, error) {
+	var (
+		records []*api.Record
+		size    int
+		linger  <-chan time.Time
+	)
+	if s.pending != nil {
+		records = append(records, s.pending)
+		size = proto.Size(s.pending)
+		s.pending = nil
+	}
+	for uint64(len(records)) < limit {
+		// streams that don't batch send every record on its own
+		if len(records) > 0 && s.req.MaxBatchBytes == 0 {
+			break
+		}
+		if linger == nil && len(records) > 0 && s.req.MaxWaitMs > 0 {
+			timer := time.NewTimer(time.Duration(s.req.MaxWaitMs) * time.Millisecond)
+			defer timer.Stop()
+			linger = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-linger:
+			return records, nil
+		default:
+		}
+
+		// the channel is taken before reading so an append right after Next gives up still wakes the stream
+		appended := s.CommitLog.Appended()
+		if !s.it.Next() {
+			if err := s.it.Err(); err != nil {
+				// retention may have truncated the records a slow consumer was about to read
+				offset, ok := s.reset(s.req, err)
+				if !ok {
+					return nil, err
+				}
+				s.it.Seek(offset)
+				continue
+			}
+			// the stream has caught up with the log, so it sends what it has unless it lingers for more;
+			// if it has nothing, it waits until someone produces another record
+			if len(records) > 0 && s.req.MaxWaitMs == 0 {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, nil
+			case <-linger:
+				return records, nil
+			case <-appended:
+			case <-time.After(caughtUpPoll):
+			}
+			continue
+		}
+
+		record := s.it.Record()
+		if !s.filter.match(record) {
+			continue
+		}
+		n := proto.Size(record)
+		if len(records) > 0 && size+n > int(s.req.MaxBatchBytes) {
+			s.pending = record
+			break
+		}
+		records = append(records, record)
+		size += n
+	}
+	return records, nil
+}
+
+// send sends the records to the consumer in one response, or in the response's record field
+// if the stream doesn't batch, and records each in a span of its record's trace.
+func (s *subscription) send(ctx context.Context, records []*api.Record, send func(*api.ConsumeResponse) error) error {
+	spans := make([]trace.Span, 0, len(records))
+	for _, record := range records {
+		_, span := s.startConsumeSpan(ctx, record)
+		spans = append(spans, span)
+	}
+	res := &api.ConsumeResponse{HighWatermark: s.CommitLog.NextOffset()}
+	if s.req.MaxBatchBytes == 0 {
+		res.Record = records[0]
+	} else {
+		res.Records = records
+	}
+	err := s.sendTimeout(ctx, send, res)
+	for _, span := range spans {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+	return err
+}
+
+// sendTimeout sends the response, giving up with api.ErrSlowConsumer if the consumer doesn't take it within
+// the server's send timeout. The send runs on its own goroutine, which a Send blocked by gRPC's flow control
+// leaves behind: the stream ends with the error once the handler returns it, and gRPC then cancels the stream,
+// which makes the Send return.
+func (g *grpcServer) sendTimeout(ctx context.Context, send func(*api.ConsumeResponse) error, res *api.ConsumeResponse) error {
+	if g.SendTimeout == 0 {
+		return send(res)
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, g.SendTimeout)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() {
+		// a send the stream gave up on before the goroutine got to it isn't started
+		if sendCtx.Err() == nil {
+			sent <- send(res)
+		}
+	}()
+	select {
+	case err := <-sent:
+		return err
+	case <-sendCtx.Done():
+		if err := ctx.Err(); err != nil {
+			// the RPC ended before the consumer took the response
+			return status.FromContextError(err).Err()
+		}
+		g.metrics.slowConsumers.Inc()
+		return api.ErrSlowConsumer{SendTimeout: g.SendTimeout}
+	}
+}
+
+// credit counts how many more records a Subscribe stream may send.
+type credit struct {
+	mu sync.Mutex
+	n  uint64
+	// set once the client closed its side of the stream, so it won't grant more
+	closed  bool
+	changed chan struct{}
+}
+
+func newCredit() *credit {
+	return &credit{changed: make(chan struct{}, 1)}
+}
+
+func (c *credit) grant(n uint32) {
+	c.mu.Lock()
+	c.n += uint64(n)
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *credit) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *credit) signal() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until the stream may send records and returns how many. It returns zero once the context is done,
+// or once the client closed its side and the stream has used up its credit.
+func (c *credit) wait(ctx context.Context) uint64 {
+	for {
+		c.mu.Lock()
+		n, closed := c.n, c.closed
+		c.mu.Unlock()
+		if n > 0 {
+			return n
+		}
+		if closed {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-c.changed:
+		}
+	}
+}
+
+func (c *credit) take(n uint64) {
+	c.mu.Lock()
+	c.n -= n
+	c.mu.Unlock()
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStream(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, client api.LogClient){
+		"batches records up to the byte limit":   testBatch,
+		"lingers for more records":               testLinger,
+		"subscribers only get records on credit": testCredit,
+		"subscribers must say what to consume":   testSubscribeWithoutConsume,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, _, _, teardown := setupTest(t, nil)
+			defer teardown()
+			fn(t, client)
+		})
+	}
+}
+
+func produceN(t *testing.T, client api.LogClient, n int, value []byte) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+	}
+}
+
+func testBatch(t *testing.T, client api.LogClient) {
+	value := bytes.Repeat([]byte("a"), 100)
+	produceN(t, client, 10, value)
+
+	// three records fit in a batch, four don't
+	maxBatchBytes := 3 * proto.Size(&api.Record{Value: value, Offset: 9, Timestamp: time.Now().UnixMilli()})
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{MaxBatchBytes: uint32(maxBatchBytes)})
+	require.NoError(t, err)
+	var offset uint64
+	for offset < 10 {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Nil(t, res.Record)
+		require.NotEmpty(t, res.Records)
+		require.LessOrEqual(t, len(res.Records), 3)
+		for _, record := range res.Records {
+			require.Equal(t, offset, record.Offset)
+			offset++
+		}
+	}
+
+	// a record larger than the limit gets a batch of its own
+	produceN(t, client, 1, bytes.Repeat([]byte("a"), 2*maxBatchBytes))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(10), res.Records[0].Offset)
+}
+
+func testLinger(t *testing.T, client api.LogClient) {
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{
+		MaxBatchBytes: 1 << 20,
+		MaxWaitMs:     500,
+	})
+	require.NoError(t, err)
+	produceN(t, client, 3, []byte("hello world"))
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 3)
+	require.Equal(t, uint64(3), res.HighWatermark)
+}
+
+func testCredit(t *testing.T, client api.LogClient) {
+	produceN(t, client, 5, []byte("hello world"))
+	ctx := context.Background()
+
+	stream, err := client.Subscribe(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.SubscribeRequest{
+		Request: &api.SubscribeRequest_Consume{Consume: &api.ConsumeRequest{}},
+	}))
+	require.NoError(t, stream.Send(&api.SubscribeRequest{Request: &api.SubscribeRequest_Credit{Credit: 2}}))
+	// the stream ends once the server has sent the records the client granted credit for
+	require.NoError(t, stream.CloseSend())
+	for _, want := range []uint64{0, 1} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// batches are as large as the credit allows
+	stream, err = client.Subscribe(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.SubscribeRequest{
+		Request: &api.SubscribeRequest_Consume{Consume: &api.ConsumeRequest{Offset: 1, MaxBatchBytes: 1 << 20}},
+	}))
+	require.NoError(t, stream.Send(&api.SubscribeRequest{Request: &api.SubscribeRequest_Credit{Credit: 3}}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 3)
+	require.Equal(t, uint64(1), res.Records[0].Offset)
+
+	require.NoError(t, stream.Send(&api.SubscribeRequest{Request: &api.SubscribeRequest_Credit{Credit: 10}}))
+	require.NoError(t, stream.CloseSend())
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(4), res.Records[0].Offset)
+}
+
+func testSubscribeWithoutConsume(t *testing.T, client api.LogClient) {
+	stream, err := client.Subscribe(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.SubscribeRequest{Request: &api.SubscribeRequest_Credit{Credit: 1}}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCaughtUpStreamWaits(t *testing.T) {
+	var nexts atomic.Int64
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = countingCommitLog{CommitLog: c.CommitLog, nexts: &nexts}
+	})
+	defer teardown()
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	// a caught-up stream reads the log once, then again only when it's appended to or when it polls
+	time.Sleep(3 * caughtUpPoll)
+	require.LessOrEqual(t, nexts.Load(), int64(5))
+
+	produceN(t, client, 1, []byte("hello world"))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+}
+
+// countingCommitLog counts the calls to Next of its iterators.
+type countingCommitLog struct {
+	CommitLog
+	nexts *atomic.Int64
+}
+
+func (c countingCommitLog) Iterator() Iterator {
+	return countingIterator{Iterator: c.CommitLog.Iterator(), nexts: c.nexts}
+}
+
+type countingIterator struct {
+	Iterator
+	nexts *atomic.Int64
+}
+
+func (it countingIterator) Next() bool {
+	it.nexts.Add(1)
+	return it.Iterator.Next()
+}
+
+func TestSendTimeout(t *testing.T) {
+	g, err := newgrpcServer(&Config{SendTimeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	sent := func(*api.ConsumeResponse) error { return nil }
+	require.NoError(t, g.sendTimeout(context.Background(), sent, &api.ConsumeResponse{}))
+
+	// a consumer that stops reading blocks the stream's Send once gRPC's flow control window fills up
+	release := make(chan struct{})
+	defer close(release)
+	blocked := func(*api.ConsumeResponse) error {
+		<-release
+		return io.EOF
+	}
+	err = g.sendTimeout(context.Background(), blocked, &api.ConsumeResponse{})
+	require.Equal(t, api.ErrSlowConsumer{SendTimeout: 10 * time.Millisecond}, err)
+	require.Equal(t, 1.0, testutil.ToFloat64(g.metrics.slowConsumers))
+
+	// a stream whose RPC ends while it waits for the consumer stops waiting with the RPC's status
+	g.SendTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = g.sendTimeout(ctx, blocked, &api.ConsumeResponse{})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Equal(t, 1.0, testutil.ToFloat64(g.metrics.slowConsumers))
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		c.SendTimeout = 50 * time.Millisecond
+	})
+	defer teardown()
+	// enough records to fill gRPC's flow control windows
+	produceN(t, client, 64, bytes.Repeat([]byte("a"), 64*1024))
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	// the server gives up on the consumer and its stream's handler returns, though the consumer hasn't read anything
+	require.Eventually(t, func() bool {
+		return serverMetric(t, config, "proglog_consume_stream_slow_consumers_total") == 1 &&
+			serverMetric(t, config, "proglog_consume_stream_subscriptions") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	// the consumer gets the records the server sent before it gave up, then the reason it did
+	for {
+		if _, err := stream.Recv(); err != nil {
+			require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+			require.Equal(t, api.ErrSlowConsumer{SendTimeout: 50 * time.Millisecond}, api.FromError(err))
+			return
+		}
+	}
+}
+
+// serverMetric returns the value of the server's counter or gauge without labels.
+func serverMetric(t *testing.T, config *Config, name string) float64 {
+	t.Helper()
+	families, err := config.Registerer.(*prometheus.Registry).Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		m := f.GetMetric()[0]
+		if m.GetCounter() != nil {
+			return m.GetCounter().GetValue()
+		}
+		return m.GetGauge().GetValue()
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/ttaaoo/proglog/api/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+The server traces every RPC with otelgrpc's stats handler, which continues the trace of the client's call
+from the gRPC metadata. On top of that, the server stores the produce span's trace context in the
+headers of the records it appends, and the spans of the consumers that later read the records continue
+the trace from the headers. So one trace follows a record from its producer, through the log, to its consumers.
+*/
+
+// Propagator carries trace context in gRPC metadata and record headers, as W3C trace context and baggage.
+// Clients of the server, like the replicator, should use it too so their traces continue in the server.
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+const tracerName = "github.com/ttaaoo/proglog/internal/server"
+
+// The attributes the server adds to the spans of produced and consumed records.
+const (
+	offsetKey     = attribute.Key("proglog.offset")
+	recordSizeKey = attribute.Key("proglog.record.size")
+)
+
+// headerCarrier adapts record headers to propagation.TextMapCarrier.
+type headerCarrier map[string]string
+
+var _ propagation.TextMapCarrier = headerCarrier(nil)
+
+func (h headerCarrier) Get(key string) string { return h[key] }
+
+func (h headerCarrier) Set(key, value string) { h[key] = value }
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (g *grpcServer) tracer() trace.Tracer {
+	tp := g.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// injectTraceContext stores the context's trace context in the record's headers, unless the record
+// already carries one, like the records the replicator copies from other servers do.
+func injectTraceContext(ctx context.Context, record *api.Record) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	if record.Headers == nil {
+		record.Headers = make(map[string]string)
+	}
+	carrier := headerCarrier(record.Headers)
+	if trace.SpanContextFromContext(Propagator.Extract(context.Background(), carrier)).IsValid() {
+		return
+	}
+	Propagator.Inject(ctx, carrier)
+}
+
+// startConsumeSpan starts the span of a consumer reading the record. The span continues the trace
+// stored in the record's headers and links to the consumer's RPC span; records without trace context
+// get a child of the RPC span.
+func (g *grpcServer) startConsumeSpan(ctx context.Context, record *api.Record) (context.Context, trace.Span) {
+	rpc := trace.SpanContextFromContext(ctx)
+	parent := Propagator.Extract(ctx, headerCarrier(record.Headers))
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(recordAttributes(record)...),
+	}
+	if producer := trace.SpanContextFromContext(parent); producer.IsValid() && !producer.Equal(rpc) && rpc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: rpc}))
+	}
+	return g.tracer().Start(parent, "consume record", opts...)
+}
+
+func recordAttributes(record *api.Record) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		offsetKey.Int64(int64(record.Offset)),
+		recordSizeKey.Int(proto.Size(record)),
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/ttaaoo/proglog/api/v1"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.TracerProvider = tp
+	})
+	defer teardown()
+
+	// the producer's trace continues into the server
+	ctx, producer := tp.Tracer("test").Start(context.Background(), "produce")
+	produced, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	producer.End()
+
+	// the consumers have traces of their own
+	consumed, err := client.Consume(context.Background(), &api.ConsumeRequest{Offset: produced.Offset})
+	require.NoError(t, err)
+	require.Contains(t, consumed.Record.Headers, "traceparent")
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{Offset: produced.Offset})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseSend())
+
+	spans := func(name string) tracetest.SpanStubs {
+		var stubs tracetest.SpanStubs
+		for _, span := range exporter.GetSpans() {
+			if span.Name == name {
+				stubs = append(stubs, span)
+			}
+		}
+		return stubs
+	}
+
+	produceRPC := spans("log.v1.Log/Produce")
+	require.Len(t, produceRPC, 1)
+	require.Equal(t, producer.SpanContext().TraceID(), produceRPC[0].SpanContext.TraceID())
+	require.Contains(t, produceRPC[0].Attributes, offsetKey.Int64(int64(produced.Offset)))
+
+	consumeRPC := spans("log.v1.Log/Consume")
+	require.Len(t, consumeRPC, 1)
+	require.NotEqual(t, producer.SpanContext().TraceID(), consumeRPC[0].SpanContext.TraceID())
+
+	// both consumers' record spans are in the producer's trace, children of the produce span,
+	// and link to the consumers' RPC spans
+	require.Eventually(t, func() bool { return len(spans("consume record")) == 2 }, time.Second, 10*time.Millisecond)
+	for _, span := range spans("consume record") {
+		require.Equal(t, producer.SpanContext().TraceID(), span.SpanContext.TraceID())
+		require.Equal(t, produceRPC[0].SpanContext.SpanID(), span.Parent.SpanID())
+		require.Equal(t, trace.SpanKindConsumer, span.SpanKind)
+		require.Contains(t, span.Attributes, offsetKey.Int64(int64(produced.Offset)))
+		require.Len(t, span.Links, 1)
+	}
+	require.Equal(t, consumeRPC[0].SpanContext, spans("consume record")[0].Links[0].SpanContext)
+}
+
+func TestInjectTraceContext(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "produce")
+	defer span.End()
+
+	record := &api.Record{}
+	injectTraceContext(ctx, record)
+	traceparent := record.Headers["traceparent"]
+	require.Contains(t, traceparent, span.SpanContext().TraceID().String())
+
+	// records that already carry trace context, like replicated ones, keep it
+	ctx, other := tp.Tracer("test").Start(context.Background(), "replicate")
+	defer other.End()
+	injectTraceContext(ctx, record)
+	require.Equal(t, traceparent, record.Headers["traceparent"])
+
+	// without a span, there's nothing to inject
+	record = &api.Record{}
+	injectTraceContext(context.Background(), record)
+	require.Empty(t, record.Headers)
+}